@@ -0,0 +1,127 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package main
+
+import (
+	"github.com/dankomiocevic/mulifs/store"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/golang/glog"
+)
+
+// browseDirs are the special directories that group
+// the Songs by one of their tags, with the index of the
+// store that backs every one of them.
+// Inside them the Songs are organized by value, Artist
+// and Album, like /years/1997/Artist/Album.
+var browseDirs = map[string]string{
+	"genres":  store.GenresIndex,
+	"years":   store.YearsIndex,
+	"decades": store.DecadesIndex,
+}
+
+// isBrowseDir returns true if the name belongs to one
+// of the browse directories.
+func isBrowseDir(name string) bool {
+	_, ok := browseDirs[name]
+	return ok
+}
+
+// isSpecialDir returns true if the name belongs to one
+// of the special directories in the root Directory.
+func isSpecialDir(name string) bool {
+	for _, v := range dirDirs {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// browseLookup finds a directory or a Song file inside
+// a browse directory.
+func (d *Dir) browseLookup(name string) (fs.Node, error) {
+	levels := make([]string, 0, len(d.levels)+1)
+	levels = append(levels, d.levels...)
+	levels = append(levels, name)
+
+	err := store.GetIndexEntry(browseDirs[d.artist], levels)
+	if err != nil {
+		glog.Info(err)
+		return nil, fuse.ENOENT
+	}
+
+	if len(levels) < 4 {
+		return &Dir{fs: d.fs, artist: d.artist, levels: levels, mPoint: d.mPoint}, nil
+	}
+
+	extension := filepath.Ext(name)
+	songName := name[:len(name)-len(extension)]
+	return &File{artist: levels[1], album: levels[2], song: songName, name: name, mPoint: d.mPoint}, nil
+}
+
+// browseReadDirAll lists a browse directory.
+func (d *Dir) browseReadDirAll() ([]fuse.Dirent, error) {
+	a, err := store.ListIndex(browseDirs[d.artist], d.levels)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return a, nil
+}
+
+// genreRename changes the Genre of the Songs moved into
+// a Directory of the genres tree. The Genre is the
+// first level inside genres or the new name when the
+// entry is moved to the genres Directory itself.
+func (d *Dir) genreRename(r *fuse.RenameRequest, newD *Dir) error {
+	genre := r.NewName
+	if len(newD.levels) > 0 {
+		genre = newD.levels[0]
+	}
+
+	if d.artist == "drop" || d.artist == "playlists" {
+		glog.Info("Only the Songs in the Music Library can change their Genre.")
+		return fuse.EPERM
+	}
+
+	switch {
+	case isBrowseDir(d.artist):
+		levels := make([]string, 0, len(d.levels)+1)
+		levels = append(levels, d.levels...)
+		levels = append(levels, r.OldName)
+		return store.SetIndexGenre(browseDirs[d.artist], levels, genre, d.mPoint)
+	case d.layoutDir():
+		return store.SetLayoutGenre(d.layoutPath(r.OldName), genre, d.mPoint)
+	case d.artist == "search":
+		if len(d.album) < 1 {
+			return fuse.EPERM
+		}
+
+		artist, album, song, err := store.GetSearchSong(d.album, r.OldName)
+		if err != nil {
+			return fuse.ENOENT
+		}
+		return store.SetGenre(artist, album, song, genre, d.mPoint)
+	case len(d.artist) < 1:
+		return store.SetGenre(r.OldName, "", "", genre, d.mPoint)
+	case len(d.album) < 1:
+		return store.SetGenre(d.artist, r.OldName, "", genre, d.mPoint)
+	}
+	return store.SetGenre(d.artist, d.album, r.OldName, genre, d.mPoint)
+}
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
 	"github.com/dankomiocevic/mulifs/store"
 	"io/ioutil"
 	"os"
@@ -33,10 +35,15 @@ import (
 // filesystem, the Directories can be Artist or Albums.
 // The root Directory that contains all the Artists
 // is also a Directory.
+// When a custom layout is used levels holds the names
+// of the layout directories up to this one, inside the
+// browse directories it holds the value, Artist and
+// Album.
 type Dir struct {
 	fs     *FS
 	artist string
 	album  string
+	levels []string
 	mPoint string
 }
 
@@ -58,6 +65,16 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 var dirDirs = []fuse.Dirent{
 	{Name: "drop", Type: fuse.DT_Dir},
 	{Name: "playlists", Type: fuse.DT_Dir},
+	{Name: "genres", Type: fuse.DT_Dir},
+	{Name: "years", Type: fuse.DT_Dir},
+	{Name: "decades", Type: fuse.DT_Dir},
+	{Name: "search", Type: fuse.DT_Dir},
+}
+
+// isRulesFile returns true if the name is the rules
+// file of a smart playlist inside a playlist Directory.
+func (d *Dir) isRulesFile(name string) bool {
+	return d.artist == "playlists" && len(d.album) > 0 && name == playlistmgr.RulesName
 }
 
 var _ = fs.NodeStringLookuper(&Dir{})
@@ -68,11 +85,26 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		return &File{artist: d.artist, album: d.album, song: name, name: name, mPoint: d.mPoint}, nil
 	}
 
-	if name[0] == '.' {
+	if name[0] == '.' && !d.isRulesFile(name) {
 		return nil, fuse.EIO
 	}
 
+	if d.layoutDir() && (len(d.levels) > 0 || !isSpecialDir(name)) {
+		return d.layoutLookup(name)
+	}
+
+	if isBrowseDir(d.artist) {
+		return d.browseLookup(name)
+	}
+
+	if d.artist == "search" {
+		return d.searchLookup(name)
+	}
+
 	if len(d.artist) < 1 {
+		if isBrowseDir(name) || name == "search" {
+			return &Dir{fs: d.fs, artist: name, album: "", mPoint: d.mPoint}, nil
+		}
 		if name == "drop" {
 			return &Dir{fs: d.fs, artist: "drop", album: "", mPoint: d.mPoint}, nil
 		}
@@ -97,6 +129,22 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		return &Dir{fs: d.fs, artist: d.artist, album: name, mPoint: d.mPoint}, nil
 	}
 
+	if d.artist != "drop" && d.artist != "playlists" && musicmgr.IsImageFile(name) {
+		f := &File{artist: d.artist, album: d.album, song: name, name: name, mPoint: d.mPoint}
+		if !f.uploading() && (!f.isCover() || !store.HasAlbumCover(d.artist, d.album)) {
+			return nil, fuse.ENOENT
+		}
+		return f, nil
+	}
+
+	if d.artist != "drop" && d.artist != "playlists" && musicmgr.IsLyricsFile(name) {
+		f := &File{artist: d.artist, album: d.album, song: name, name: name, mPoint: d.mPoint}
+		if !f.uploading() && !store.HasSongLyrics(d.artist, d.album, name) {
+			return nil, fuse.ENOENT
+		}
+		return f, nil
+	}
+
 	var err error
 	if d.artist == "drop" {
 		_, err = store.GetDropFilePath(name, d.mPoint)
@@ -135,6 +183,18 @@ var _ = fs.HandleReadDirAller(&Dir{})
 
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	glog.Infof("Entering ReadDirAll\n")
+	if d.layoutDir() {
+		return d.layoutReadDirAll()
+	}
+
+	if isBrowseDir(d.artist) {
+		return d.browseReadDirAll()
+	}
+
+	if d.artist == "search" {
+		return d.searchReadDirAll()
+	}
+
 	if len(d.artist) < 1 {
 		a, err := store.ListArtists()
 		if err != nil {
@@ -226,6 +286,20 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 	if d.mPoint[len(d.mPoint)-1] != '/' {
 		d.mPoint = d.mPoint + "/"
 	}
+	if d.layoutDir() {
+		glog.Info("The directories of the layout are generated from the tags.")
+		return nil, fuse.EPERM
+	}
+
+	if isBrowseDir(d.artist) {
+		glog.Info("The browse directories are read only.")
+		return nil, fuse.EPERM
+	}
+
+	if d.artist == "search" {
+		return d.searchMkdir(name)
+	}
+
 	if len(d.artist) < 1 {
 		glog.Info("Creating an Artist.")
 		ret, err := store.CreateArtist(name)
@@ -317,8 +391,8 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		path := rootPoint + "drop/"
 		extension := filepath.Ext(name)
 
-		if extension != ".mp3" {
-			glog.Info("Only mp3 files are allowed.")
+		if !musicmgr.IsMusicFile(name) {
+			glog.Info("Only music files are allowed.")
 			return nil, nil, fuse.EIO
 		}
 
@@ -368,8 +442,8 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		path := rootPoint + "playlists/" + d.album
 		extension := filepath.Ext(name)
 
-		if extension != ".mp3" {
-			glog.Info("Only mp3 files are allowed.")
+		if !musicmgr.IsMusicFile(name) && !d.isRulesFile(name) {
+			glog.Info("Only music files are allowed.")
 			return nil, nil, fuse.EIO
 		}
 
@@ -404,7 +478,7 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		return f, &FileHandle{r: fi, f: f}, nil
 	}
 
-	if len(d.artist) < 1 || len(d.album) < 1 {
+	if len(d.artist) < 1 || len(d.album) < 1 || d.artist == "search" {
 		return nil, nil, fuse.EPERM
 	}
 
@@ -420,6 +494,30 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	}
 
 	path := rootPoint + d.artist + "/" + d.album + "/"
+	if musicmgr.IsImageFile(nameRaw) || musicmgr.IsLyricsFile(nameRaw) {
+		glog.Infof("Creating album image or lyrics: %s\n", nameRaw)
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			glog.Info("Cannot create folder.")
+			return nil, nil, err
+		}
+
+		f := &File{
+			artist: d.artist,
+			album:  d.album,
+			song:   nameRaw,
+			name:   nameRaw,
+			mPoint: d.mPoint,
+		}
+
+		fi, err := os.Create(f.uploadPath())
+		if err != nil {
+			glog.Infof("Cannot create file: %s\n", err)
+			return nil, nil, err
+		}
+		return f, &FileHandle{r: fi, f: f}, nil
+	}
+
 	name, err := store.CreateSong(d.artist, d.album, nameRaw, path)
 	if err != nil {
 		glog.Info("Error creating song.")
@@ -465,10 +563,31 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return nil
 	}
 
+	if d.isRulesFile(name) && !req.Dir {
+		err := playlistmgr.DeleteRules(d.album, d.mPoint)
+		if err != nil {
+			return fuse.EIO
+		}
+		return store.RegeneratePlaylistFile(d.album, d.mPoint)
+	}
+
 	if name[0] == '.' {
 		return fuse.EIO
 	}
 
+	if d.layoutDir() && (len(d.levels) > 0 || !isSpecialDir(name)) {
+		return d.layoutRemove(req)
+	}
+
+	if isBrowseDir(d.artist) {
+		glog.Info("The browse directories are read only.")
+		return fuse.EPERM
+	}
+
+	if d.artist == "search" {
+		return d.searchRemove(req)
+	}
+
 	if req.Dir {
 		if len(name) < 1 {
 			return fuse.EIO
@@ -483,6 +602,10 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 				return fuse.EIO
 			}
 
+			if isSpecialDir(name) {
+				return fuse.EIO
+			}
+
 			err := store.DeleteArtist(name, d.mPoint)
 			if err != nil {
 				return fuse.EIO
@@ -558,12 +681,47 @@ func (d *Dir) Rename(ctx context.Context, r *fuse.RenameRequest, newDir fs.Node)
 		return fuse.EPERM
 	}
 
+	// Every rename except the playlists ones changes the
+	// tags, with read only tags the change would only be
+	// stored in the database and the next scan would add
+	// the Song again from the old tags.
+	if musicmgr.IsReadOnly() && (d.artist != "playlists" || len(d.album) > 0) {
+		glog.Info("Cannot rename with read only tags.")
+		return fuse.EPERM
+	}
+
+	if newD.artist == "genres" {
+		glog.Info("Changing the Genre.")
+		return d.genreRename(r, newD)
+	}
+
+	if isBrowseDir(d.artist) || isBrowseDir(newD.artist) {
+		glog.Info("The browse directories are read only.")
+		return fuse.EPERM
+	}
+
+	if d.artist == "search" || newD.artist == "search" {
+		glog.Info("The search directory is read only.")
+		return fuse.EPERM
+	}
+
+	if d.layoutDir() {
+		if len(d.levels) == 0 && isSpecialDir(r.OldName) {
+			return fuse.EPERM
+		}
+		return d.layoutRename(r, newD)
+	}
+
 	if len(d.artist) < 1 {
 		glog.Info("Changing artist name.")
 		if len(newD.artist) > 0 {
 			return fuse.EPERM
 		}
 
+		if isSpecialDir(r.OldName) || isSpecialDir(r.NewName) {
+			return fuse.EPERM
+		}
+
 		err := store.MoveArtist(r.OldName, r.NewName, d.mPoint)
 		return err
 	}
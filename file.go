@@ -24,6 +24,7 @@ import (
 	"github.com/dankomiocevic/mulifs/store"
 	"github.com/golang/glog"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -47,6 +48,57 @@ type File struct {
 	mPoint string
 }
 
+// isImage returns true if the file is an image inside
+// an Album, it can be the virtual cover file or an
+// image being copied to set the Album cover.
+func (f *File) isImage() bool {
+	if f.artist == "drop" || f.artist == "playlists" || len(f.album) < 1 {
+		return false
+	}
+	return musicmgr.IsImageFile(f.name)
+}
+
+// isCover returns true if the file is the virtual
+// cover file of an Album.
+func (f *File) isCover() bool {
+	return f.isImage() && store.IsCoverFile(f.name)
+}
+
+// isLyrics returns true if the file is the lyrics
+// file of a Song inside an Album.
+func (f *File) isLyrics() bool {
+	if f.artist == "drop" || f.artist == "playlists" || len(f.album) < 1 {
+		return false
+	}
+	return musicmgr.IsLyricsFile(f.name)
+}
+
+// isRules returns true if the file is the rules file
+// of a smart playlist.
+func (f *File) isRules() bool {
+	return f.artist == "playlists" && len(f.album) > 0 && f.name == playlistmgr.RulesName
+}
+
+// uploadPath returns the path of the temporary file
+// that holds an image or a lyrics file while it is
+// copied into an Album. It is hidden inside the actual
+// Album folder.
+func (f *File) uploadPath() string {
+	rootPoint := f.mPoint
+	if rootPoint[len(rootPoint)-1] != '/' {
+		rootPoint = rootPoint + "/"
+	}
+	return rootPoint + f.artist + "/" + f.album + "/." + f.name
+}
+
+// uploading returns true if the image or the lyrics
+// file is being copied into the Album and was not
+// embedded in the songs yet.
+func (f *File) uploading() bool {
+	_, err := os.Stat(f.uploadPath())
+	return err == nil
+}
+
 /** This function is used to do nothing to the file
  *	but to update the Touch time.
  */
@@ -56,7 +108,7 @@ func DelayedVoid(f File) error {
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	glog.Infof("Entering file Attr with name: %s, Artist: %s and Album: %s.\n", f.name, f.artist, f.album)
-	if f.name[0] == '.' {
+	if f.name[0] == '.' && !f.isRules() {
 		if f.name == ".description" {
 			descriptionJson, err := store.GetDescription(f.artist, f.album, f.name)
 			if err != nil {
@@ -74,6 +126,52 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 		} else {
 			return fuse.EPERM
 		}
+	} else if (f.isImage() || f.isLyrics()) && f.uploading() {
+		fi, err := os.Stat(f.uploadPath())
+		if err != nil {
+			return err
+		}
+
+		a.Size = uint64(fi.Size())
+		a.Mode = 0666
+		if config_params.uid != 0 {
+			a.Uid = uint32(config_params.uid)
+		}
+		if config_params.gid != 0 {
+			a.Gid = uint32(config_params.gid)
+		}
+	} else if f.isImage() {
+		if !f.isCover() {
+			return fuse.ENOENT
+		}
+
+		cover, err := store.GetAlbumCover(f.artist, f.album)
+		if err != nil {
+			return err
+		}
+
+		a.Size = uint64(len(cover))
+		a.Mode = 0444
+		if config_params.uid != 0 {
+			a.Uid = uint32(config_params.uid)
+		}
+		if config_params.gid != 0 {
+			a.Gid = uint32(config_params.gid)
+		}
+	} else if f.isLyrics() {
+		lyrics, err := store.GetSongLyrics(f.artist, f.album, f.name)
+		if err != nil {
+			return err
+		}
+
+		a.Size = uint64(len(lyrics))
+		a.Mode = 0666
+		if config_params.uid != 0 {
+			a.Uid = uint32(config_params.uid)
+		}
+		if config_params.gid != 0 {
+			a.Gid = uint32(config_params.gid)
+		}
 	} else {
 		var songPath string
 		var err error
@@ -126,10 +224,50 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 		return &FileHandle{r: nil, f: f}, nil
 	}
 
-	if f.name[0] == '.' {
+	if f.name[0] == '.' && !f.isRules() {
 		return nil, fuse.EPERM
 	}
 
+	if f.isImage() {
+		// Writing an image in the Album sets the cover,
+		// it is stored apart until it is embedded.
+		if !req.Flags.IsReadOnly() || f.uploading() {
+			r, err := os.OpenFile(f.uploadPath(), int(req.Flags)|os.O_CREATE, 0666)
+			if err != nil {
+				return nil, err
+			}
+			return &FileHandle{r: r, f: f}, nil
+		}
+
+		if !f.isCover() {
+			return nil, fuse.ENOENT
+		}
+
+		cover, err := store.GetAlbumCover(f.artist, f.album)
+		if err != nil {
+			return nil, err
+		}
+		return &FileHandle{r: nil, f: f, data: cover}, nil
+	}
+
+	if f.isLyrics() {
+		// Writing a lyrics file stores the lyrics in the
+		// Song, it is stored apart until it is embedded.
+		if !req.Flags.IsReadOnly() || f.uploading() {
+			r, err := os.OpenFile(f.uploadPath(), int(req.Flags)|os.O_CREATE, 0666)
+			if err != nil {
+				return nil, err
+			}
+			return &FileHandle{r: r, f: f}, nil
+		}
+
+		lyrics, err := store.GetSongLyrics(f.artist, f.album, f.name)
+		if err != nil {
+			return nil, err
+		}
+		return &FileHandle{r: nil, f: f, data: lyrics}, nil
+	}
+
 	if runtime.GOOS == "darwin" {
 		resp.Flags |= fuse.OpenDirectIO
 	}
@@ -167,9 +305,13 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	return &FileHandle{r: r, f: f}, nil
 }
 
+// FileHandle is an open file in the filesystem.
+// r is the actual file for the Songs, the virtual
+// files keep their contents in data instead.
 type FileHandle struct {
-	r *os.File
-	f *File
+	r    *os.File
+	f    *File
+	data []byte
 }
 
 var _ fs.Handle = (*FileHandle)(nil)
@@ -186,9 +328,9 @@ func DelayedHandlePlaylistSong(f File) error {
 	path := rootPoint + "playlists/" + f.album + "/" + f.name
 
 	extension := filepath.Ext(f.name)
-	if extension != ".mp3" {
+	if !musicmgr.IsMusicFile(f.name) {
 		os.Remove(path)
-		return errors.New("File is not an mp3.")
+		return errors.New("File is not a music file.")
 	}
 
 	src, err := os.Stat(path)
@@ -196,7 +338,7 @@ func DelayedHandlePlaylistSong(f File) error {
 		return errors.New("File not found.")
 	}
 
-	err, tags := musicmgr.GetMp3Tags(path)
+	err, tags := musicmgr.GetTags(path)
 	if err != nil {
 		os.Remove(path)
 		return err
@@ -205,10 +347,10 @@ func DelayedHandlePlaylistSong(f File) error {
 	artist := store.GetCompatibleString(tags.Artist)
 	album := store.GetCompatibleString(tags.Album)
 	title := tags.Title
-	if strings.HasSuffix(title, ".mp3") {
-		title = title[:len(title)-len(".mp3")]
+	if strings.HasSuffix(title, extension) {
+		title = title[:len(title)-len(extension)]
 	}
-	title = store.GetCompatibleString(title) + ".mp3"
+	title = store.GetCompatibleString(title) + extension
 
 	newPath, err := store.GetFilePath(artist, album, title)
 	if err == nil {
@@ -240,6 +382,20 @@ func DelayedHandlePlaylistSong(f File) error {
 	return err
 }
 
+// DelayedHandleRules writes again the playlist file
+// of a smart playlist when its rules change and is
+// called by the background dispatcher after some time
+// has passed.
+func DelayedHandleRules(f File) error {
+	err := store.CheckPlaylistRules(f.album, f.mPoint)
+	if err != nil {
+		glog.Errorf("Wrong rules in playlist %s: %s\n", f.album, err)
+		return err
+	}
+
+	return store.RegeneratePlaylistFile(f.album, f.mPoint)
+}
+
 // DelayedHandleDrop handles a dropped file
 // but is called by the background dispatcher
 // after some time has passed.
@@ -260,6 +416,45 @@ func DelayedHandleDrop(f File) error {
 	return nil
 }
 
+// DelayedHandleCover embeds an image copied into an
+// Album as the cover of all its songs and is called
+// by the background dispatcher after some time has
+// passed.
+func DelayedHandleCover(f File) error {
+	path := f.uploadPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	err = store.SetAlbumCover(f.artist, f.album, data)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+// DelayedHandleLyrics embeds a lyrics file copied into
+// an Album in the matching Song and is called by the
+// background dispatcher after some time has passed.
+func DelayedHandleLyrics(f File) error {
+	path := f.uploadPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	err = store.SetSongLyrics(f.artist, f.album, f.name, data)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
 var _ fs.HandleReleaser = (*FileHandle)(nil)
 
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
@@ -272,6 +467,10 @@ func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) err
 		if fh.f.name[0] == '.' {
 			return fuse.EPERM
 		}
+
+		if fh.f.isCover() || fh.f.isLyrics() {
+			return nil
+		}
 	}
 
 	if fh.r == nil {
@@ -288,6 +487,14 @@ func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) err
 		return ret_val
 	}
 
+	if fh.f != nil && fh.f.isRules() {
+		glog.Infof("Entered Release with the rules of playlist: %s\n", fh.f.album)
+		ret_val := fh.r.Close()
+
+		PushFileItem(*fh.f, DelayedHandleRules)
+		return ret_val
+	}
+
 	if fh.f != nil && fh.f.artist == "playlists" {
 		glog.Infof("Entered Release with playlist song: %s\n", fh.f.name)
 		ret_val := fh.r.Close()
@@ -296,6 +503,22 @@ func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) err
 		return ret_val
 	}
 
+	if fh.f != nil && fh.f.isImage() {
+		glog.Infof("Entered Release with album image: %s\n", fh.f.name)
+		ret_val := fh.r.Close()
+
+		PushFileItem(*fh.f, DelayedHandleCover)
+		return ret_val
+	}
+
+	if fh.f != nil && fh.f.isLyrics() {
+		glog.Infof("Entered Release with lyrics file: %s\n", fh.f.name)
+		ret_val := fh.r.Close()
+
+		PushFileItem(*fh.f, DelayedHandleLyrics)
+		return ret_val
+	}
+
 	// This is not an music file or this is a strange situation.
 	if fh.f == nil || len(fh.f.artist) < 1 || len(fh.f.album) < 1 {
 		glog.Info("Entered Release: Artist or Album not set.\n")
@@ -304,15 +527,16 @@ func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) err
 
 	glog.Infof("Entered Release: Artist: %s, Album: %s, Song: %s\n", fh.f.artist, fh.f.album, fh.f.name)
 	ret_val := fh.r.Close()
-	extension := filepath.Ext(fh.f.name)
 	songPath, err := store.GetFilePath(fh.f.artist, fh.f.album, fh.f.name)
 	if err != nil {
 		return err
 	}
 
-	if extension == ".mp3" {
+	if musicmgr.IsMusicFile(fh.f.name) {
 		//TODO: Use the correct artist and album
-		musicmgr.SetMp3Tags(fh.f.artist, fh.f.album, fh.f.song, songPath)
+		musicmgr.SetTags(fh.f.artist, fh.f.album, fh.f.song, songPath)
+		_, tags := musicmgr.GetTags(songPath)
+		store.UpdateSongTags(fh.f.artist, fh.f.album, fh.f.name, &tags)
 	}
 	return ret_val
 }
@@ -347,6 +571,19 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 			return nil
 		}
 
+		if fh.f.isCover() || fh.f.isLyrics() {
+			glog.Info("Reading virtual file\n")
+			if req.Offset >= int64(len(fh.data)) {
+				return nil
+			}
+			end := req.Offset + int64(req.Size)
+			if end > int64(len(fh.data)) {
+				end = int64(len(fh.data))
+			}
+			resp.Data = fh.data[req.Offset:end]
+			return nil
+		}
+
 		glog.Info("There is no file handler.\n")
 		return fuse.EIO
 	}
@@ -396,6 +633,9 @@ func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	}
 
 	if fh.r == nil {
+		if fh.f != nil && (fh.f.isCover() || fh.f.isLyrics()) {
+			return nil
+		}
 		glog.Infof("There is no file handler.\n")
 		return fuse.EIO
 	}
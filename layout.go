@@ -0,0 +1,123 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package main
+
+import (
+	"github.com/dankomiocevic/mulifs/store"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/golang/glog"
+)
+
+// layoutDir returns true if the Directory is the root
+// or one of the directories generated by a custom
+// layout, instead of an Artist or an Album.
+func (d *Dir) layoutDir() bool {
+	return store.CustomLayout() && len(d.artist) < 1
+}
+
+// layoutPath returns the levels of the layout for an
+// entry inside the Directory.
+func (d *Dir) layoutPath(name string) []string {
+	levels := make([]string, 0, len(d.levels)+1)
+	levels = append(levels, d.levels...)
+	return append(levels, name)
+}
+
+// layoutLookup finds a directory or a Song file inside
+// a Directory of the layout.
+func (d *Dir) layoutLookup(name string) (fs.Node, error) {
+	levels := d.layoutPath(name)
+	if len(d.levels) < store.LayoutDepth() {
+		err := store.GetLayoutDir(levels)
+		if err != nil {
+			glog.Info(err)
+			return nil, err
+		}
+		return &Dir{fs: d.fs, levels: levels, mPoint: d.mPoint}, nil
+	}
+
+	artist, album, song, err := store.GetLayoutSong(levels)
+	if err != nil {
+		glog.Info(err)
+		return nil, err
+	}
+
+	extension := filepath.Ext(song)
+	songName := song[:len(song)-len(extension)]
+	return &File{artist: artist, album: album, song: songName, name: song, mPoint: d.mPoint}, nil
+}
+
+// layoutReadDirAll lists a Directory of the layout, the
+// root Directory also has the drop and playlists
+// directories.
+func (d *Dir) layoutReadDirAll() ([]fuse.Dirent, error) {
+	a, err := store.ListLayout(d.levels)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+
+	if len(d.levels) == 0 {
+		a = append(a, dirDirs...)
+	}
+	return a, nil
+}
+
+// layoutRemove deletes a Song file from a Directory of
+// the layout, the directories disappear when they
+// have no Songs.
+func (d *Dir) layoutRemove(req *fuse.RemoveRequest) error {
+	if req.Dir {
+		glog.Info("Cannot remove directories of the layout.")
+		return fuse.EPERM
+	}
+
+	artist, album, song, err := store.GetLayoutSong(d.layoutPath(req.Name))
+	if err != nil {
+		return fuse.EIO
+	}
+
+	fullPath, err := store.GetFilePath(artist, album, song)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	err = store.DeleteSong(artist, album, song, d.mPoint)
+	if err != nil {
+		return fuse.EIO
+	}
+	return os.Remove(fullPath)
+}
+
+// layoutRename renames or moves a directory or a Song
+// file of the layout, the tags of the Songs are
+// changed to match the new names.
+func (d *Dir) layoutRename(r *fuse.RenameRequest, newD *Dir) error {
+	if !newD.layoutDir() {
+		glog.Info("Cannot move outside the layout.")
+		return fuse.EPERM
+	}
+
+	if len(newD.levels) == 0 && isSpecialDir(r.NewName) {
+		return fuse.EPERM
+	}
+
+	return store.RenameLayout(d.layoutPath(r.OldName), newD.layoutPath(r.NewName), d.mPoint)
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/dankomiocevic/mulifs/musicmgr"
 	"github.com/dankomiocevic/mulifs/store"
 	"github.com/dankomiocevic/mulifs/tools"
 	"log"
@@ -50,9 +51,17 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "  %s %s\n", progName, progVer)
 	fmt.Fprintf(os.Stderr, "\nSynopsis:\n")
 	fmt.Fprintf(os.Stderr, "  %s [global_options] MUSIC_SOURCE MOUNTPOINT \n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [global_options] -replaygain MUSIC_SOURCE \n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [global_options] -write_tags MUSIC_SOURCE \n", progName)
 	fmt.Fprintf(os.Stderr, "\nDescription:\n")
 	fmt.Fprintf(os.Stderr, "  Mounts a filesystem in MOUNTPOINT with the music files obtained\n")
 	fmt.Fprintf(os.Stderr, "  from MUSIC_SOURCE ordered in folders by Artist and Album.\n")
+	fmt.Fprintf(os.Stderr, "  With -replaygain it writes the ReplayGain tags on the songs\n")
+	fmt.Fprintf(os.Stderr, "  in MUSIC_SOURCE and exits without mounting the filesystem.\n")
+	fmt.Fprintf(os.Stderr, "  With -write_tags it writes the tags stored in the database on\n")
+	fmt.Fprintf(os.Stderr, "  the songs and exits without mounting the filesystem.\n")
+	fmt.Fprintf(os.Stderr, "  With -restore_file, -restore_album or -restore_since it restores\n")
+	fmt.Fprintf(os.Stderr, "  the tags backed up before MuLi modified them and exits.\n")
 	fmt.Fprintf(os.Stderr, "\n  For more information please visit:\n")
 	fmt.Fprintf(os.Stderr, "    <http://github.com/dankomiocevic/mulifs>\n")
 	fmt.Fprintf(os.Stderr, "\nParams:\n")
@@ -76,12 +85,28 @@ func main() {
 	var err error
 	var db_path string
 	var mount_ops string
+	var charset string
+	var path_patterns string
+	var layout string
+	var restore_file string
+	var restore_album string
+	var restore_since string
 	flag.StringVar(&db_path, "db_path", "muli.db", "Database path.")
 	flag.StringVar(&mount_ops, "o", "", "Default mount options.")
 	uid_conf := flag.Uint("uid", 0, "User owner of the files.")
 	gid_conf := flag.Uint("gid", 0, "Group owner of the files.")
 	allow_other := flag.Bool("allow_other", false, "Allow other users to access the filesystem.")
 	allow_root := flag.Bool("allow_root", false, "Allow root to access the filesystem.")
+	flag.StringVar(&charset, "charset", "cp1252", "Charset of the legacy tags when it cannot be detected.")
+	flag.StringVar(&path_patterns, "path_patterns", "", "Patterns separated by semicolons to infer the missing tags from the path.")
+	flag.StringVar(&layout, "layout", "", "Template of the directories and file names, like %genre%/%artist%/%year% - %album%/%track% %title%.")
+	repair_charset := flag.Bool("repair_charset", false, "Rewrite the legacy tags using Unicode.")
+	replaygain := flag.Bool("replaygain", false, "Write the ReplayGain tags on the songs and exit.")
+	read_only_tags := flag.Bool("read_only_tags", false, "Never modify the tags in the music files.")
+	write_tags := flag.Bool("write_tags", false, "Write the tags stored in the database on the songs and exit.")
+	flag.StringVar(&restore_file, "restore_file", "", "Restore the original tags of a music file and exit.")
+	flag.StringVar(&restore_album, "restore_album", "", "Restore the original tags of the songs in an Artist/Album and exit.")
+	flag.StringVar(&restore_since, "restore_since", "", "Restore the tags changed after a time (2006-01-02 15:04:05) and exit.")
 
 	flag.Parse()
 		
@@ -124,6 +149,16 @@ func main() {
 					uint_gid := uint(parsed_gid)
 					gid_conf = &uint_gid
 				}
+			} else if strings.Compare(token, "read_only_tags") == 0 {
+				read_only_tags = newTrue()
+			} else if strings.Compare(token, "repair_charset") == 0 {
+				repair_charset = newTrue()
+			} else if strings.HasPrefix(token, "path_patterns=") {
+				path_patterns = token[len("path_patterns="):]
+			} else if strings.HasPrefix(token, "layout=") {
+				layout = token[len("layout="):]
+			} else if strings.HasPrefix(token, "charset=") {
+				charset = token[len("charset="):]
 			} else if strings.HasPrefix(token, "db_path=") {
 				db_path = token[len("db_path="):]
 				if len(db_path) < 3 {
@@ -138,7 +173,9 @@ func main() {
 		uid: *uid_conf, gid: *gid_conf, allow_users: *allow_other, allow_root: *allow_root,
 	}
 
-	if flag.NArg() < 2 {
+	restore := len(restore_file) > 0 || len(restore_album) > 0 || len(restore_since) > 0
+	command := *replaygain || *write_tags || restore
+	if flag.NArg() < 2 && !(command && flag.NArg() == 1) {
 		usage()
 		os.Exit(2)
 	}
@@ -150,16 +187,64 @@ func main() {
 		os.Exit(3)
 	}
 
-	if mountpoint[0] == '-' {
+	if !command && mountpoint[0] == '-' {
 		usage()
 		os.Exit(4)
 	}
 
+	// The tags are always written when it is
+	// explicitly requested.
+	musicmgr.SetReadOnly(*read_only_tags && !*write_tags && !restore)
+
+	err = musicmgr.ConfigureCharset(charset, *repair_charset)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = musicmgr.SetPathPatterns(strings.Split(path_patterns, ";"))
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	err = store.SetLayout(layout)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
 	err = store.InitDB(db_path)
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(5)
 	}
+	defer store.CloseDB()
+
+	if *write_tags {
+		err = tools.WriteTags()
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(10)
+		}
+		return
+	}
+
+	if restore {
+		if len(restore_file) > 0 {
+			err = tools.RestoreFile(restore_file)
+		} else if len(restore_album) > 0 {
+			err = tools.RestoreAlbum(restore_album)
+		} else {
+			err = tools.RestoreSince(restore_since)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(10)
+		}
+		return
+	}
 
 	path, err = filepath.Abs(path)
 	if err != nil {
@@ -173,6 +258,15 @@ func main() {
 		os.Exit(7)
 	}
 
+	if *replaygain {
+		err = tools.ReplayGain()
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(10)
+		}
+		return
+	}
+
 	err = tools.ScanPlaylistFolder(path)
 	if err != nil {
 		log.Fatal(err)
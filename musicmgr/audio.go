@@ -0,0 +1,53 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"errors"
+	"time"
+)
+
+// AudioInfo describes the audio stream of a music file.
+// Bitrate is the average bitrate in kbps, SampleRate
+// is in Hz and VBR is true when the stream uses a
+// variable bitrate.
+type AudioInfo struct {
+	Duration    time.Duration
+	Bitrate     int
+	SampleRate  int
+	Channels    int
+	ChannelMode string
+	VBR         bool
+}
+
+// AudioInfoReader is implemented by the backends that
+// can read the properties of the audio stream in the
+// music files.
+type AudioInfoReader interface {
+	ReadAudioInfo(path string) (AudioInfo, error)
+}
+
+// GetAudioInfo returns the properties of the audio
+// stream in the music file, using the backend
+// registered for its extension.
+func GetAudioInfo(path string) (AudioInfo, error) {
+	reader, ok := backendFor(path).(AudioInfoReader)
+	if !ok {
+		return AudioInfo{}, errors.New("Audio information not supported.")
+	}
+	return reader.ReadAudioInfo(path)
+}
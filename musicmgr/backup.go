@@ -0,0 +1,105 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"errors"
+)
+
+// TagSnapshotter is implemented by the backends that
+// can save the tags of a music file exactly as they
+// are stored, including the frames MuLi does not
+// know, and put them back later. The pictures are
+// left out of the snapshots so the images are not
+// copied in every backup, restoring the tags keeps
+// the pictures the file has at that moment.
+type TagSnapshotter interface {
+	SnapshotTags(path string) ([]byte, error)
+	RestoreTags(path string, snapshot []byte) error
+}
+
+// BackupFunc receives the snapshot of the tags of a
+// music file taken right before they are modified,
+// along with the values that were read from them.
+type BackupFunc func(path string, snapshot []byte, tags FileTags)
+
+// backupFunc is called before any change in the tags,
+// it is nil when the backups are disabled.
+var backupFunc BackupFunc
+
+// SetBackupFunc sets the function that keeps the
+// original tags of the music files. It is called by
+// every function that modifies the tags, before the
+// file is written. Use nil to disable the backups.
+func SetBackupFunc(fn BackupFunc) {
+	backupFunc = fn
+}
+
+// SnapshotTags returns a copy of the tags of the music
+// file that can be stored with RestoreTags, using the
+// backend registered for its extension.
+func SnapshotTags(path string) ([]byte, error) {
+	snapshotter, ok := backendFor(path).(TagSnapshotter)
+	if !ok {
+		return nil, errors.New("Tag snapshots not supported.")
+	}
+	return snapshotter.SnapshotTags(path)
+}
+
+// RestoreTags replaces all the tags of the music file
+// with the ones from a snapshot returned by
+// SnapshotTags, using the backend registered for its
+// extension. No backup is made before restoring.
+func RestoreTags(path string, snapshot []byte) error {
+	snapshotter, ok := backendFor(path).(TagSnapshotter)
+	if !ok {
+		return errors.New("Tag snapshots not supported.")
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+	return snapshotter.RestoreTags(path, snapshot)
+}
+
+// takeSnapshot returns the snapshot and the values of
+// the tags of the music file. The last value is false
+// if the backups are disabled or the snapshot cannot
+// be taken.
+func takeSnapshot(path string) ([]byte, FileTags, bool) {
+	if backupFunc == nil {
+		return nil, FileTags{}, false
+	}
+
+	snapshot, err := SnapshotTags(path)
+	if err != nil {
+		return nil, FileTags{}, false
+	}
+
+	var tags FileTags
+	if backend := backendFor(path); backend != nil {
+		tags, _ = backend.ReadTags(path)
+	}
+	return snapshot, tags, true
+}
+
+// backupTags saves the current tags of the music file
+// with the backup function before they are modified.
+func backupTags(path string) {
+	if snapshot, tags, ok := takeSnapshot(path); ok {
+		backupFunc(path, snapshot, tags)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"testing"
+)
+
+// snapshotBackend is a backend that can store pictures
+// and take snapshots of the tags.
+type snapshotBackend interface {
+	TagBackend
+	PictureReader
+	PictureWriter
+	TagSnapshotter
+}
+
+// TestSnapshotPictures checks that the snapshots do not
+// keep the pictures and that restoring the tags keeps
+// the pictures the file has.
+func TestSnapshotPictures(t *testing.T) {
+	fixtures := []struct {
+		name    string
+		backend snapshotBackend
+		data    []byte
+	}{
+		{"song.mp3", mp3Backend{}, append(id3Fixture{version: 3, padding: 256}.encode(), testPayload(10000, 70)...)},
+		{"song.flac", flacBackend{}, flacFixture(16, testPayload(10000, 71))},
+		{"song.ogg", oggBackend{}, oggFixture(false)},
+		{"song.m4a", mp4Backend{}, mp4Fixture(mp4Layout{})},
+	}
+
+	for _, f := range fixtures {
+		path, clean := writeFixture(t, f.name, f.data)
+		defer clean()
+
+		first := Picture{Type: FrontCover, MimeType: "image/jpeg", Data: testPayload(40000, 72)}
+		if err := f.backend.WritePicture(path, first); err != nil {
+			t.Fatal(f.name, err)
+		}
+
+		snapshot, err := f.backend.SnapshotTags(path)
+		if err != nil {
+			t.Fatal(f.name, err)
+		}
+		if len(snapshot) >= len(first.Data) {
+			t.Errorf("%s: the snapshot keeps the picture, %d bytes.", f.name, len(snapshot))
+		}
+
+		second := Picture{Type: FrontCover, MimeType: "image/jpeg", Data: testPayload(30000, 73)}
+		if err = f.backend.WriteTags(path, FileTags{Title: "Changed"}); err != nil {
+			t.Fatal(f.name, err)
+		}
+		if err = f.backend.WritePicture(path, second); err != nil {
+			t.Fatal(f.name, err)
+		}
+
+		if err = f.backend.RestoreTags(path, snapshot); err != nil {
+			t.Fatal(f.name, err)
+		}
+
+		tags, err := f.backend.ReadTags(path)
+		if err != nil || tags.Title != "Fixture" {
+			t.Errorf("%s: the tags were not restored: %v %v", f.name, tags, err)
+		}
+		pictures, err := f.backend.ReadPictures(path)
+		if err != nil || len(pictures) != 1 || !bytes.Equal(pictures[0].Data, second.Data) {
+			t.Errorf("%s: the picture was not kept: %d %v", f.name, len(pictures), err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// legacyCharsets are the single byte charsets that can
+// be used as fallback to decode the legacy tags.
+var legacyCharsets = map[string]*charmap.Charmap{
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-2":   charmap.ISO8859_2,
+	"iso-8859-5":   charmap.ISO8859_5,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"cp866":        charmap.CodePage866,
+	"cp1250":       charmap.Windows1250,
+	"windows-1250": charmap.Windows1250,
+	"cp1251":       charmap.Windows1251,
+	"windows-1251": charmap.Windows1251,
+	"cp1252":       charmap.Windows1252,
+	"windows-1252": charmap.Windows1252,
+	"koi8-r":       charmap.KOI8R,
+	"koi8-u":       charmap.KOI8U,
+}
+
+// charsetConfig stores the configuration used to
+// decode the tags stored as ISO-8859-1 text.
+// fallback is the charset used when the encoding
+// cannot be detected and rewrite enables storing the
+// repaired tags back in the files.
+var charsetConfig = struct {
+	fallback *charmap.Charmap
+	rewrite  bool
+}{fallback: charmap.Windows1252}
+
+// CharsetRepairer is implemented by the backends that
+// store text in legacy charsets and can rewrite it
+// using Unicode. RepairCharset returns true if the
+// file was modified.
+type CharsetRepairer interface {
+	RepairCharset(path string) (bool, error)
+}
+
+// ConfigureCharset sets the charset used to decode the
+// legacy tags when the encoding cannot be detected and
+// whether the repaired tags are written back in the
+// files when they are read.
+func ConfigureCharset(fallback string, rewrite bool) error {
+	cm, ok := legacyCharsets[strings.ToLower(fallback)]
+	if !ok {
+		return errors.New("Unknown charset: " + fallback)
+	}
+
+	charsetConfig.fallback = cm
+	charsetConfig.rewrite = rewrite
+	return nil
+}
+
+// RepairCharset rewrites the tags of the music file
+// that are stored in a legacy charset using Unicode,
+// using the backend registered for its extension.
+// It returns true if the file was modified.
+func RepairCharset(path string) (bool, error) {
+	repairer, ok := backendFor(path).(CharsetRepairer)
+	if !ok {
+		return false, nil
+	}
+	if readOnly {
+		return false, ErrReadOnly
+	}
+
+	// The snapshot is only kept when the file changes.
+	snapshot, tags, ok := takeSnapshot(path)
+	changed, err := repairer.RepairCharset(path)
+	if changed && ok {
+		backupFunc(path, snapshot, tags)
+	}
+	return changed, err
+}
+
+// decodeLatin1 decodes ISO-8859-1 text as it is,
+// without trying to detect the real charset.
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// detectCharset guesses the charset of text that was
+// stored as ISO-8859-1 but that many taggers write in
+// the charset of the system instead.
+// Cyrillic text in Windows-1251 is detected when most
+// of the letters are in the upper half of the table,
+// since a Cyrillic word never uses ASCII letters, and
+// Windows-1252 when the non ASCII letters are only a
+// few accented ones among ASCII letters. The fallback
+// charset is used when it is not clear.
+// It returns nil if the text is plain ASCII or valid
+// UTF-8, that some taggers also write.
+func detectCharset(data []byte) *charmap.Charmap {
+	high, ascii, symbols := 0, 0, 0
+	for _, b := range data {
+		switch {
+		case b >= 0xc0 || b == 0xa8 || b == 0xb8:
+			high++
+		case b >= 0x80:
+			symbols++
+		case b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z':
+			ascii++
+		}
+	}
+
+	switch {
+	case high+symbols == 0 || utf8.Valid(data):
+		return nil
+	case high > ascii:
+		return charmap.Windows1251
+	case high > 0 && high*2 < ascii:
+		return charmap.Windows1252
+	}
+	return charsetConfig.fallback
+}
+
+// decodeLegacy decodes text stored as ISO-8859-1,
+// detecting the charset that was actually used to
+// write it.
+func decodeLegacy(data []byte) string {
+	cm := detectCharset(data)
+	if cm == nil {
+		return string(data)
+	}
+
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = cm.DecodeByte(b)
+	}
+	return string(runes)
+}
@@ -0,0 +1,512 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"os"
+)
+
+// FLAC metadata block types used by MuLi.
+const (
+	flacStreamInfo    = 0
+	flacPadding       = 1
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+// flacDefaultPadding is the amount of padding added
+// when the metadata does not fit anymore and the
+// whole file needs to be written again.
+const flacDefaultPadding = 4096
+
+// flacMaxBlockSize is the biggest length that can be
+// stored in a metadata block header.
+const flacMaxBlockSize = 1<<24 - 1
+
+// flacBlock is a metadata block from a FLAC file.
+type flacBlock struct {
+	blockType byte
+	data      []byte
+}
+
+// flacMetadata describes the metadata section of a
+// FLAC file. The padding blocks are not kept, they
+// are generated again every time the metadata is
+// written.
+// start is the offset of the first metadata block and
+// end is the offset where the audio frames start.
+type flacMetadata struct {
+	start  int64
+	end    int64
+	blocks []flacBlock
+}
+
+// skipID3v2 positions the reader after the ID3v2 tag
+// found at the beginning of the file, if there is any,
+// and returns the new offset.
+// Some taggers add an ID3v2 tag in front of formats
+// that do not support it, like FLAC.
+func skipID3v2(r io.ReadSeeker) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	if string(header[:3]) != "ID3" {
+		return r.Seek(0, 0)
+	}
+
+	size := int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 |
+		int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f)
+	size += 10
+	// Footer present
+	if header[5]&0x10 != 0 {
+		size += 10
+	}
+	return r.Seek(size, 0)
+}
+
+// readFlacMetadata reads all the metadata blocks from
+// a FLAC file.
+func readFlacMetadata(r io.ReadSeeker) (*flacMetadata, error) {
+	offset, err := skipID3v2(r)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := make([]byte, 4)
+	if _, err = io.ReadFull(r, marker); err != nil {
+		return nil, err
+	}
+	if string(marker) != "fLaC" {
+		return nil, errors.New("Not a FLAC file.")
+	}
+
+	meta := &flacMetadata{start: offset + 4}
+	pos := meta.start
+	header := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if blockType == flacPadding {
+			if _, err = r.Seek(length, 1); err != nil {
+				return nil, err
+			}
+		} else {
+			data := make([]byte, length)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			meta.blocks = append(meta.blocks, flacBlock{blockType, data})
+		}
+
+		pos += 4 + length
+		if last {
+			break
+		}
+	}
+	meta.end = pos
+
+	if len(meta.blocks) < 1 || meta.blocks[0].blockType != flacStreamInfo {
+		return nil, errors.New("FLAC STREAMINFO block not found.")
+	}
+	return meta, nil
+}
+
+// encodeFlacBlocks returns the binary representation
+// of the metadata blocks followed by a padding block
+// of the specified length. If padding is negative no
+// padding block is added.
+func encodeFlacBlocks(blocks []flacBlock, padding int) []byte {
+	var out []byte
+	for i, b := range blocks {
+		header := b.blockType
+		if i == len(blocks)-1 && padding < 0 {
+			header |= 0x80
+		}
+		length := len(b.data)
+		out = append(out, header, byte(length>>16), byte(length>>8), byte(length))
+		out = append(out, b.data...)
+	}
+
+	if padding >= 0 {
+		out = append(out, flacPadding|0x80, byte(padding>>16), byte(padding>>8), byte(padding))
+		out = append(out, make([]byte, padding)...)
+	}
+	return out
+}
+
+// writeFlacMetadata stores the metadata blocks in the
+// FLAC file. If the new blocks fit in the space used
+// by the old metadata (including the padding) the file
+// is updated in place, otherwise the file is written
+// again with new padding.
+func writeFlacMetadata(path string, meta *flacMetadata, blocks []flacBlock) error {
+	size := int64(0)
+	for _, b := range blocks {
+		if len(b.data) > flacMaxBlockSize {
+			return errors.New("FLAC metadata block too big.")
+		}
+		size += 4 + int64(len(b.data))
+	}
+
+	available := meta.end - meta.start
+	if size == available || (size+4 <= available && available-size-4 <= flacMaxBlockSize) {
+		padding := -1
+		if size != available {
+			padding = int(available - size - 4)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(encodeFlacBlocks(blocks, padding), meta.start)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	encoded := encodeFlacBlocks(blocks, flacDefaultPadding)
+	return replaceFile(path, func(src *os.File, w io.Writer) error {
+		if _, err := io.CopyN(w, src, meta.start); err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		if _, err := src.Seek(meta.end, 0); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// parseFlacPicture decodes a FLAC picture block, the
+// same structure is used by the METADATA_BLOCK_PICTURE
+// field of the Vorbis comments.
+func parseFlacPicture(data []byte) (Picture, error) {
+	var p Picture
+	field := func(length int) ([]byte, error) {
+		if length < 0 || length > len(data) {
+			return nil, errors.New("FLAC picture truncated.")
+		}
+		value := data[:length]
+		data = data[length:]
+		return value, nil
+	}
+	number := func() (int, error) {
+		value, err := field(4)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint32(value)), nil
+	}
+
+	pictureType, err := number()
+	if err != nil {
+		return p, err
+	}
+	p.Type = byte(pictureType)
+
+	length, err := number()
+	if err != nil {
+		return p, err
+	}
+	mime, err := field(length)
+	if err != nil {
+		return p, err
+	}
+	p.MimeType = string(mime)
+
+	length, err = number()
+	if err != nil {
+		return p, err
+	}
+	description, err := field(length)
+	if err != nil {
+		return p, err
+	}
+	p.Description = string(description)
+
+	// Skip the width, height, color depth and
+	// number of colors.
+	if _, err = field(16); err != nil {
+		return p, err
+	}
+
+	length, err = number()
+	if err != nil {
+		return p, err
+	}
+	p.Data, err = field(length)
+	return p, err
+}
+
+// encodeFlacPicture returns the FLAC picture block for
+// the picture. The width and height are only filled
+// when the image format is known.
+func encodeFlacPicture(p Picture) []byte {
+	var width, height, depth uint32
+	if config, _, err := image.DecodeConfig(bytes.NewReader(p.Data)); err == nil {
+		width = uint32(config.Width)
+		height = uint32(config.Height)
+		depth = 24
+	}
+
+	out := make([]byte, 0, 32+len(p.MimeType)+len(p.Description)+len(p.Data))
+	var number [4]byte
+	put := func(n uint32) {
+		binary.BigEndian.PutUint32(number[:], n)
+		out = append(out, number[:]...)
+	}
+
+	put(uint32(p.Type))
+	put(uint32(len(p.MimeType)))
+	out = append(out, p.MimeType...)
+	put(uint32(len(p.Description)))
+	out = append(out, p.Description...)
+	put(width)
+	put(height)
+	put(depth)
+	put(0)
+	put(uint32(len(p.Data)))
+	return append(out, p.Data...)
+}
+
+// parseFlacBlocks decodes the metadata blocks encoded
+// by encodeFlacBlocks.
+func parseFlacBlocks(data []byte) ([]flacBlock, error) {
+	var blocks []flacBlock
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("FLAC metadata block truncated.")
+		}
+		length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if 4+length > len(data) {
+			return nil, errors.New("FLAC metadata block truncated.")
+		}
+		blocks = append(blocks, flacBlock{data[0] & 0x7f, data[4 : 4+length]})
+		data = data[4+length:]
+	}
+	return blocks, nil
+}
+
+// readFlacComment reads the metadata of a FLAC file and
+// returns it with the Vorbis comment found on it.
+// If the file does not have a Vorbis comment block an
+// empty one is returned.
+func readFlacComment(path string) (*flacMetadata, *vorbisComment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	meta, err := readFlacMetadata(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, b := range meta.blocks {
+		if b.blockType == flacVorbisComment {
+			vc, err := parseVorbisComment(b.data)
+			if err != nil {
+				return nil, nil, err
+			}
+			return meta, vc, nil
+		}
+	}
+	return meta, &vorbisComment{vendor: "MuLiFS"}, nil
+}
+
+// writeFlacComment replaces the Vorbis comment block
+// in a FLAC file. If the file does not have one, the
+// block is added after the STREAMINFO block.
+func writeFlacComment(path string, meta *flacMetadata, vc *vorbisComment) error {
+	newBlock := flacBlock{flacVorbisComment, vc.bytes()}
+	blocks := make([]flacBlock, 0, len(meta.blocks)+1)
+	found := false
+	for _, b := range meta.blocks {
+		if b.blockType == flacVorbisComment {
+			if !found {
+				blocks = append(blocks, newBlock)
+				found = true
+			}
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+
+	if !found {
+		blocks = append(blocks[:1], append([]flacBlock{newBlock}, blocks[1:]...)...)
+	}
+	return writeFlacMetadata(path, meta, blocks)
+}
+
+func init() {
+	RegisterFormat(flacBackend{}, ".flac")
+}
+
+// flacBackend manages the Vorbis comments in FLAC files.
+type flacBackend struct{}
+
+// ReadTags returns a FileTags struct with
+// all the information obtained from the Vorbis
+// comments in the FLAC file.
+func (flacBackend) ReadTags(path string) (FileTags, error) {
+	_, vc, err := readFlacComment(path)
+	if err != nil {
+		return FileTags{}, err
+	}
+	return vc.tags(), nil
+}
+
+// WriteTags updates the Vorbis comments with the
+// new values in the song FLAC file.
+func (flacBackend) WriteTags(path string, tags FileTags) error {
+	meta, vc, err := readFlacComment(path)
+	if err != nil {
+		return err
+	}
+
+	vc.setTags(tags)
+
+	return writeFlacComment(path, meta, vc)
+}
+
+// ReadPictures returns the images stored in the
+// picture blocks of the FLAC file.
+func (flacBackend) ReadPictures(path string) ([]Picture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta, err := readFlacMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var pictures []Picture
+	for _, b := range meta.blocks {
+		if b.blockType != flacPicture {
+			continue
+		}
+		p, err := parseFlacPicture(b.data)
+		if err == nil && len(p.Data) > 0 {
+			pictures = append(pictures, p)
+		}
+	}
+	return pictures, nil
+}
+
+// WritePicture stores the picture in a new picture
+// block of the FLAC file, replacing the pictures of
+// the same type.
+func (flacBackend) WritePicture(path string, picture Picture) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	meta, err := readFlacMetadata(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	blocks := make([]flacBlock, 0, len(meta.blocks)+1)
+	for _, b := range meta.blocks {
+		if b.blockType == flacPicture {
+			if old, err := parseFlacPicture(b.data); err == nil && old.Type == picture.Type {
+				continue
+			}
+		}
+		blocks = append(blocks, b)
+	}
+
+	blocks = append(blocks, flacBlock{flacPicture, encodeFlacPicture(picture)})
+	return writeFlacMetadata(path, meta, blocks)
+}
+
+// SnapshotTags returns all the metadata blocks of the
+// FLAC file except the STREAMINFO, the padding and the
+// pictures.
+func (flacBackend) SnapshotTags(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta, err := readFlacMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+	return encodeFlacBlocks(flacBlocks(meta.blocks[1:], false), -1), nil
+}
+
+// RestoreTags replaces the metadata blocks of the FLAC
+// file, except the STREAMINFO and the pictures, with
+// the ones from the snapshot.
+func (flacBackend) RestoreTags(path string, snapshot []byte) error {
+	old, err := parseFlacBlocks(snapshot)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	meta, err := readFlacMetadata(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	blocks := append([]flacBlock{meta.blocks[0]}, flacBlocks(old, false)...)
+	blocks = append(blocks, flacBlocks(meta.blocks[1:], true)...)
+	return writeFlacMetadata(path, meta, blocks)
+}
+
+// flacBlocks returns the picture blocks from the list
+// when pictures is true, or all the other blocks when
+// it is false.
+func flacBlocks(blocks []flacBlock, pictures bool) []flacBlock {
+	var result []flacBlock
+	for _, b := range blocks {
+		if (b.blockType == flacPicture) == pictures {
+			result = append(result, b)
+		}
+	}
+	return result
+}
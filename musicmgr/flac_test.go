@@ -0,0 +1,262 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPayload returns n bytes of random data, the same
+// seed always returns the same data.
+func testPayload(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// writeFixture stores the data in a new file inside a
+// temporary directory, the returned function deletes it.
+func writeFixture(t *testing.T, name string, data []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "musicmgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// readFixture returns the contents of the file.
+func readFixture(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// vorbisFixture returns a Vorbis comment with the
+// vendor and the comments, as stored in the FLAC and
+// Ogg files.
+func vorbisFixture(vendor string, comments ...string) []byte {
+	var out [4]byte
+	data := make([]byte, 0)
+	binary.LittleEndian.PutUint32(out[:], uint32(len(vendor)))
+	data = append(data, out[:]...)
+	data = append(data, vendor...)
+	binary.LittleEndian.PutUint32(out[:], uint32(len(comments)))
+	data = append(data, out[:]...)
+	for _, c := range comments {
+		binary.LittleEndian.PutUint32(out[:], uint32(len(c)))
+		data = append(data, out[:]...)
+		data = append(data, c...)
+	}
+	return data
+}
+
+// flacBlockFixture returns a FLAC metadata block.
+func flacBlockFixture(blockType byte, last bool, data []byte) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	n := len(data)
+	return append([]byte{blockType, byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+}
+
+// flacFixture returns a FLAC file with a STREAMINFO,
+// an APPLICATION and a Vorbis comment block followed
+// by a padding block of the specified size and the
+// audio frames. No padding block is added if padding
+// is negative.
+func flacFixture(padding int, audio []byte) []byte {
+	comment := vorbisFixture("reference", "TITLE=Fixture", "ARTIST=Someone")
+	out := []byte("fLaC")
+	out = append(out, flacBlockFixture(0, false, testPayload(34, 1))...)
+	out = append(out, flacBlockFixture(2, false, []byte("TESTapplication"))...)
+	out = append(out, flacBlockFixture(4, padding < 0, comment)...)
+	if padding >= 0 {
+		out = append(out, flacBlockFixture(1, true, make([]byte, padding))...)
+	}
+	return append(out, audio...)
+}
+
+// splitFlac returns the metadata blocks of a FLAC file,
+// without the padding and the last block flag, and the
+// audio frames found after them.
+func splitFlac(t *testing.T, data []byte) ([][]byte, []byte) {
+	if len(data) < 4 || string(data[:4]) != "fLaC" {
+		t.Fatal("FLAC marker not found.")
+	}
+
+	var blocks [][]byte
+	pos := 4
+	for {
+		if pos+4 > len(data) {
+			t.Fatal("FLAC metadata truncated.")
+		}
+		header := data[pos]
+		n := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		if pos+4+n > len(data) {
+			t.Fatal("FLAC metadata block truncated.")
+		}
+		if header&0x7f != 1 {
+			block := append([]byte{header & 0x7f}, data[pos+1:pos+4+n]...)
+			blocks = append(blocks, block)
+		}
+		pos += 4 + n
+		if header&0x80 != 0 {
+			break
+		}
+	}
+	return blocks, data[pos:]
+}
+
+// checkFlac checks that the file keeps the audio frames
+// and every metadata block except the Vorbis comment.
+func checkFlac(t *testing.T, original, data []byte) {
+	oldBlocks, oldAudio := splitFlac(t, original)
+	newBlocks, newAudio := splitFlac(t, data)
+	if !bytes.Equal(oldAudio, newAudio) {
+		t.Fatal("The audio frames changed.")
+	}
+
+	var kept [][]byte
+	for _, b := range newBlocks {
+		if b[0] != 4 && b[0] != 6 {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) != 2 || !bytes.Equal(kept[0], oldBlocks[0]) || !bytes.Equal(kept[1], oldBlocks[1]) {
+		t.Fatal("The STREAMINFO or APPLICATION blocks changed.")
+	}
+}
+
+func TestFlacWriteTagsInPlace(t *testing.T) {
+	original := flacFixture(1024, testPayload(20000, 2))
+	path, clean := writeFixture(t, "song.flac", original)
+	defer clean()
+
+	err := flacBackend{}.WriteTags(path, FileTags{Title: "Títle", Album: "Álbum", Year: 1999, Track: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := readFixture(t, path)
+	if len(data) != len(original) {
+		t.Fatalf("The file was written again, size %d instead of %d.", len(data), len(original))
+	}
+	checkFlac(t, original, data)
+
+	tags, err := flacBackend{}.ReadTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Title != "Títle" || tags.Artist != "Someone" || tags.Album != "Álbum" || tags.Year != 1999 || tags.Track != 3 {
+		t.Fatal(tags)
+	}
+}
+
+func TestFlacWriteTagsGrow(t *testing.T) {
+	original := flacFixture(-1, testPayload(20000, 3))
+	path, clean := writeFixture(t, "song.flac", original)
+	defer clean()
+
+	artist := strings.Repeat("Long Artist ", 100)
+	err := flacBackend{}.WriteTags(path, FileTags{Artist: artist})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := readFixture(t, path)
+	checkFlac(t, original, data)
+	tags, err := flacBackend{}.ReadTags(path)
+	if err != nil || tags.Artist != artist || tags.Title != "Fixture" {
+		t.Fatal(tags, err)
+	}
+
+	// The padding added on the first write is used by
+	// the next one.
+	err = flacBackend{}.WriteTags(path, FileTags{Album: "Album"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grown := readFixture(t, path)
+	if len(grown) != len(data) {
+		t.Fatal("The padding was not used.")
+	}
+	checkFlac(t, original, grown)
+}
+
+func TestFlacWritePicture(t *testing.T) {
+	original := flacFixture(16, testPayload(20000, 4))
+	path, clean := writeFixture(t, "song.flac", original)
+	defer clean()
+
+	picture := Picture{Type: FrontCover, MimeType: "image/jpeg", Data: testPayload(50000, 5)}
+	err := flacBackend{}.WritePicture(path, picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFlac(t, original, readFixture(t, path))
+	pictures, err := flacBackend{}.ReadPictures(path)
+	if err != nil || len(pictures) != 1 || !bytes.Equal(pictures[0].Data, picture.Data) {
+		t.Fatal("The picture was not stored.", err)
+	}
+
+	tags, err := flacBackend{}.ReadTags(path)
+	if err != nil || tags.Title != "Fixture" {
+		t.Fatal(tags, err)
+	}
+}
+
+func TestFlacWithID3v2(t *testing.T) {
+	id3 := []byte("ID3\x03\x00\x00\x00\x00\x00\x0a")
+	id3 = append(id3, make([]byte, 10)...)
+	original := append(id3, flacFixture(-1, testPayload(5000, 6))...)
+	path, clean := writeFixture(t, "song.flac", original)
+	defer clean()
+
+	err := flacBackend{}.WriteTags(path, FileTags{Title: "Another title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := readFixture(t, path)
+	if !bytes.HasPrefix(data, id3) {
+		t.Fatal("The ID3v2 tag changed.")
+	}
+	checkFlac(t, original[len(id3):], data[len(id3):])
+
+	tags, err := flacBackend{}.ReadTags(path)
+	if err != nil || tags.Title != "Another title" {
+		t.Fatal(tags, err)
+	}
+}
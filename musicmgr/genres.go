@@ -0,0 +1,118 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"strconv"
+	"strings"
+)
+
+// id3v1Genres are the genre names referenced by number
+// in ID3v1 tags, in the TCON frame of old ID3v2 tags
+// and in the gnre atom of MP4 files.
+// It includes the Winamp extensions.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk",
+	"Grunge", "Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other",
+	"Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack",
+	"Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion",
+	"Trance", "Classical", "Instrumental", "Acid", "House", "Game",
+	"Sound Clip", "Gospel", "Noise", "AlternRock", "Bass", "Soul", "Punk",
+	"Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic",
+	"Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult",
+	"Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave",
+	"Showtunes", "Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz",
+	"Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock", "Folk",
+	"Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin",
+	"Revival", "Celtic", "Bluegrass", "Avantgarde", "Gothic Rock",
+	"Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock",
+	"Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech",
+	"Chanson", "Opera", "Chamber Music", "Sonata", "Symphony", "Booty Bass",
+	"Primus", "Porn Groove", "Satire", "Slow Jam", "Club", "Tango", "Samba",
+	"Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House",
+	"Dance Hall", "Goa", "Drum & Bass", "Club-House", "Hardcore", "Terror",
+	"Indie", "BritPop", "Negerpunk", "Polsk Punk", "Beat",
+	"Christian Gangsta Rap", "Heavy Metal", "Black Metal", "Crossover",
+	"Contemporary Christian", "Christian Rock", "Merengue", "Salsa",
+	"Thrash Metal", "Anime", "JPop", "Synthpop", "Abstract", "Art Rock",
+	"Baroque", "Bhangra", "Big Beat", "Breakbeat", "Chillout", "Downtempo",
+	"Dub", "EBM", "Eclectic", "Electro", "Electroclash", "Emo",
+	"Experimental", "Garage", "Global", "IDM", "Illbient", "Industro-Goth",
+	"Jam Band", "Krautrock", "Leftfield", "Lounge", "Math Rock",
+	"New Romantic", "Nu-Breakz", "Post-Punk", "Post-Rock", "Psytrance",
+	"Shoegaze", "Space Rock", "Trop Rock", "World Music", "Neoclassical",
+	"Audiobook", "Audio Theatre", "Neue Deutsche Welle", "Podcast",
+	"Indie Rock", "G-Funk", "Dubstep", "Garage Rock", "Psybient",
+}
+
+// genreName returns the name of the ID3v1 genre with
+// the specified number, or an empty string if the
+// number is not valid.
+func genreName(number int) string {
+	if number < 0 || number >= len(id3v1Genres) {
+		return ""
+	}
+	return id3v1Genres[number]
+}
+
+// parseGenre returns the genre name from a genre tag.
+// The tag can be a plain name, an ID3v1 genre number or
+// the ID3v2.3 form with references between parentheses
+// like "(17)" or "(17)Rock", where the refinement
+// after the reference is preferred.
+// Only the first genre is returned when the tag holds
+// many of them.
+func parseGenre(value string) string {
+	value = strings.TrimSpace(strings.SplitN(value, "\x00", 2)[0])
+	for strings.HasPrefix(value, "(") && !strings.HasPrefix(value, "((") {
+		end := strings.IndexByte(value, ')')
+		if end < 0 {
+			break
+		}
+
+		reference := value[1:end]
+		refinement := strings.TrimSpace(value[end+1:])
+		if refinement != "" && !strings.HasPrefix(refinement, "(") {
+			return refinement
+		}
+
+		switch reference {
+		case "RX":
+			return "Remix"
+		case "CR":
+			return "Cover"
+		}
+		if number, err := strconv.Atoi(reference); err == nil {
+			return genreName(number)
+		}
+		value = refinement
+	}
+
+	if strings.HasPrefix(value, "((") {
+		return value[1:]
+	}
+	if number, err := strconv.Atoi(value); err == nil {
+		if name := genreName(number); name != "" {
+			return name
+		}
+	}
+	return value
+}
@@ -0,0 +1,982 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ID3v2 header flags.
+const (
+	id3Unsync   = 0x80
+	id3Extended = 0x40
+	id3Footer   = 0x10
+)
+
+// id3TagAlter is the frame status flag that asks to
+// discard the frame when the tag is altered and the
+// frame is unknown. It is in the ID3v2.3 layout,
+// ID3v2.4 uses the same flags shifted one bit to the
+// right.
+const id3TagAlter = 0x80
+
+// ID3v2 text encodings.
+const (
+	id3Latin1  = 0
+	id3UTF16   = 1
+	id3UTF16BE = 2
+	id3UTF8    = 3
+)
+
+// id3DefaultPadding is the amount of padding added
+// when the tag does not fit anymore and the whole
+// file needs to be written again, so the next changes
+// can be done in place.
+const id3DefaultPadding = 2048
+
+// id3v22Frames maps the ID3v2.2 frame identifiers to
+// the ID3v2.3 ones. ID3v2.2 tags are always written
+// back as ID3v2.3 tags and the frames that are not
+// in this list are dropped.
+var id3v22Frames = map[string]string{
+	"BUF": "RBUF", "CNT": "PCNT", "COM": "COMM", "CRA": "AENC",
+	"ETC": "ETCO", "EQU": "EQUA", "GEO": "GEOB", "IPL": "IPLS",
+	"LNK": "LINK", "MCI": "MCDI", "MLL": "MLLT", "PIC": "APIC",
+	"POP": "POPM", "REV": "RVRB", "RVA": "RVAD", "SLT": "SYLT",
+	"STC": "SYTC", "TAL": "TALB", "TBP": "TBPM", "TCM": "TCOM",
+	"TCO": "TCON", "TCR": "TCOP", "TDA": "TDAT", "TDY": "TDLY",
+	"TEN": "TENC", "TFT": "TFLT", "TIM": "TIME", "TKE": "TKEY",
+	"TLA": "TLAN", "TLE": "TLEN", "TMT": "TMED", "TOA": "TOPE",
+	"TOF": "TOFN", "TOL": "TOLY", "TOR": "TORY", "TOT": "TOAL",
+	"TP1": "TPE1", "TP2": "TPE2", "TP3": "TPE3", "TP4": "TPE4",
+	"TPA": "TPOS", "TPB": "TPUB", "TRC": "TSRC", "TRD": "TRDA",
+	"TRK": "TRCK", "TSI": "TSIZ", "TSS": "TSSE", "TT1": "TIT1",
+	"TT2": "TIT2", "TT3": "TIT3", "TXT": "TEXT", "TXX": "TXXX",
+	"TYE": "TYER", "UFI": "UFID", "ULT": "USLT", "WAF": "WOAF",
+	"WAR": "WOAR", "WAS": "WOAS", "WCM": "WCOM", "WCP": "WCOP",
+	"WPB": "WPUB", "WXX": "WXXX",
+}
+
+// id3Frame is a single frame from an ID3v2 tag.
+// The data is kept decoded, without unsynchronisation
+// or compression, except for the encrypted frames that
+// MuLi cannot decode, these are kept as they were read
+// together with their format flags and written back
+// untouched.
+// status holds the status flags in the ID3v2.3 layout
+// and group is the grouping identifier, or -1 if the
+// frame does not belong to a group.
+type id3Frame struct {
+	id        string
+	status    byte
+	group     int
+	encrypted bool
+	format    byte
+	data      []byte
+}
+
+// id3Tag is an ID3v2 tag.
+// size is the amount of bytes used by the tag in the
+// file, including the header, the padding and the
+// footer. It is zero if the file has no tag.
+type id3Tag struct {
+	version byte
+	frames  []*id3Frame
+	size    int64
+}
+
+// syncsafe decodes a 28 bits integer stored in four
+// bytes using only the lower seven bits of each one.
+func syncsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 |
+		int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+// putSyncsafe encodes a 28 bits integer in four bytes
+// using only the lower seven bits of each one.
+func putSyncsafe(b []byte, v int) {
+	b[0] = byte(v>>21) & 0x7f
+	b[1] = byte(v>>14) & 0x7f
+	b[2] = byte(v>>7) & 0x7f
+	b[3] = byte(v) & 0x7f
+}
+
+// removeUnsync reverts the unsynchronisation scheme,
+// removing the zero bytes inserted after every 0xFF.
+func removeUnsync(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		out = append(out, data[i])
+		if data[i] == 0xff && i+1 < len(data) && data[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// validFrameStart returns true if the data starts with
+// a valid ID3v2.3 or ID3v2.4 frame identifier, the
+// padding or the end of the tag.
+func validFrameStart(data []byte) bool {
+	if len(data) == 0 || data[0] == 0 {
+		return true
+	}
+	if len(data) < 4 {
+		return false
+	}
+	for _, c := range data[:4] {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// readID3v2 reads the ID3v2 tag found at the beginning
+// of the stream. If there is no tag an empty ID3v2.3
+// tag is returned.
+func readID3v2(r io.Reader) (*id3Tag, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &id3Tag{version: 3}, nil
+		}
+		return nil, err
+	}
+
+	if string(header[:3]) != "ID3" {
+		return &id3Tag{version: 3}, nil
+	}
+
+	version := header[3]
+	flags := header[5]
+	if version < 2 || version > 4 {
+		return nil, errors.New("Unsupported ID3v2 version.")
+	}
+	if version == 2 && flags&0x40 != 0 {
+		return nil, errors.New("Compressed ID3v2.2 tags are not supported.")
+	}
+
+	size := syncsafe(header[6:])
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	tag := &id3Tag{version: version, size: 10 + size}
+	if version == 4 && flags&id3Footer != 0 {
+		tag.size += 10
+	}
+
+	// Before ID3v2.4 the unsynchronisation is applied
+	// to the whole tag, including the frame headers.
+	unsync := flags&id3Unsync != 0
+	if version < 4 && unsync {
+		body = removeUnsync(body)
+	}
+
+	if version > 2 && flags&id3Extended != 0 {
+		if len(body) < 4 {
+			return nil, errors.New("ID3v2 extended header truncated.")
+		}
+		extended := int64(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			extended = syncsafe(body)
+		}
+		if extended > int64(len(body)) {
+			return nil, errors.New("Wrong ID3v2 extended header size.")
+		}
+		body = body[extended:]
+	}
+
+	for len(body) > 0 && body[0] != 0 {
+		frame, n, err := parseID3Frame(body, version, unsync)
+		if err != nil {
+			return nil, err
+		}
+		if frame != nil {
+			tag.frames = append(tag.frames, frame)
+		}
+		body = body[n:]
+	}
+
+	if version == 2 {
+		tag.version = 3
+	}
+	return tag, nil
+}
+
+// parseID3Frame decodes the frame at the beginning of
+// the data and returns it with the amount of bytes it
+// uses. The frame is nil if it has to be dropped.
+func parseID3Frame(data []byte, version byte, unsync bool) (*id3Frame, int, error) {
+	if version == 2 {
+		if len(data) < 6 {
+			return nil, 0, errors.New("ID3v2 frame truncated.")
+		}
+		size := int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		if 6+size > len(data) {
+			return nil, 0, errors.New("ID3v2 frame truncated.")
+		}
+
+		id, ok := id3v22Frames[string(data[:3])]
+		if !ok {
+			return nil, 6 + size, nil
+		}
+
+		payload := append([]byte{}, data[6:6+size]...)
+		if id == "APIC" {
+			payload = convertPIC(payload)
+		}
+		return &id3Frame{id: id, group: -1, data: payload}, 6 + size, nil
+	}
+
+	if len(data) < 10 {
+		return nil, 0, errors.New("ID3v2 frame truncated.")
+	}
+
+	size := int(binary.BigEndian.Uint32(data[4:]))
+	if version == 4 {
+		// Some taggers do not use syncsafe sizes in
+		// ID3v2.4 frames, use the size that leads to
+		// a valid frame.
+		safe := int(syncsafe(data[4:]))
+		if data[4]|data[5]|data[6]|data[7] < 0x80 &&
+			(10+size > len(data) || !validFrameStart(data[10+size:]) ||
+				10+safe <= len(data) && validFrameStart(data[10+safe:])) {
+			size = safe
+		}
+	}
+	if size < 0 || 10+size > len(data) {
+		return nil, 0, errors.New("ID3v2 frame truncated.")
+	}
+
+	frame := &id3Frame{id: string(data[:4]), status: data[8], group: -1}
+	format := data[9]
+	payload := data[10 : 10+size]
+	if version == 4 {
+		frame.status <<= 1
+	}
+
+	if version == 3 && format&0x40 != 0 || version == 4 && format&0x04 != 0 {
+		frame.encrypted = true
+		frame.format = format
+		frame.data = append([]byte{}, payload...)
+		return frame, 10 + size, nil
+	}
+
+	compressed := false
+	truncated := errors.New("ID3v2 frame truncated.")
+	if version == 3 {
+		if format&0x80 != 0 {
+			if len(payload) < 4 {
+				return nil, 0, truncated
+			}
+			compressed = true
+			payload = payload[4:]
+		}
+		if format&0x20 != 0 {
+			if len(payload) < 1 {
+				return nil, 0, truncated
+			}
+			frame.group = int(payload[0])
+			payload = payload[1:]
+		}
+	} else {
+		if format&0x40 != 0 {
+			if len(payload) < 1 {
+				return nil, 0, truncated
+			}
+			frame.group = int(payload[0])
+			payload = payload[1:]
+		}
+		if format&0x01 != 0 {
+			if len(payload) < 4 {
+				return nil, 0, truncated
+			}
+			payload = payload[4:]
+		}
+		if format&0x02 != 0 || unsync {
+			payload = removeUnsync(payload)
+		}
+		compressed = format&0x08 != 0
+	}
+
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, 0, err
+		}
+		payload, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	frame.data = append([]byte{}, payload...)
+	return frame, 10 + size, nil
+}
+
+// convertPIC converts the contents of an ID3v2.2 PIC
+// frame, that uses a three letters image format, to
+// the APIC frame used since ID3v2.3 that uses a MIME
+// type instead.
+func convertPIC(data []byte) []byte {
+	if len(data) < 4 {
+		return data
+	}
+
+	mime := "image/" + strings.ToLower(string(data[1:4]))
+	if mime == "image/jpg" {
+		mime = "image/jpeg"
+	}
+
+	out := []byte{data[0]}
+	out = append(out, mime...)
+	out = append(out, 0)
+	return append(out, data[4:]...)
+}
+
+// bytes encodes the frame for the specified ID3v2
+// version. The frames are never compressed or
+// unsynchronised.
+func (f *id3Frame) bytes(version byte) []byte {
+	status := f.status
+	if version == 4 {
+		status >>= 1
+	}
+
+	format := f.format
+	var extra []byte
+	if !f.encrypted {
+		format = 0
+		if f.group >= 0 {
+			format = 0x20
+			if version == 4 {
+				format = 0x40
+			}
+			extra = []byte{byte(f.group)}
+		}
+	}
+
+	size := len(extra) + len(f.data)
+	out := make([]byte, 10, 10+size)
+	copy(out, f.id)
+	if version == 4 {
+		putSyncsafe(out[4:], size)
+	} else {
+		binary.BigEndian.PutUint32(out[4:], uint32(size))
+	}
+	out[8] = status
+	out[9] = format
+	out = append(out, extra...)
+	return append(out, f.data...)
+}
+
+// known returns true if MuLi knows how to handle the
+// frame. The unknown frames that ask to be discarded
+// when the tag is altered are not written back.
+func (f *id3Frame) known() bool {
+	return strings.HasPrefix(f.id, "T")
+}
+
+// encode returns the binary representation of the tag
+// followed by the specified amount of padding.
+// The tag is written without extended header, footer
+// or unsynchronisation.
+func (t *id3Tag) encode(padding int) []byte {
+	var frames []byte
+	for _, f := range t.frames {
+		if f.status&id3TagAlter != 0 && !f.known() {
+			continue
+		}
+		frames = append(frames, f.bytes(t.version)...)
+	}
+
+	out := make([]byte, 10, 10+len(frames)+padding)
+	copy(out, "ID3")
+	out[3] = t.version
+	putSyncsafe(out[6:], len(frames)+padding)
+	out = append(out, frames...)
+	return append(out, make([]byte, padding)...)
+}
+
+// writeID3v2 stores the tag at the beginning of the
+// file. If the new tag fits in the space used by the
+// old one (including the padding) the file is updated
+// in place, otherwise the file is written again with
+// new padding.
+func writeID3v2(path string, t *id3Tag) error {
+	encoded := t.encode(0)
+	if t.size > 0 && int64(len(encoded)) <= t.size {
+		encoded = t.encode(int(t.size) - len(encoded))
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(encoded, 0)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	encoded = t.encode(id3DefaultPadding)
+	return replaceFile(path, func(src *os.File, w io.Writer) error {
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		if _, err := src.Seek(t.size, 0); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// frame returns the first frame with the specified
+// identifier that can be decoded, or nil if the tag
+// does not have it.
+func (t *id3Tag) frame(id string) *id3Frame {
+	for _, f := range t.frames {
+		if f.id == id && !f.encrypted {
+			return f
+		}
+	}
+	return nil
+}
+
+// setFrame replaces all the frames with the specified
+// identifier with a new one holding the data. The new
+// frame takes the position of the first old one.
+func (t *id3Tag) setFrame(id string, data []byte) {
+	frame := &id3Frame{id: id, group: -1, data: data}
+	frames := t.frames[:0]
+	replaced := false
+	for _, f := range t.frames {
+		if f.id == id {
+			if replaced {
+				continue
+			}
+			f = frame
+			replaced = true
+		}
+		frames = append(frames, f)
+	}
+
+	if !replaced {
+		frames = append(frames, frame)
+	}
+	t.frames = frames
+}
+
+// removeFrames deletes all the frames with the
+// specified identifier.
+func (t *id3Tag) removeFrames(id string) {
+	frames := t.frames[:0]
+	for _, f := range t.frames {
+		if f.id != id {
+			frames = append(frames, f)
+		}
+	}
+	t.frames = frames
+}
+
+// textValues returns the values stored in the first
+// text frame with the specified identifier.
+func (t *id3Tag) textValues(id string) []string {
+	f := t.frame(id)
+	if f == nil || len(f.data) < 1 {
+		return nil
+	}
+
+	var values []string
+	enc, data := f.data[0], f.data[1:]
+	for len(data) > 0 {
+		var value string
+		value, data = splitID3String(enc, data)
+		values = append(values, value)
+	}
+
+	// Remove the trailing terminators.
+	for len(values) > 0 && values[len(values)-1] == "" {
+		values = values[:len(values)-1]
+	}
+	return values
+}
+
+// text returns the text stored in the first text
+// frame with the specified identifier. When the frame
+// has many values they are separated with slashes.
+func (t *id3Tag) text(id string) string {
+	return strings.Join(t.textValues(id), "/")
+}
+
+// setText replaces the text frames with the specified
+// identifier with a new one holding the value.
+func (t *id3Tag) setText(id, value string) {
+	enc := id3Encoding(t.version, value)
+	t.setFrame(id, append([]byte{enc}, encodeID3String(enc, value)...))
+}
+
+// setUserText replaces the TXXX frames with the
+// specified description with a new one holding the
+// value. The new frame takes the position of the first
+// old one.
+func (t *id3Tag) setUserText(description, value string) {
+	enc := id3Encoding(t.version, description, value)
+	data := append([]byte{enc}, encodeID3String(enc, description)...)
+	data = append(data, id3Terminator(enc)...)
+	data = append(data, encodeID3String(enc, value)...)
+	frame := &id3Frame{id: "TXXX", group: -1, data: data}
+
+	frames := t.frames[:0]
+	replaced := false
+	for _, f := range t.frames {
+		if f.id == "TXXX" && !f.encrypted && len(f.data) > 0 {
+			desc, _ := splitID3String(f.data[0], f.data[1:])
+			if strings.EqualFold(desc, description) {
+				if replaced {
+					continue
+				}
+				f = frame
+				replaced = true
+			}
+		}
+		frames = append(frames, f)
+	}
+
+	if !replaced {
+		frames = append(frames, frame)
+	}
+	t.frames = frames
+}
+
+// yearFrames returns the identifiers of the frames
+// that store the year, the one used by the tag version
+// goes first: TDRC in ID3v2.4 tags and TYER in the
+// older ones.
+func (t *id3Tag) yearFrames() (string, string) {
+	if t.version == 4 {
+		return "TDRC", "TYER"
+	}
+	return "TYER", "TDRC"
+}
+
+// tags returns the FileTags stored in the tag.
+// The year is read from the frame used by the tag
+// version, the other one is only used when it is
+// missing.
+func (t *id3Tag) tags() FileTags {
+	year, other := t.yearFrames()
+	tags := FileTags{
+		Title:       t.text("TIT2"),
+		Artist:      t.text("TPE1"),
+		Album:       t.text("TALB"),
+		AlbumArtist: t.text("TPE2"),
+		Composer:    t.text("TCOM"),
+		Year:        parseYear(t.text(year)),
+	}
+
+	if tags.Year == 0 {
+		tags.Year = parseYear(t.text(other))
+	}
+	if genres := t.textValues("TCON"); len(genres) > 0 {
+		tags.Genre = parseGenre(genres[0])
+	}
+	tags.Track, tags.TrackTotal = parseNumberPair(t.text("TRCK"))
+	tags.Disc, tags.DiscTotal = parseNumberPair(t.text("TPOS"))
+	return tags
+}
+
+// setTags stores the non empty values from the
+// FileTags in the tag.
+func (t *id3Tag) setTags(tags FileTags) {
+	texts := []struct {
+		id    string
+		value string
+	}{
+		{"TIT2", tags.Title},
+		{"TPE1", tags.Artist},
+		{"TALB", tags.Album},
+		{"TPE2", tags.AlbumArtist},
+		{"TCOM", tags.Composer},
+		{"TCON", tags.Genre},
+	}
+	for _, text := range texts {
+		if text.value != "" {
+			t.setText(text.id, text.value)
+		}
+	}
+
+	// The frame of the other version is removed so a
+	// stale year does not hide the new one.
+	if tags.Year > 0 {
+		year, other := t.yearFrames()
+		t.setText(year, strconv.Itoa(tags.Year))
+		t.removeFrames(other)
+	}
+	if tags.Track > 0 {
+		_, total := parseNumberPair(t.text("TRCK"))
+		if tags.TrackTotal > 0 {
+			total = tags.TrackTotal
+		}
+		t.setText("TRCK", formatNumberPair(tags.Track, total))
+	}
+	if tags.Disc > 0 {
+		_, total := parseNumberPair(t.text("TPOS"))
+		if tags.DiscTotal > 0 {
+			total = tags.DiscTotal
+		}
+		t.setText("TPOS", formatNumberPair(tags.Disc, total))
+	}
+}
+
+// parseAPIC decodes the contents of an APIC frame.
+// It returns false if the frame cannot be decoded or
+// the picture is only linked with an URL.
+func parseAPIC(data []byte) (Picture, bool) {
+	var p Picture
+	if len(data) < 2 {
+		return p, false
+	}
+
+	enc := data[0]
+	mime, rest := splitID3String(id3Latin1, data[1:])
+	if mime == "-->" || len(rest) < 1 {
+		return p, false
+	}
+	if mime == "" {
+		mime = "image/"
+	}
+
+	p.MimeType = mime
+	p.Type = rest[0]
+	p.Description, rest = splitID3String(enc, rest[1:])
+	p.Data = rest
+	return p, len(p.Data) > 0
+}
+
+// pictures returns the images stored in the APIC
+// frames of the tag.
+func (t *id3Tag) pictures() []Picture {
+	var pictures []Picture
+	for _, f := range t.frames {
+		if f.id != "APIC" || f.encrypted {
+			continue
+		}
+		if p, ok := parseAPIC(f.data); ok {
+			pictures = append(pictures, p)
+		}
+	}
+	return pictures
+}
+
+// setPicture stores the picture in a new APIC frame,
+// replacing the pictures of the same type.
+func (t *id3Tag) setPicture(p Picture) {
+	frames := t.frames[:0]
+	for _, f := range t.frames {
+		if f.id == "APIC" && !f.encrypted {
+			if old, ok := parseAPIC(f.data); ok && old.Type == p.Type {
+				continue
+			}
+		}
+		frames = append(frames, f)
+	}
+
+	enc := id3Encoding(t.version, p.Description)
+	data := []byte{enc}
+	data = append(data, encodeID3String(id3Latin1, p.MimeType)...)
+	data = append(data, 0, p.Type)
+	data = append(data, encodeID3String(enc, p.Description)...)
+	data = append(data, id3Terminator(enc)...)
+	data = append(data, p.Data...)
+	t.frames = append(frames, &id3Frame{id: "APIC", group: -1, data: data})
+}
+
+// repairCharset rewrites the text frames stored as
+// ISO-8859-1 that were actually written in another
+// charset using a Unicode encoding.
+// It returns true if any frame was modified.
+func (t *id3Tag) repairCharset() bool {
+	changed := false
+	for i, f := range t.frames {
+		if f.id[0] != 'T' || f.encrypted || len(f.data) < 1 || f.data[0] != id3Latin1 {
+			continue
+		}
+
+		var values []string
+		legacy := false
+		for _, raw := range bytes.Split(f.data[1:], []byte{0}) {
+			value := decodeLegacy(raw)
+			if value != decodeLatin1(raw) {
+				legacy = true
+			}
+			values = append(values, value)
+		}
+		if !legacy {
+			continue
+		}
+
+		enc := id3Encoding(t.version, values...)
+		data := []byte{enc}
+		for j, value := range values {
+			if j > 0 {
+				data = append(data, id3Terminator(enc)...)
+			}
+			data = append(data, encodeID3String(enc, value)...)
+		}
+		t.frames[i] = &id3Frame{id: f.id, group: -1, data: data}
+		changed = true
+	}
+	return changed
+}
+
+// id3LyricsLanguage is the language written in the
+// lyrics frames, the ID3v2 specification requires one.
+const id3LyricsLanguage = "eng"
+
+// SYLT time stamp format and content type used by
+// the synchronized lyrics.
+const (
+	id3Milliseconds = 2
+	id3ContentLyric = 1
+)
+
+// parseSYLT decodes a SYLT frame with the time stamps
+// in milliseconds. It returns false if the frame uses
+// a different format.
+func parseSYLT(data []byte) ([]lyricsLine, bool) {
+	if len(data) < 6 || data[4] != id3Milliseconds {
+		return nil, false
+	}
+
+	enc := data[0]
+	_, rest := splitID3String(enc, data[6:])
+	var lines []lyricsLine
+	for len(rest) > 0 {
+		var text string
+		text, rest = splitID3String(enc, rest)
+		if len(rest) < 4 {
+			break
+		}
+		ms := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+
+		// Most taggers start every line with a new line
+		// character instead of ending them with it.
+		text = strings.TrimLeft(text, "\r\n")
+		lines = append(lines, lyricsLine{Time: time.Duration(ms) * time.Millisecond, Text: text})
+	}
+	return lines, len(lines) > 0
+}
+
+// lyrics returns the lyrics of the tag in the LRC
+// format. The synchronized lyrics from the SYLT frame
+// are preferred, the USLT frame is used otherwise.
+func (t *id3Tag) lyrics() string {
+	for _, f := range t.frames {
+		if f.id != "SYLT" || f.encrypted {
+			continue
+		}
+		if lines, ok := parseSYLT(f.data); ok {
+			return formatLRC(lines)
+		}
+	}
+
+	f := t.frame("USLT")
+	if f == nil || len(f.data) < 4 {
+		return ""
+	}
+	_, text := splitID3String(f.data[0], f.data[4:])
+	lyrics, _ := splitID3String(f.data[0], text)
+	return lyrics
+}
+
+// setLyrics replaces the lyrics frames in the tag.
+// The USLT frame always gets the text without the time
+// tags and the SYLT frame is only written when the
+// lyrics are synchronized, otherwise the old one is
+// removed to avoid keeping outdated lyrics.
+func (t *id3Tag) setLyrics(lrc string) {
+	lines, synced := parseLRC(lrc)
+	texts := make([]string, len(lines))
+	for i, l := range lines {
+		texts[i] = l.Text
+	}
+	text := strings.Join(texts, "\n")
+
+	frames := t.frames[:0]
+	for _, f := range t.frames {
+		if (f.id == "SYLT" || f.id == "USLT") && !f.encrypted {
+			continue
+		}
+		frames = append(frames, f)
+	}
+	t.frames = frames
+
+	if len(lines) == 0 {
+		return
+	}
+
+	enc := id3Encoding(t.version, text)
+	data := append([]byte{enc}, id3LyricsLanguage...)
+	data = append(data, id3Terminator(enc)...)
+	data = append(data, encodeID3String(enc, text)...)
+	t.frames = append(t.frames, &id3Frame{id: "USLT", group: -1, data: data})
+
+	if !synced {
+		return
+	}
+
+	data = append([]byte{enc}, id3LyricsLanguage...)
+	data = append(data, id3Milliseconds, id3ContentLyric)
+	data = append(data, id3Terminator(enc)...)
+	var ms [4]byte
+	for _, l := range lines {
+		data = append(data, encodeID3String(enc, l.Text)...)
+		data = append(data, id3Terminator(enc)...)
+		binary.BigEndian.PutUint32(ms[:], uint32(l.Time/time.Millisecond))
+		data = append(data, ms[:]...)
+	}
+	t.frames = append(t.frames, &id3Frame{id: "SYLT", group: -1, data: data})
+}
+
+// id3Encoding returns the text encoding used to store
+// the values, ISO-8859-1 is used when possible and
+// the Unicode encoding supported by the tag version
+// otherwise.
+func id3Encoding(version byte, values ...string) byte {
+	for _, value := range values {
+		for _, r := range value {
+			if r > 0xff {
+				if version == 4 {
+					return id3UTF8
+				}
+				return id3UTF16
+			}
+		}
+	}
+	return id3Latin1
+}
+
+// id3Terminator returns the string terminator used by
+// the text encoding.
+func id3Terminator(enc byte) []byte {
+	if enc == id3UTF16 || enc == id3UTF16BE {
+		return []byte{0, 0}
+	}
+	return []byte{0}
+}
+
+// splitID3String decodes the first string, that ends
+// on a terminator or at the end of the data, and
+// returns it with the data found after it.
+func splitID3String(enc byte, data []byte) (string, []byte) {
+	if enc == id3UTF16 || enc == id3UTF16BE {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return decodeID3String(enc, data[:i]), data[i+2:]
+			}
+		}
+		return decodeID3String(enc, data), nil
+	}
+
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return decodeID3String(enc, data[:i]), data[i+1:]
+	}
+	return decodeID3String(enc, data), nil
+}
+
+// decodeID3String decodes a string, without the
+// terminator, stored with the specified text encoding.
+// UTF-16 strings without byte order mark are taken as
+// little endian, as most of the taggers that forget
+// it write them that way.
+// ISO-8859-1 strings are often written in other
+// charsets, it is detected with decodeLegacy.
+func decodeID3String(enc byte, data []byte) string {
+	switch enc {
+	case id3UTF16, id3UTF16BE:
+		bigEndian := enc == id3UTF16BE
+		if len(data) >= 2 {
+			switch {
+			case data[0] == 0xff && data[1] == 0xfe:
+				bigEndian = false
+				data = data[2:]
+			case data[0] == 0xfe && data[1] == 0xff:
+				bigEndian = true
+				data = data[2:]
+			}
+		}
+
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(data[i*2:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(data[i*2:])
+			}
+		}
+		return string(utf16.Decode(units))
+	case id3UTF8:
+		return string(data)
+	default:
+		return decodeLegacy(data)
+	}
+}
+
+// encodeID3String encodes a string, without the
+// terminator, using the specified text encoding.
+// UTF-16 strings are written in little endian with a
+// byte order mark.
+func encodeID3String(enc byte, value string) []byte {
+	switch enc {
+	case id3UTF16:
+		units := utf16.Encode([]rune(value))
+		out := make([]byte, 2+len(units)*2)
+		out[0], out[1] = 0xff, 0xfe
+		for i, u := range units {
+			binary.LittleEndian.PutUint16(out[2+i*2:], u)
+		}
+		return out
+	case id3UTF8:
+		return []byte(value)
+	default:
+		out := make([]byte, 0, len(value))
+		for _, r := range value {
+			if r > 0xff {
+				r = '?'
+			}
+			out = append(out, byte(r))
+		}
+		return out
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// id3Fixture describes an ID3v2 tag built by the tests.
+type id3Fixture struct {
+	version  byte
+	unsync   bool
+	extended bool
+	padding  int
+}
+
+// id3TestPicture is the image stored in the fixtures,
+// it has the bytes changed by the unsynchronisation.
+var id3TestPicture = append([]byte{0xff, 0xd8, 0xff, 0xe0, 0xff, 0x00, 0xff}, testPayload(500, 60)...)
+
+// id3TestPrivate is the content of the PRIV frame in
+// the fixtures, MuLi must write it back untouched.
+var id3TestPrivate = append([]byte("owner\x00\xff\xfb"), testPayload(100, 61)...)
+
+// id3TestArtist is the artist stored in the fixtures,
+// in a Unicode encoding for ID3v2.3 and ID3v2.4.
+func id3TestArtist(version byte) string {
+	if version == 2 {
+		return "Artist"
+	}
+	return "Ärtist ☺"
+}
+
+// testUTF16 encodes the text as UTF-16 with a little
+// endian byte order mark.
+func testUTF16(text string) []byte {
+	out := []byte{0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(text)) {
+		out = append(out, byte(u), byte(u>>8))
+	}
+	return out
+}
+
+// testUnsync applies the unsynchronisation scheme,
+// adding a zero after every 0xFF followed by a byte
+// that could be taken as a frame sync or a zero.
+func testUnsync(data []byte) []byte {
+	var out []byte
+	for i, b := range data {
+		out = append(out, b)
+		if b == 0xff && (i+1 == len(data) || data[i+1] >= 0xe0 || data[i+1] == 0) {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+// testSyncsafe encodes the value in four bytes using
+// seven bits of each one.
+func testSyncsafe(v int) []byte {
+	return []byte{byte(v>>21) & 0x7f, byte(v>>14) & 0x7f, byte(v>>7) & 0x7f, byte(v) & 0x7f}
+}
+
+// frames returns the frames of the fixture encoded for
+// its version.
+func (f id3Fixture) frames() []byte {
+	type frame struct {
+		id   string
+		data []byte
+	}
+
+	var frames []frame
+	switch f.version {
+	case 2:
+		frames = []frame{
+			{"TT2", []byte("\x00Fixture")},
+			{"TP1", []byte("\x00Artist")},
+			{"TAL", []byte("\x00Album\x00")},
+			{"TYE", []byte("\x002001")},
+			{"PIC", append([]byte("\x00JPG\x03\x00"), id3TestPicture...)},
+		}
+	case 3:
+		frames = []frame{
+			{"TIT2", []byte("\x00Fixture")},
+			{"TPE1", append([]byte{1}, testUTF16(id3TestArtist(3))...)},
+			{"TALB", []byte("\x00Album\x00")},
+			{"TYER", []byte("\x002001")},
+			{"PRIV", id3TestPrivate},
+			{"APIC", append([]byte("\x00image/jpeg\x00\x03\x00"), id3TestPicture...)},
+		}
+	default:
+		frames = []frame{
+			{"TIT2", []byte("\x03Fixture")},
+			{"TPE1", append([]byte{3}, id3TestArtist(4)...)},
+			{"TALB", []byte("\x03Album\x00")},
+			{"TDRC", []byte("\x032001-05-02")},
+			{"PRIV", id3TestPrivate},
+			{"APIC", append([]byte("\x03image/jpeg\x00\x03\x00"), id3TestPicture...)},
+		}
+	}
+
+	var out []byte
+	for i, fr := range frames {
+		data := fr.data
+		switch f.version {
+		case 2:
+			n := len(data)
+			out = append(out, fr.id...)
+			out = append(out, byte(n>>16), byte(n>>8), byte(n))
+		case 3:
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+			out = append(out, fr.id...)
+			out = append(out, size[:]...)
+			out = append(out, 0, 0)
+		default:
+			// The unsynchronisation flag of the tag applies
+			// to all the frames, only some taggers set it on
+			// the frames too.
+			format := byte(0)
+			if f.unsync {
+				data = testUnsync(data)
+				if i%2 == 0 {
+					format = 0x02
+				}
+			}
+			out = append(out, fr.id...)
+			out = append(out, testSyncsafe(len(data))...)
+			out = append(out, 0, format)
+		}
+		out = append(out, data...)
+	}
+	return out
+}
+
+// encode returns the tag of the fixture.
+func (f id3Fixture) encode() []byte {
+	var body []byte
+	flags := byte(0)
+	if f.extended {
+		flags |= 0x40
+		if f.version == 3 {
+			var padding [4]byte
+			binary.BigEndian.PutUint32(padding[:], uint32(f.padding))
+			body = append([]byte{0, 0, 0, 6, 0, 0}, padding[:]...)
+		} else {
+			body = append(testSyncsafe(6), 1, 0)
+		}
+	}
+
+	body = append(body, f.frames()...)
+	body = append(body, make([]byte, f.padding)...)
+	if f.unsync {
+		flags |= 0x80
+		if f.version < 4 {
+			body = testUnsync(body)
+		}
+	}
+
+	out := []byte{'I', 'D', '3', f.version, 0, flags}
+	out = append(out, testSyncsafe(len(body))...)
+	return append(out, body...)
+}
+
+// testID3Frames splits a tag written by MuLi in its
+// frames, it returns the data of every frame by its
+// identifier and the amount of bytes used by the tag.
+func testID3Frames(t *testing.T, data []byte) (map[string][]byte, int) {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		t.Fatal("ID3v2 tag not found.")
+	}
+	if data[5] != 0 {
+		t.Fatalf("The tag was written with the flags %x.", data[5])
+	}
+
+	version := data[3]
+	size := 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+	body := data[10:size]
+	frames := make(map[string][]byte)
+	for len(body) >= 10 && body[0] != 0 {
+		n := int(binary.BigEndian.Uint32(body[4:]))
+		if version == 4 {
+			n = int(body[4])<<21 | int(body[5])<<14 | int(body[6])<<7 | int(body[7])
+		}
+		if 10+n > len(body) {
+			t.Fatal("ID3v2 frame truncated.")
+		}
+		frames[string(body[:4])] = body[10 : 10+n]
+		body = body[10+n:]
+	}
+	for _, b := range body {
+		if b != 0 {
+			t.Fatal("Data found in the padding.")
+		}
+	}
+	return frames, size
+}
+
+// checkID3 checks the tag written in the file and that
+// the audio after it is kept, it returns the frames.
+func checkID3(t *testing.T, path string, version byte, audio []byte) map[string][]byte {
+	data := readFixture(t, path)
+	frames, size := testID3Frames(t, data)
+	if data[3] != version {
+		t.Fatalf("The tag was written as ID3v2.%d instead of ID3v2.%d.", data[3], version)
+	}
+	if !bytes.Equal(data[size:], audio) {
+		t.Fatal("The audio changed.")
+	}
+	return frames
+}
+
+// checkID3Pictures checks that the fixture picture is
+// the only one in the file.
+func checkID3Pictures(t *testing.T, path string) {
+	pictures, err := mp3Backend{}.ReadPictures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pictures) != 1 || pictures[0].MimeType != "image/jpeg" || pictures[0].Type != FrontCover ||
+		!bytes.Equal(pictures[0].Data, id3TestPicture) {
+		t.Fatal("The picture was not kept.")
+	}
+}
+
+func TestID3RoundTrip(t *testing.T) {
+	var fixtures []id3Fixture
+	for _, version := range []byte{2, 3, 4} {
+		for _, unsync := range []bool{false, true} {
+			fixtures = append(fixtures, id3Fixture{version: version, unsync: unsync, padding: 512})
+			if version > 2 {
+				fixtures = append(fixtures, id3Fixture{version: version, unsync: unsync, extended: true, padding: 512})
+			}
+		}
+	}
+
+	audio := testPayload(10000, 62)
+	for _, f := range fixtures {
+		original := append(f.encode(), audio...)
+		path, clean := writeFixture(t, "song.mp3", original)
+		defer clean()
+
+		tags, err := mp3Backend{}.ReadTags(path)
+		if err != nil {
+			t.Fatal(f, err)
+		}
+		artist := id3TestArtist(f.version)
+		if tags.Title != "Fixture" || tags.Artist != artist || tags.Album != "Album" || tags.Year != 2001 {
+			t.Fatal(f, tags)
+		}
+		checkID3Pictures(t, path)
+
+		err = mp3Backend{}.WriteTags(path, FileTags{Title: "Títle ☺", Track: 5, TrackTotal: 9})
+		if err != nil {
+			t.Fatal(f, err)
+		}
+
+		// ID3v2.2 tags are written back as ID3v2.3 and
+		// the unsynchronisation and extended headers are
+		// dropped, the tag still fits in its old space.
+		version := f.version
+		if version == 2 {
+			version = 3
+		}
+		frames := checkID3(t, path, version, audio)
+		if len(readFixture(t, path)) != len(original) {
+			t.Fatal(f, "The tag was not written in place.")
+		}
+		if f.version > 2 && !bytes.Equal(frames["PRIV"], id3TestPrivate) {
+			t.Fatal(f, "The PRIV frame changed.")
+		}
+
+		tags, err = mp3Backend{}.ReadTags(path)
+		if err != nil {
+			t.Fatal(f, err)
+		}
+		if tags.Title != "Títle ☺" || tags.Artist != artist || tags.Album != "Album" ||
+			tags.Year != 2001 || tags.Track != 5 || tags.TrackTotal != 9 {
+			t.Fatal(f, tags)
+		}
+		checkID3Pictures(t, path)
+	}
+}
+
+func TestID3WriteGrow(t *testing.T) {
+	audio := testPayload(10000, 63)
+	for _, version := range []byte{3, 4} {
+		original := append(id3Fixture{version: version}.encode(), audio...)
+		path, clean := writeFixture(t, "song.mp3", original)
+		defer clean()
+
+		title := strings.Repeat("Long Title ", 100)
+		err := mp3Backend{}.WriteTags(path, FileTags{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := readFixture(t, path)
+		if len(data) < len(original)+id3DefaultPadding {
+			t.Fatal("The padding was not added.")
+		}
+		checkID3(t, path, version, audio)
+
+		tags, err := mp3Backend{}.ReadTags(path)
+		if err != nil || tags.Title != title || tags.Artist != id3TestArtist(version) {
+			t.Fatal(tags, err)
+		}
+		checkID3Pictures(t, path)
+
+		// The next change is done in the padding.
+		err = mp3Backend{}.WriteTags(path, FileTags{Album: "Another Album"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(readFixture(t, path)) != len(data) {
+			t.Fatal("The padding was not used.")
+		}
+		checkID3(t, path, version, audio)
+	}
+}
+
+func TestID3WriteNewTag(t *testing.T) {
+	audio := append([]byte{0xff, 0xfb, 0x90, 0x00}, testPayload(10000, 64)...)
+	path, clean := writeFixture(t, "song.mp3", audio)
+	defer clean()
+
+	err := mp3Backend{}.WriteTags(path, FileTags{Title: "Title", Artist: "Artist", Year: 1985})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := checkID3(t, path, 3, audio)
+	if string(frames["TYER"]) != "\x001985" || frames["TDRC"] != nil {
+		t.Fatal("The year was not stored in the TYER frame.")
+	}
+
+	tags, err := mp3Backend{}.ReadTags(path)
+	if err != nil || tags.Title != "Title" || tags.Artist != "Artist" || tags.Year != 1985 {
+		t.Fatal(tags, err)
+	}
+}
+
+func TestID3YearFrames(t *testing.T) {
+	audio := testPayload(1000, 65)
+	for _, version := range []byte{3, 4} {
+		f := id3Fixture{version: version, padding: 64}
+		original := append(f.encode(), audio...)
+		path, clean := writeFixture(t, "song.mp3", original)
+		defer clean()
+
+		err := mp3Backend{}.WriteTags(path, FileTags{Year: 1977})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames := checkID3(t, path, version, audio)
+		year, other := "TYER", "TDRC"
+		if version == 4 {
+			year, other = other, year
+		}
+		if string(frames[year][1:]) != "1977" || frames[other] != nil {
+			t.Fatalf("The year was not stored in the %s frame.", year)
+		}
+	}
+}
+
+func TestID3WithID3v1(t *testing.T) {
+	v1 := make([]byte, id3v1Size)
+	copy(v1, "TAGOld Title")
+	copy(v1[33:], "Old Artist")
+	v1[127] = 255
+	audio := testPayload(5000, 66)
+	original := append(append(id3Fixture{version: 3, padding: 64}.encode(), audio...), v1...)
+	path, clean := writeFixture(t, "song.mp3", original)
+	defer clean()
+
+	err := mp3Backend{}.WriteTags(path, FileTags{Title: "New Title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := readFixture(t, path)
+	tail := data[len(data)-id3v1Size:]
+	checkID3(t, path, 3, append(append([]byte{}, audio...), tail...))
+	if !bytes.HasPrefix(tail, []byte("TAGNew Title\x00")) || !bytes.HasPrefix(tail[33:], []byte("Old Artist")) {
+		t.Fatal("The ID3v1 tag was not updated.")
+	}
+}
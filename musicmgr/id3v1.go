@@ -0,0 +1,157 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// id3v1Size is the size of an ID3v1 tag, it is always
+// stored in the last bytes of the file.
+const id3v1Size = 128
+
+// id3v1Tag is an ID3v1 or ID3v1.1 tag.
+// The fields are kept in their binary form so the
+// ones that are not modified are written back
+// untouched.
+type id3v1Tag [id3v1Size]byte
+
+// readID3v1 reads the ID3v1 tag at the end of the
+// file, it returns nil if the file does not have one.
+func readID3v1(r io.ReadSeeker) (*id3v1Tag, error) {
+	end, err := r.Seek(0, 2)
+	if err != nil {
+		return nil, err
+	}
+	if end < id3v1Size {
+		return nil, nil
+	}
+
+	if _, err = r.Seek(-id3v1Size, 2); err != nil {
+		return nil, err
+	}
+	tag := new(id3v1Tag)
+	if _, err = io.ReadFull(r, tag[:]); err != nil {
+		return nil, err
+	}
+
+	if string(tag[:3]) != "TAG" {
+		return nil, nil
+	}
+	return tag, nil
+}
+
+// id3v1Field decodes an ISO-8859-1 field, that is
+// padded with zeros or spaces. The charset actually
+// used to write it is detected.
+func id3v1Field(field []byte) string {
+	if i := strings.IndexByte(string(field), 0); i >= 0 {
+		field = field[:i]
+	}
+	return strings.TrimSpace(decodeID3String(id3Latin1, field))
+}
+
+// legacy returns true if the Title, Artist or Album
+// fields are written in a charset other than
+// ISO-8859-1.
+func (t *id3v1Tag) legacy() bool {
+	for _, field := range [][]byte{t[3:33], t[33:63], t[63:93]} {
+		if decodeLegacy(field) != decodeLatin1(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// setID3v1Field stores the value in an ISO-8859-1
+// field, the value is truncated if it is too long.
+func setID3v1Field(field []byte, value string) {
+	encoded := encodeID3String(id3Latin1, value)
+	for i := range field {
+		field[i] = 0
+	}
+	copy(field, encoded)
+}
+
+// tags returns the FileTags stored in the tag.
+func (t *id3v1Tag) tags() FileTags {
+	tags := FileTags{
+		Title:  id3v1Field(t[3:33]),
+		Artist: id3v1Field(t[33:63]),
+		Album:  id3v1Field(t[63:93]),
+		Year:   parseYear(id3v1Field(t[93:97])),
+		Genre:  genreName(int(t[127])),
+	}
+
+	// ID3v1.1 stores the track number at the end of
+	// the comment.
+	if t[125] == 0 && t[126] != 0 {
+		tags.Track = int(t[126])
+	}
+	return tags
+}
+
+// setTags stores the non empty values from the
+// FileTags in the tag.
+func (t *id3v1Tag) setTags(tags FileTags) {
+	if tags.Title != "" {
+		setID3v1Field(t[3:33], tags.Title)
+	}
+	if tags.Artist != "" {
+		setID3v1Field(t[33:63], tags.Artist)
+	}
+	if tags.Album != "" {
+		setID3v1Field(t[63:93], tags.Album)
+	}
+	if tags.Year > 0 && tags.Year < 10000 {
+		setID3v1Field(t[93:97], strconv.Itoa(tags.Year))
+	}
+	if tags.Track > 0 && tags.Track < 256 {
+		t[125] = 0
+		t[126] = byte(tags.Track)
+	}
+	if tags.Genre != "" {
+		for i, name := range id3v1Genres {
+			if strings.EqualFold(name, tags.Genre) {
+				t[127] = byte(i)
+				break
+			}
+		}
+	}
+}
+
+// writeID3v1 stores the tag at the end of the file,
+// replacing the one that is already there.
+func writeID3v1(path string, t *id3v1Tag) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(-id3v1Size, 2)
+	if err == nil {
+		_, err = f.Write(t[:])
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"math"
+)
+
+// Gating thresholds used to compute the integrated
+// loudness, as specified in ITU-R BS.1770.
+const (
+	loudnessAbsoluteGate = -70.0
+	loudnessRelativeGate = -10.0
+)
+
+// Loudness is the result of the EBU R128 analysis of a
+// song. Integrated is the loudness in LUFS and Peak is
+// the biggest sample found, where 1.0 is full scale.
+// Integrated is -Inf when the song is silent.
+type Loudness struct {
+	Integrated float64
+	Peak       float64
+	blocks     []float64
+}
+
+// biquad is a second order IIR filter in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// process filters one sample.
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the two filters that implement
+// the K-weighting curve for the sample rate: a high
+// shelf that models the effect of the head and a high
+// pass filter. The coefficients are calculated from
+// the analog prototypes so any sample rate is
+// supported, not only the 48 kHz of the specification.
+func kWeighting(sampleRate int) [2]biquad {
+	fs := float64(sampleRate)
+
+	f0 := 1681.974450955533
+	gain := 3.999843853973347
+	q := 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return [2]biquad{shelf, highPass}
+}
+
+// loudnessMeter measures the loudness of an audio
+// stream. The power is accumulated in 100ms steps and
+// every gating block uses the last four of them, so
+// the 400ms blocks overlap by 75%.
+type loudnessMeter struct {
+	filters  [][2]biquad
+	stepSize int
+	count    int
+	sum      float64
+	steps    []float64
+	blocks   []float64
+	peak     float64
+}
+
+// newLoudnessMeter returns a meter for a stream with
+// the specified sample rate and amount of channels.
+func newLoudnessMeter(sampleRate, channels int) *loudnessMeter {
+	m := &loudnessMeter{
+		filters:  make([][2]biquad, channels),
+		stepSize: sampleRate / 10,
+	}
+	for i := range m.filters {
+		m.filters[i] = kWeighting(sampleRate)
+	}
+	return m
+}
+
+// add processes one sample for every channel, the
+// values go from -1.0 to 1.0.
+func (m *loudnessMeter) add(samples []float64) {
+	for i, s := range samples {
+		if math.Abs(s) > m.peak {
+			m.peak = math.Abs(s)
+		}
+		f := &m.filters[i]
+		y := f[1].process(f[0].process(s))
+		m.sum += y * y
+	}
+
+	m.count++
+	if m.count < m.stepSize {
+		return
+	}
+
+	m.steps = append(m.steps, m.sum/float64(m.count))
+	m.sum = 0
+	m.count = 0
+	if len(m.steps) > 4 {
+		m.steps = m.steps[1:]
+	}
+	if len(m.steps) == 4 {
+		m.blocks = append(m.blocks, (m.steps[0]+m.steps[1]+m.steps[2]+m.steps[3])/4)
+	}
+}
+
+// result returns the loudness of the samples processed
+// by the meter.
+func (m *loudnessMeter) result() *Loudness {
+	return &Loudness{
+		Integrated: integratedLoudness(m.blocks),
+		Peak:       m.peak,
+		blocks:     m.blocks,
+	}
+}
+
+// blockLoudness converts the power of a gating block
+// to LUFS.
+func blockLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
+
+// integratedLoudness applies the absolute and the
+// relative gates to the blocks and returns the
+// loudness of the ones that are left.
+func integratedLoudness(blocks []float64) float64 {
+	gated := func(threshold float64) (float64, float64) {
+		sum, count := 0.0, 0.0
+		for _, power := range blocks {
+			if blockLoudness(power) > threshold {
+				sum += power
+				count++
+			}
+		}
+		return sum, count
+	}
+
+	sum, count := gated(loudnessAbsoluteGate)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	sum, count = gated(blockLoudness(sum/count) + loudnessRelativeGate)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(sum / count)
+}
+
+// AlbumLoudness returns the loudness of a group of
+// songs measured as if they were a single stream,
+// with the biggest peak found in them.
+func AlbumLoudness(songs []*Loudness) *Loudness {
+	album := &Loudness{}
+	for _, song := range songs {
+		album.blocks = append(album.blocks, song.blocks...)
+		if song.Peak > album.Peak {
+			album.Peak = song.Peak
+		}
+	}
+	album.Integrated = integratedLoudness(album.blocks)
+	return album
+}
@@ -0,0 +1,206 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lyricsLine is a single line of the lyrics of a song.
+// Time is the moment the line starts, it is negative
+// when the lyrics are not synchronized.
+type lyricsLine struct {
+	Time time.Duration
+	Text string
+}
+
+// LyricsReader is implemented by the backends that
+// can read the lyrics embedded in the music files.
+// The lyrics are returned in the LRC format.
+type LyricsReader interface {
+	ReadLyrics(path string) (string, error)
+}
+
+// LyricsWriter is implemented by the backends that
+// can embed lyrics in the music files. The lyrics are
+// received in the LRC format, plain text without time
+// tags is also accepted.
+type LyricsWriter interface {
+	WriteLyrics(path string, lrc string) error
+}
+
+// IsLyricsFile returns true if the file in the
+// specified path has the extension of the LRC files.
+func IsLyricsFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".lrc"
+}
+
+// GetLyrics returns the lyrics embedded in the music
+// file in the LRC format, using the backend registered
+// for its extension.
+// It returns an empty string if the file has no lyrics.
+func GetLyrics(path string) (string, error) {
+	reader, ok := backendFor(path).(LyricsReader)
+	if !ok {
+		return "", errors.New("Lyrics not supported.")
+	}
+	return reader.ReadLyrics(path)
+}
+
+// SetLyrics embeds the lyrics in the music file,
+// replacing the ones it already has, using the backend
+// registered for its extension.
+func SetLyrics(path string, lrc string) error {
+	writer, ok := backendFor(path).(LyricsWriter)
+	if !ok {
+		return errors.New("Lyrics not supported.")
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+	backupTags(path)
+	return writer.WriteLyrics(path, lrc)
+}
+
+// HasLyrics returns true if the music file has
+// embedded lyrics.
+func HasLyrics(path string) bool {
+	lyrics, err := GetLyrics(path)
+	return err == nil && len(lyrics) > 0
+}
+
+// parseLRCTime decodes a time tag in the mm:ss.xx
+// format, without the brackets.
+func parseLRCTime(tag string) (time.Duration, bool) {
+	colon := strings.Index(tag, ":")
+	if colon < 1 {
+		return 0, false
+	}
+
+	minutes, err := strconv.Atoi(tag[:colon])
+	if err != nil || minutes < 0 {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseFloat(tag[colon+1:], 64)
+	if err != nil || seconds < 0 || seconds >= 60 {
+		return 0, false
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
+
+// parseLRC decodes the lyrics in the LRC format.
+// Lines with many time tags are repeated for every one
+// of them and the offset tag is applied. The ID tags,
+// like the artist or title, are ignored.
+// synced is false when no line has a time tag, then
+// the lines are returned as they were found.
+func parseLRC(lrc string) (lines []lyricsLine, synced bool) {
+	offset := time.Duration(0)
+	lrc = strings.Replace(lrc, "\r\n", "\n", -1)
+	for _, line := range strings.Split(lrc, "\n") {
+		var times []time.Duration
+		isTag := false
+		for strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				break
+			}
+
+			tag := line[1:end]
+			if t, ok := parseLRCTime(tag); ok {
+				times = append(times, t)
+			} else if strings.HasPrefix(strings.ToLower(tag), "offset:") {
+				ms, err := strconv.Atoi(strings.TrimSpace(tag[len("offset:"):]))
+				if err == nil {
+					offset = time.Duration(ms) * time.Millisecond
+				}
+				isTag = true
+			} else if strings.Contains(tag, ":") {
+				isTag = true
+			} else {
+				break
+			}
+			line = line[end+1:]
+		}
+
+		if len(times) == 0 {
+			if !isTag {
+				lines = append(lines, lyricsLine{Time: -1, Text: line})
+			}
+			continue
+		}
+
+		synced = true
+		for _, t := range times {
+			lines = append(lines, lyricsLine{Time: t, Text: strings.TrimSpace(line)})
+		}
+	}
+
+	if !synced {
+		// Remove the empty lines at the end.
+		for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1].Text) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		return lines, false
+	}
+
+	// The lines without time tags cannot be placed
+	// in synchronized lyrics.
+	timed := lines[:0]
+	for _, l := range lines {
+		if l.Time >= 0 {
+			// A positive offset shows the lyrics sooner.
+			l.Time -= offset
+			if l.Time < 0 {
+				l.Time = 0
+			}
+			timed = append(timed, l)
+		}
+	}
+	sort.SliceStable(timed, func(i, j int) bool {
+		return timed[i].Time < timed[j].Time
+	})
+	return timed, true
+}
+
+// formatLRC encodes the lyrics in the LRC format.
+// The lines without time are written as plain text.
+func formatLRC(lines []lyricsLine) string {
+	var out []string
+	for _, l := range lines {
+		if l.Time < 0 {
+			out = append(out, l.Text)
+			continue
+		}
+
+		hundredths := int64(l.Time / (10 * time.Millisecond))
+		out = append(out, fmt.Sprintf("[%02d:%02d.%02d]%s",
+			hundredths/6000, hundredths/100%60, hundredths%100, l.Text))
+	}
+
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
+}
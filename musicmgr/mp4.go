@@ -0,0 +1,679 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+// MP4 metadata item atoms used by MuLi.
+const (
+	mp4Title       = "\xa9nam"
+	mp4Artist      = "\xa9ART"
+	mp4Album       = "\xa9alb"
+	mp4AlbumArtist = "aART"
+	mp4Composer    = "\xa9wrt"
+	mp4Genre       = "\xa9gen"
+	mp4GenreID     = "gnre"
+	mp4Year        = "\xa9day"
+	mp4Track       = "trkn"
+	mp4Disc        = "disk"
+	mp4Cover       = "covr"
+)
+
+// mp4DefaultPadding is the size of the free atom added
+// after the moov atom when the whole file needs to be
+// written again, so the next changes can be done in place.
+const mp4DefaultPadding = 2048
+
+// mp4Containers are the atoms that contain other atoms
+// and need to be parsed to reach the metadata and
+// the chunk offset tables.
+var mp4Containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"udta": true,
+	"meta": true,
+	"ilst": true,
+}
+
+// mp4Atom is an atom (or box) from an MP4 file.
+// Containers have their children parsed, other atoms
+// keep their contents in data.
+// prefix holds the version and flags of the meta atom,
+// which is a container with a full box header.
+type mp4Atom struct {
+	kind     string
+	prefix   []byte
+	data     []byte
+	children []*mp4Atom
+}
+
+// parseMp4Atoms decodes all the atoms in the buffer.
+func parseMp4Atoms(data []byte) ([]*mp4Atom, error) {
+	var atoms []*mp4Atom
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("MP4 atom truncated.")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("MP4 atom truncated.")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+
+		if size < header || size > uint64(len(data)) {
+			return nil, errors.New("Wrong MP4 atom size.")
+		}
+
+		atom := &mp4Atom{kind: kind}
+		content := data[header:size]
+		if mp4Containers[kind] {
+			// The meta atom is a full box except on some
+			// QuickTime files where the handler comes first.
+			if kind == "meta" && len(content) >= 8 && string(content[4:8]) != "hdlr" {
+				atom.prefix = content[:4]
+				content = content[4:]
+			}
+
+			children, err := parseMp4Atoms(content)
+			if err != nil {
+				return nil, err
+			}
+			atom.children = children
+		} else {
+			atom.data = content
+		}
+
+		atoms = append(atoms, atom)
+		data = data[size:]
+	}
+	return atoms, nil
+}
+
+// size returns the amount of bytes the atom uses
+// when it is encoded.
+func (a *mp4Atom) size() uint64 {
+	size := uint64(8 + len(a.prefix) + len(a.data))
+	for _, c := range a.children {
+		size += c.size()
+	}
+	if size > 0xffffffff {
+		size += 8
+	}
+	return size
+}
+
+// encode appends the binary representation of
+// the atom to the buffer.
+func (a *mp4Atom) encode(out []byte) []byte {
+	size := a.size()
+	var header [16]byte
+	if size > 0xffffffff {
+		binary.BigEndian.PutUint32(header[:], 1)
+		copy(header[4:], a.kind)
+		binary.BigEndian.PutUint64(header[8:], size)
+		out = append(out, header[:16]...)
+	} else {
+		binary.BigEndian.PutUint32(header[:], uint32(size))
+		copy(header[4:], a.kind)
+		out = append(out, header[:8]...)
+	}
+
+	out = append(out, a.prefix...)
+	out = append(out, a.data...)
+	for _, c := range a.children {
+		out = c.encode(out)
+	}
+	return out
+}
+
+// child returns the first child atom of the specified
+// kind. If it does not exist and create is true, a new
+// one is added at the end of the children list.
+func (a *mp4Atom) child(kind string, create bool) *mp4Atom {
+	for _, c := range a.children {
+		if c.kind == kind {
+			return c
+		}
+	}
+
+	if !create {
+		return nil
+	}
+	c := &mp4Atom{kind: kind}
+	a.children = append(a.children, c)
+	return c
+}
+
+// remove deletes all the children with the specified
+// kind.
+func (a *mp4Atom) remove(kind string) {
+	children := a.children[:0]
+	for _, c := range a.children {
+		if c.kind != kind {
+			children = append(children, c)
+		}
+	}
+	a.children = children
+}
+
+// shiftChunkOffsets adds delta to every chunk offset
+// in the stco and co64 tables that points at or after
+// the specified position.
+func (a *mp4Atom) shiftChunkOffsets(from uint64, delta int64) {
+	switch a.kind {
+	case "stco":
+		if len(a.data) < 8 {
+			return
+		}
+		count := int(binary.BigEndian.Uint32(a.data[4:]))
+		for i := 0; i < count && 12+i*4 <= len(a.data); i++ {
+			entry := a.data[8+i*4:]
+			offset := uint64(binary.BigEndian.Uint32(entry))
+			if offset >= from {
+				binary.BigEndian.PutUint32(entry, uint32(int64(offset)+delta))
+			}
+		}
+	case "co64":
+		if len(a.data) < 8 {
+			return
+		}
+		count := int(binary.BigEndian.Uint32(a.data[4:]))
+		for i := 0; i < count && 16+i*8 <= len(a.data); i++ {
+			entry := a.data[8+i*8:]
+			offset := binary.BigEndian.Uint64(entry)
+			if offset >= from {
+				binary.BigEndian.PutUint64(entry, uint64(int64(offset)+delta))
+			}
+		}
+	}
+
+	for _, c := range a.children {
+		c.shiftChunkOffsets(from, delta)
+	}
+}
+
+// mp4File describes the location of the moov atom
+// inside an MP4 file.
+// free is the size of the free atoms found right after
+// the moov atom and last is true when there is nothing
+// else after those atoms.
+type mp4File struct {
+	moov   *mp4Atom
+	offset int64
+	size   int64
+	free   int64
+	last   bool
+}
+
+// readMp4Header reads the size and kind of the atom
+// found in the current position of the reader.
+// It returns the size of the whole atom and the size
+// of the header.
+func readMp4Header(r io.ReadSeeker, fileSize int64) (int64, int64, string, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header[:8]); err != nil {
+		return 0, 0, "", err
+	}
+
+	pos, err := r.Seek(0, 1)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header))
+	kind := string(header[4:8])
+	switch size {
+	case 0:
+		return fileSize - pos + 8, 8, kind, nil
+	case 1:
+		if _, err := io.ReadFull(r, header[8:]); err != nil {
+			return 0, 0, "", err
+		}
+		return int64(binary.BigEndian.Uint64(header[8:])), 16, kind, nil
+	}
+	return size, 8, kind, nil
+}
+
+// readMp4File finds the moov atom in the MP4 file and
+// parses it.
+func readMp4File(path string) (*mp4File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	file := &mp4File{offset: -1}
+	pos := int64(0)
+	for pos < info.Size() {
+		if _, err = f.Seek(pos, 0); err != nil {
+			return nil, err
+		}
+
+		size, header, kind, err := readMp4Header(f, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		if size < header || pos+size > info.Size() {
+			return nil, errors.New("Wrong MP4 atom size.")
+		}
+
+		if pos == 0 && kind != "ftyp" {
+			return nil, errors.New("Not an MP4 file.")
+		}
+
+		if kind == "moov" {
+			data := make([]byte, size)
+			if _, err = f.ReadAt(data, pos); err != nil {
+				return nil, err
+			}
+			atoms, err := parseMp4Atoms(data)
+			if err != nil {
+				return nil, err
+			}
+			file.moov = atoms[0]
+			file.offset = pos
+			file.size = size
+			file.last = true
+		} else if file.moov != nil && file.last {
+			if kind == "free" || kind == "skip" {
+				file.free += size
+			} else {
+				file.last = false
+			}
+		}
+		pos += size
+	}
+
+	if file.moov == nil {
+		return nil, errors.New("MP4 moov atom not found.")
+	}
+	return file, nil
+}
+
+// freeAtom returns a free atom of the specified size.
+func freeAtom(size int64) []byte {
+	out := make([]byte, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], "free")
+	return out
+}
+
+// writeMp4File stores the moov atom in the MP4 file.
+// The atom is written in place when it fits in the space
+// used by the old moov atom and the free atoms after it,
+// or when it is the last atom in the file. Otherwise the
+// file is written again, adding some padding and fixing
+// the chunk offsets of the media data that moves.
+func writeMp4File(path string, file *mp4File) error {
+	size := int64(file.moov.size())
+	available := file.size + file.free
+
+	var padding int64 = -1
+	switch {
+	case size == available:
+		padding = 0
+	case size+8 <= available:
+		padding = available - size
+	case file.last:
+		padding = 0
+	}
+
+	if padding >= 0 {
+		encoded := file.moov.encode(nil)
+		if padding > 0 {
+			encoded = append(encoded, freeAtom(padding)...)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(encoded, file.offset)
+		if err == nil && file.last {
+			err = f.Truncate(file.offset + int64(len(encoded)))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	delta := size + mp4DefaultPadding - available
+	file.moov.shiftChunkOffsets(uint64(file.offset+file.size), delta)
+	encoded := file.moov.encode(nil)
+	encoded = append(encoded, freeAtom(mp4DefaultPadding)...)
+	return replaceFile(path, func(src *os.File, w io.Writer) error {
+		if _, err := io.CopyN(w, src, file.offset); err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		if _, err := src.Seek(file.offset+available, 0); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// ilst returns the metadata item list of the file,
+// creating the udta, meta and ilst atoms if needed.
+func (file *mp4File) ilst() *mp4Atom {
+	udta := file.moov.child("udta", true)
+	meta := udta.child("meta", false)
+	if meta == nil {
+		meta = udta.child("meta", true)
+		meta.prefix = make([]byte, 4)
+		// Handler used by iTunes for the metadata.
+		hdlr := meta.child("hdlr", true)
+		hdlr.data = make([]byte, 25)
+		copy(hdlr.data[8:], "mdirappl")
+	}
+	return meta.child("ilst", true)
+}
+
+// mp4ItemData returns the payload of the data atom
+// inside a metadata item.
+func mp4ItemData(item *mp4Atom) []byte {
+	atoms, err := parseMp4Atoms(item.data)
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range atoms {
+		// Skip the type and the locale.
+		if a.kind == "data" && len(a.data) >= 8 {
+			return a.data[8:]
+		}
+	}
+	return nil
+}
+
+// setMp4Item replaces the contents of a metadata item
+// with a single data atom of the specified type.
+func setMp4Item(ilst *mp4Atom, kind string, dataType uint32, payload []byte) {
+	data := &mp4Atom{kind: "data", data: make([]byte, 8+len(payload))}
+	binary.BigEndian.PutUint32(data.data, dataType)
+	copy(data.data[8:], payload)
+	ilst.child(kind, true).data = data.encode(nil)
+}
+
+// mp4Text returns the text stored in a metadata item.
+func mp4Text(ilst *mp4Atom, kind string) string {
+	item := ilst.child(kind, false)
+	if item == nil {
+		return ""
+	}
+	return string(mp4ItemData(item))
+}
+
+// setMp4Text stores a text in a metadata item.
+func setMp4Text(ilst *mp4Atom, kind, value string) {
+	// Type 1 is UTF-8 text.
+	setMp4Item(ilst, kind, 1, []byte(value))
+}
+
+// mp4Pair returns the number and the total stored in a
+// track or disc metadata item.
+func mp4Pair(ilst *mp4Atom, kind string) (int, int) {
+	item := ilst.child(kind, false)
+	if item == nil {
+		return 0, 0
+	}
+
+	payload := mp4ItemData(item)
+	if len(payload) < 6 {
+		return 0, 0
+	}
+	return int(binary.BigEndian.Uint16(payload[2:])), int(binary.BigEndian.Uint16(payload[4:]))
+}
+
+// setMp4Pair stores the number and the total in a
+// track or disc metadata item.
+func setMp4Pair(ilst *mp4Atom, kind string, number, total int) {
+	payload := make([]byte, 6)
+	if kind == mp4Track {
+		payload = make([]byte, 8)
+	}
+	binary.BigEndian.PutUint16(payload[2:], uint16(number))
+	binary.BigEndian.PutUint16(payload[4:], uint16(total))
+	// Type 0 is implicit binary data.
+	setMp4Item(ilst, kind, 0, payload)
+}
+
+func init() {
+	RegisterFormat(mp4Backend{}, ".m4a", ".m4b", ".mp4")
+}
+
+// mp4Backend manages the metadata atoms in MP4 files,
+// both AAC and ALAC.
+type mp4Backend struct{}
+
+// ReadTags returns a FileTags struct with
+// all the information obtained from the metadata
+// atoms in the MP4 file.
+func (mp4Backend) ReadTags(path string) (FileTags, error) {
+	file, err := readMp4File(path)
+	if err != nil {
+		return FileTags{}, err
+	}
+
+	ilst := file.ilst()
+	tags := FileTags{
+		Title:       mp4Text(ilst, mp4Title),
+		Artist:      mp4Text(ilst, mp4Artist),
+		Album:       mp4Text(ilst, mp4Album),
+		AlbumArtist: mp4Text(ilst, mp4AlbumArtist),
+		Composer:    mp4Text(ilst, mp4Composer),
+		Genre:       mp4Text(ilst, mp4Genre),
+		Year:        parseYear(mp4Text(ilst, mp4Year)),
+	}
+
+	// The standard genres are stored as the ID3v1
+	// genre number plus one.
+	if tags.Genre == "" {
+		if item := ilst.child(mp4GenreID, false); item != nil {
+			if payload := mp4ItemData(item); len(payload) == 2 {
+				tags.Genre = genreName(int(binary.BigEndian.Uint16(payload)) - 1)
+			}
+		}
+	}
+
+	tags.Track, tags.TrackTotal = mp4Pair(ilst, mp4Track)
+	tags.Disc, tags.DiscTotal = mp4Pair(ilst, mp4Disc)
+	return tags, nil
+}
+
+// WriteTags updates the metadata atoms with the
+// new values in the song MP4 file.
+func (mp4Backend) WriteTags(path string, tags FileTags) error {
+	file, err := readMp4File(path)
+	if err != nil {
+		return err
+	}
+
+	ilst := file.ilst()
+	texts := []struct {
+		kind  string
+		value string
+	}{
+		{mp4Title, tags.Title},
+		{mp4Artist, tags.Artist},
+		{mp4Album, tags.Album},
+		{mp4AlbumArtist, tags.AlbumArtist},
+		{mp4Composer, tags.Composer},
+	}
+	for _, t := range texts {
+		if t.value != "" {
+			setMp4Text(ilst, t.kind, t.value)
+		}
+	}
+
+	if tags.Genre != "" {
+		ilst.remove(mp4GenreID)
+		setMp4Text(ilst, mp4Genre, tags.Genre)
+	}
+	if tags.Year > 0 {
+		setMp4Text(ilst, mp4Year, strconv.Itoa(tags.Year))
+	}
+	if tags.Track > 0 {
+		_, total := mp4Pair(ilst, mp4Track)
+		if tags.TrackTotal > 0 {
+			total = tags.TrackTotal
+		}
+		setMp4Pair(ilst, mp4Track, tags.Track, total)
+	}
+	if tags.Disc > 0 {
+		_, total := mp4Pair(ilst, mp4Disc)
+		if tags.DiscTotal > 0 {
+			total = tags.DiscTotal
+		}
+		setMp4Pair(ilst, mp4Disc, tags.Disc, total)
+	}
+
+	return writeMp4File(path, file)
+}
+
+// ReadPictures returns the images stored in the cover
+// metadata item of the MP4 file. MP4 files do not
+// keep the picture type, all of them are taken as
+// front covers.
+func (mp4Backend) ReadPictures(path string) ([]Picture, error) {
+	file, err := readMp4File(path)
+	if err != nil {
+		return nil, err
+	}
+
+	item := file.ilst().child(mp4Cover, false)
+	if item == nil {
+		return nil, nil
+	}
+
+	atoms, err := parseMp4Atoms(item.data)
+	if err != nil {
+		return nil, err
+	}
+
+	var pictures []Picture
+	for _, a := range atoms {
+		if a.kind != "data" || len(a.data) <= 8 {
+			continue
+		}
+
+		p := Picture{Type: FrontCover, Data: a.data[8:]}
+		switch binary.BigEndian.Uint32(a.data) {
+		case 13:
+			p.MimeType = "image/jpeg"
+		case 14:
+			p.MimeType = "image/png"
+		case 27:
+			p.MimeType = "image/bmp"
+		default:
+			continue
+		}
+		pictures = append(pictures, p)
+	}
+	return pictures, nil
+}
+
+// WritePicture replaces the cover metadata item of the
+// MP4 file with the picture. Only JPEG and PNG images
+// are supported.
+func (mp4Backend) WritePicture(path string, picture Picture) error {
+	var dataType uint32
+	switch picture.MimeType {
+	case "image/jpeg":
+		dataType = 13
+	case "image/png":
+		dataType = 14
+	default:
+		return errors.New("Unsupported image format.")
+	}
+
+	file, err := readMp4File(path)
+	if err != nil {
+		return err
+	}
+
+	setMp4Item(file.ilst(), mp4Cover, dataType, picture.Data)
+	return writeMp4File(path, file)
+}
+
+// SnapshotTags returns the encoded metadata item list
+// of the MP4 file without the cover item.
+func (mp4Backend) SnapshotTags(path string) ([]byte, error) {
+	file, err := readMp4File(path)
+	if err != nil {
+		return nil, err
+	}
+	ilst := file.ilst()
+	ilst.remove(mp4Cover)
+	return ilst.encode(nil), nil
+}
+
+// RestoreTags replaces the metadata items of the MP4
+// file with the ones from the snapshot, keeping the
+// cover item the file has now.
+func (mp4Backend) RestoreTags(path string, snapshot []byte) error {
+	atoms, err := parseMp4Atoms(snapshot)
+	if err != nil {
+		return err
+	}
+	if len(atoms) != 1 || atoms[0].kind != "ilst" {
+		return errors.New("Wrong MP4 tags snapshot.")
+	}
+
+	file, err := readMp4File(path)
+	if err != nil {
+		return err
+	}
+
+	ilst := file.ilst()
+	cover := ilst.child(mp4Cover, false)
+	ilst.children = atoms[0].children
+	ilst.remove(mp4Cover)
+	if cover != nil {
+		ilst.children = append(ilst.children, cover)
+	}
+	return writeMp4File(path, file)
+}
@@ -0,0 +1,280 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testAtom returns an atom with the contents.
+func testAtom(kind string, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], kind)
+	return append(out, body...)
+}
+
+// testChunks are the sizes of the media chunks in the
+// MP4 fixtures.
+var testChunks = []int{700, 1200, 90, 3000}
+
+// mp4Layout is the order of the top level atoms in an
+// MP4 fixture.
+type mp4Layout struct {
+	moovLast bool
+	free     int
+	co64     bool
+}
+
+// mp4Fixture returns an MP4 file with a title in the
+// metadata and the chunks of testChunks in the media
+// data. The chunk offsets table is filled with the
+// position of every chunk.
+func mp4Fixture(layout mp4Layout) []byte {
+	ftyp := testAtom("ftyp", []byte("M4A \x00\x00\x00\x00M4A mp42isom"))
+	var media []byte
+	for i, size := range testChunks {
+		media = append(media, testPayload(size, int64(50+i))...)
+	}
+	mdat := testAtom("mdat", media)
+
+	item := testAtom(mp4Title, testAtom("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte("Fixture")))
+	hdlr := testAtom("hdlr", make([]byte, 8), []byte("mdirappl"), make([]byte, 9))
+	meta := testAtom("meta", make([]byte, 4), hdlr, testAtom("ilst", item))
+
+	moov := func(start int) []byte {
+		table := make([]byte, 8)
+		binary.BigEndian.PutUint32(table[4:], uint32(len(testChunks)))
+		offset := start
+		for _, size := range testChunks {
+			if layout.co64 {
+				var entry [8]byte
+				binary.BigEndian.PutUint64(entry[:], uint64(offset))
+				table = append(table, entry[:]...)
+			} else {
+				var entry [4]byte
+				binary.BigEndian.PutUint32(entry[:], uint32(offset))
+				table = append(table, entry[:]...)
+			}
+			offset += size
+		}
+
+		kind := "stco"
+		if layout.co64 {
+			kind = "co64"
+		}
+		stbl := testAtom("stbl", testAtom("stsd", make([]byte, 16)), testAtom(kind, table))
+		trak := testAtom("trak", testAtom("tkhd", make([]byte, 84)), testAtom("mdia", testAtom("minf", stbl)))
+		return testAtom("moov", testAtom("mvhd", make([]byte, 100)), trak, testAtom("udta", meta))
+	}
+
+	out := append([]byte{}, ftyp...)
+	if layout.moovLast {
+		out = append(out, mdat...)
+		return append(out, moov(len(ftyp)+8)...)
+	}
+
+	size := len(moov(0))
+	out = append(out, moov(len(ftyp)+size+layout.free+8)...)
+	if layout.free > 0 {
+		out = append(out, testAtom("free", make([]byte, layout.free-8))...)
+	}
+	return append(out, mdat...)
+}
+
+// testTopAtoms returns the top level atoms of the file.
+func testTopAtoms(t *testing.T, data []byte) map[string][]byte {
+	atoms := make(map[string][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatal("MP4 atom truncated.")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatal("Wrong MP4 atom size.")
+		}
+		atoms[string(data[4:8])] = data[8:size]
+		data = data[size:]
+	}
+	return atoms
+}
+
+// testChunkOffsets returns the offsets stored in the
+// stco or co64 table of the moov atom.
+func testChunkOffsets(t *testing.T, moov []byte) []uint64 {
+	path := []string{"trak", "mdia", "minf", "stbl"}
+	data := moov
+	for _, kind := range path {
+		data = testTopAtomsPrefix(t, data)[kind]
+		if data == nil {
+			t.Fatalf("MP4 %s atom not found.", kind)
+		}
+	}
+
+	atoms := testTopAtomsPrefix(t, data)
+	var offsets []uint64
+	if table := atoms["stco"]; table != nil {
+		count := int(binary.BigEndian.Uint32(table[4:]))
+		for i := 0; i < count; i++ {
+			offsets = append(offsets, uint64(binary.BigEndian.Uint32(table[8+i*4:])))
+		}
+	}
+	if table := atoms["co64"]; table != nil {
+		count := int(binary.BigEndian.Uint32(table[4:]))
+		for i := 0; i < count; i++ {
+			offsets = append(offsets, binary.BigEndian.Uint64(table[8+i*8:]))
+		}
+	}
+	return offsets
+}
+
+// testTopAtomsPrefix works as testTopAtoms but ignores
+// the data that does not fill a whole atom.
+func testTopAtomsPrefix(t *testing.T, data []byte) map[string][]byte {
+	atoms := make(map[string][]byte)
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatal("Wrong MP4 atom size.")
+		}
+		atoms[string(data[4:8])] = data[8:size]
+		data = data[size:]
+	}
+	return atoms
+}
+
+// checkMp4 checks that the media data is kept and that
+// every chunk offset points to the same chunk than
+// before.
+func checkMp4(t *testing.T, original, data []byte) {
+	oldAtoms := testTopAtoms(t, original)
+	newAtoms := testTopAtoms(t, data)
+	if !bytes.Equal(oldAtoms["mdat"], newAtoms["mdat"]) {
+		t.Fatal("The media data changed.")
+	}
+	if !bytes.Equal(oldAtoms["ftyp"], newAtoms["ftyp"]) {
+		t.Fatal("The ftyp atom changed.")
+	}
+
+	oldOffsets := testChunkOffsets(t, oldAtoms["moov"])
+	newOffsets := testChunkOffsets(t, newAtoms["moov"])
+	if len(newOffsets) != len(testChunks) {
+		t.Fatal("Chunk offsets missing.")
+	}
+	for i, size := range testChunks {
+		oldChunk := original[oldOffsets[i] : oldOffsets[i]+uint64(size)]
+		if newOffsets[i]+uint64(size) > uint64(len(data)) ||
+			!bytes.Equal(data[newOffsets[i]:newOffsets[i]+uint64(size)], oldChunk) {
+			t.Fatalf("The chunk %d moved without updating its offset.", i)
+		}
+	}
+}
+
+// writeMp4Tags writes the tags in a copy of the fixture
+// and checks the result, it returns the new file.
+func writeMp4Tags(t *testing.T, original []byte, tags FileTags) []byte {
+	path, clean := writeFixture(t, "song.m4a", original)
+	defer clean()
+
+	err := mp4Backend{}.WriteTags(path, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := readFixture(t, path)
+	checkMp4(t, original, data)
+
+	read, err := mp4Backend{}.ReadTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Title == "" {
+		tags.Title = "Fixture"
+	}
+	if read.Title != tags.Title || read.Artist != tags.Artist || read.Album != tags.Album {
+		t.Fatal(read)
+	}
+	return data
+}
+
+func TestMp4WriteTagsMoveMedia(t *testing.T) {
+	for _, co64 := range []bool{false, true} {
+		original := mp4Fixture(mp4Layout{co64: co64})
+		data := writeMp4Tags(t, original, FileTags{Artist: "Ártist", Album: "Álbum"})
+		if len(data) <= len(original) {
+			t.Fatal("The media data did not move.")
+		}
+
+		// The padding added when the media data moved is
+		// used by the next change.
+		again := writeMp4Tags(t, data, FileTags{Title: "Títle", Artist: "Ártist", Album: "Álbum"})
+		if len(again) != len(data) {
+			t.Fatal("The padding was not used.")
+		}
+	}
+}
+
+func TestMp4WriteTagsInFreeSpace(t *testing.T) {
+	original := mp4Fixture(mp4Layout{free: 512})
+	data := writeMp4Tags(t, original, FileTags{Artist: "Ártist"})
+	if len(data) != len(original) {
+		t.Fatal("The free atom was not used.")
+	}
+	if testTopAtoms(t, data)["free"] == nil {
+		t.Fatal("The free atom was removed.")
+	}
+}
+
+func TestMp4WriteTagsLastMoov(t *testing.T) {
+	original := mp4Fixture(mp4Layout{moovLast: true})
+	data := writeMp4Tags(t, original, FileTags{Artist: strings.Repeat("Long Artist ", 1000)})
+	if !bytes.HasPrefix(data, original[:len(original)-len(testTopAtoms(t, original)["moov"])-8]) {
+		t.Fatal("The atoms before the moov atom changed.")
+	}
+
+	// The space left when the moov atom gets smaller is
+	// kept as a free atom.
+	smaller := writeMp4Tags(t, data, FileTags{Artist: "Someone"})
+	if len(smaller) != len(data) || testTopAtoms(t, smaller)["free"] == nil {
+		t.Fatal("The space of the old moov atom was not kept.")
+	}
+}
+
+func TestMp4WritePicture(t *testing.T) {
+	original := mp4Fixture(mp4Layout{})
+	path, clean := writeFixture(t, "song.m4a", original)
+	defer clean()
+
+	picture := Picture{Type: FrontCover, MimeType: "image/jpeg", Data: testPayload(60000, 13)}
+	err := mp4Backend{}.WritePicture(path, picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkMp4(t, original, readFixture(t, path))
+	pictures, err := mp4Backend{}.ReadPictures(path)
+	if err != nil || len(pictures) != 1 || !bytes.Equal(pictures[0].Data, picture.Data) {
+		t.Fatal("The picture was not stored.", err)
+	}
+}
@@ -20,67 +20,262 @@
 package musicmgr
 
 import (
-	"path/filepath"
-
-	id3 "github.com/mikkyang/id3-go"
+	"bytes"
+	"errors"
+	"os"
 )
 
-// GetMp3Tags returns a FileTags struct with
+func init() {
+	RegisterFormat(mp3Backend{}, ".mp3")
+}
+
+// mp3Backend manages the ID3 tags in MP3 files.
+// The ID3v2 tag is the main source of information,
+// the ID3v1 tag is only used for the values that are
+// missing in the ID3v2 tag and it is kept updated if
+// the file has one.
+type mp3Backend struct{}
+
+// readMp3Tags reads the ID3v2 and ID3v1 tags from an
+// MP3 file. The ID3v1 tag is nil if the file does not
+// have one.
+func readMp3Tags(path string) (*id3Tag, *id3v1Tag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	tag, err := readID3v2(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v1, err := readID3v1(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tag, v1, nil
+}
+
+// ReadTags returns a FileTags struct with
 // all the information obtained from the tags in the
 // MP3 file.
-// Includes the Artist, Album and Song and defines
-// default values if the values are missing.
-// If the tags are missing, the default values will
-// be stored on the file.
-// If the tags are obtained correctly the first
-// return value will be nil.
-func GetMp3Tags(path string) (error, FileTags) {
-	mp3File, err := id3.Open(path)
+func (mp3Backend) ReadTags(path string) (FileTags, error) {
+	tag, v1, err := readMp3Tags(path)
+	if err != nil {
+		return FileTags{}, err
+	}
+
+	tags := tag.tags()
+	if v1 == nil {
+		return tags, nil
+	}
+
+	old := v1.tags()
+	if tags.Title == "" {
+		tags.Title = old.Title
+	}
+	if tags.Artist == "" {
+		tags.Artist = old.Artist
+	}
+	if tags.Album == "" {
+		tags.Album = old.Album
+	}
+	if tags.Genre == "" {
+		tags.Genre = old.Genre
+	}
+	if tags.Year == 0 {
+		tags.Year = old.Year
+	}
+	if tags.Track == 0 {
+		tags.Track = old.Track
+	}
+	return tags, nil
+}
+
+// WriteTags updates the ID3 tags with the new values
+// in the song MP3 file.
+// The ID3v2 tag is updated in place when it fits in
+// the space used by the old one, otherwise the file
+// is written again.
+func (mp3Backend) WriteTags(path string, tags FileTags) error {
+	tag, v1, err := readMp3Tags(path)
+	if err != nil {
+		return err
+	}
+
+	tag.setTags(tags)
+	err = writeID3v2(path, tag)
+	if err != nil || v1 == nil {
+		return err
+	}
+
+	v1.setTags(tags)
+	return writeID3v1(path, v1)
+}
+
+// ReadPictures returns the images stored in the APIC
+// frames of the MP3 file.
+func (mp3Backend) ReadPictures(path string) ([]Picture, error) {
+	tag, _, err := readMp3Tags(path)
+	if err != nil {
+		return nil, err
+	}
+	return tag.pictures(), nil
+}
+
+// WritePicture stores the picture in a new APIC frame
+// of the MP3 file, replacing the pictures of the same
+// type.
+func (mp3Backend) WritePicture(path string, picture Picture) error {
+	tag, _, err := readMp3Tags(path)
+	if err != nil {
+		return err
+	}
+
+	tag.setPicture(picture)
+	return writeID3v2(path, tag)
+}
+
+// ReadAudioInfo returns the duration, bitrate, sample
+// rate and channel mode of the MP3 file.
+func (mp3Backend) ReadAudioInfo(path string) (AudioInfo, error) {
+	return readMpegInfo(path)
+}
+
+// RepairCharset rewrites the ID3v2 text frames that
+// are stored in a legacy charset using Unicode.
+// The ID3v1 tag cannot store Unicode text so it is not
+// modified, but its values are copied to the ID3v2
+// tag when they are missing there.
+func (mp3Backend) RepairCharset(path string) (bool, error) {
+	tag, v1, err := readMp3Tags(path)
 	if err != nil {
-		_, file := filepath.Split(path)
-		extension := filepath.Ext(file)
-		songTitle := file[0 : len(file)-len(extension)]
-		return err, FileTags{songTitle, "unknown", "unknown"}
+		return false, err
 	}
 
-	defer mp3File.Close()
+	changed := tag.repairCharset()
+	if v1 != nil && v1.legacy() {
+		old := v1.tags()
+		current := tag.tags()
+		var missing FileTags
+		if current.Title == "" {
+			missing.Title = old.Title
+		}
+		if current.Artist == "" {
+			missing.Artist = old.Artist
+		}
+		if current.Album == "" {
+			missing.Album = old.Album
+		}
+
+		if missing != (FileTags{}) {
+			tag.setTags(missing)
+			changed = true
+		}
+	}
 
-	title := mp3File.Title()
-	if title == "" || title == "unknown" {
-		_, file := filepath.Split(path)
-		extension := filepath.Ext(file)
-		title = file[0 : len(file)-len(extension)]
-		mp3File.SetTitle(title)
+	if !changed {
+		return false, nil
 	}
+	return true, writeID3v2(path, tag)
+}
 
-	artist := mp3File.Artist()
-	if artist == "" {
-		artist = "unknown"
-		mp3File.SetArtist(artist)
+// ReadLyrics returns the lyrics stored in the SYLT or
+// USLT frames of the MP3 file.
+func (mp3Backend) ReadLyrics(path string) (string, error) {
+	tag, _, err := readMp3Tags(path)
+	if err != nil {
+		return "", err
 	}
+	return tag.lyrics(), nil
+}
 
-	album := mp3File.Album()
-	if album == "" {
-		album = "unknown"
-		mp3File.SetAlbum(album)
+// WriteLyrics stores the lyrics in the USLT frame of
+// the MP3 file, synchronized lyrics are also stored in
+// a SYLT frame.
+func (mp3Backend) WriteLyrics(path string, lrc string) error {
+	tag, _, err := readMp3Tags(path)
+	if err != nil {
+		return err
 	}
 
-	ft := FileTags{title, artist, album}
-	return nil, ft
+	tag.setLyrics(lrc)
+	return writeID3v2(path, tag)
 }
 
-// SetMp3Tags updates the Artist, Album and Title
-// tags with new values in the song MP3 file.
-func SetMp3Tags(artist string, album string, title string, songPath string) error {
-	mp3File, err := id3.Open(songPath)
+// WriteReplayGain stores the ReplayGain values in
+// TXXX frames of the MP3 file.
+func (mp3Backend) WriteReplayGain(path string, rg ReplayGain) error {
+	tag, _, err := readMp3Tags(path)
 	if err != nil {
 		return err
 	}
-	defer mp3File.Close()
 
-	mp3File.SetTitle(title)
-	mp3File.SetArtist(artist)
-	mp3File.SetAlbum(album)
+	for _, value := range rg.values() {
+		tag.setUserText(value[0], value[1])
+	}
+	return writeID3v2(path, tag)
+}
 
-	return nil
+// SnapshotTags returns the encoded ID3v2 tag of the MP3
+// file followed by the ID3v1 tag, if there is one.
+// The APIC frames are left out, the pictures are not
+// kept in the snapshots.
+func (mp3Backend) SnapshotTags(path string) ([]byte, error) {
+	tag, v1, err := readMp3Tags(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tag.frames = id3Frames(tag.frames, false)
+	snapshot := tag.encode(0)
+	if v1 != nil {
+		snapshot = append(snapshot, v1[:]...)
+	}
+	return snapshot, nil
+}
+
+// RestoreTags replaces the ID3v2 tag of the MP3 file
+// with the one from the snapshot, keeping the APIC
+// frames the file has now. The ID3v1 tag is restored
+// too when both the file and the snapshot have one.
+func (mp3Backend) RestoreTags(path string, snapshot []byte) error {
+	old, err := readID3v2(bytes.NewReader(snapshot))
+	if err != nil {
+		return err
+	}
+	rest := snapshot[old.size:]
+	if len(rest) != 0 && len(rest) != id3v1Size {
+		return errors.New("Wrong MP3 tags snapshot.")
+	}
+
+	tag, v1, err := readMp3Tags(path)
+	if err != nil {
+		return err
+	}
+
+	old.frames = append(id3Frames(old.frames, false), id3Frames(tag.frames, true)...)
+	old.size = tag.size
+	err = writeID3v2(path, old)
+	if err != nil || v1 == nil || len(rest) == 0 {
+		return err
+	}
+
+	copy(v1[:], rest)
+	return writeID3v1(path, v1)
+}
+
+// id3Frames returns the APIC frames from the list when
+// pictures is true, or all the other frames when it is
+// false.
+func id3Frames(frames []*id3Frame, pictures bool) []*id3Frame {
+	var result []*id3Frame
+	for _, f := range frames {
+		if (f.id == "APIC") == pictures {
+			result = append(result, f)
+		}
+	}
+	return result
 }
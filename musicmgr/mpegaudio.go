@@ -0,0 +1,277 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// MPEG audio versions, as stored in the frame header.
+const (
+	mpeg25 = 0
+	mpeg2  = 2
+	mpeg1  = 3
+)
+
+// mpegMaxSync is the amount of bytes after the ID3v2
+// tag where the first frame is searched.
+const mpegMaxSync = 64 * 1024
+
+// mpegBitrates holds the bitrates in kbps for every
+// bitrate index, for MPEG-1 layers I, II and III and
+// MPEG-2/2.5 layers I and II/III.
+var mpegBitrates = [5][16]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// mpegSampleRates holds the MPEG-1 sample rates, they
+// are halved for MPEG-2 and divided by four for
+// MPEG-2.5.
+var mpegSampleRates = [3]int{44100, 48000, 32000}
+
+// mpegChannelModes are the names of the channel modes.
+var mpegChannelModes = [4]string{"Stereo", "Joint stereo", "Dual channel", "Mono"}
+
+// mpegFrame is a decoded MPEG audio frame header.
+type mpegFrame struct {
+	version     int
+	layer       int
+	bitrate     int
+	sampleRate  int
+	padding     int
+	channelMode int
+}
+
+// parseMpegFrame decodes a frame header, it returns
+// false if the bytes are not a valid header.
+func parseMpegFrame(header []byte) (mpegFrame, bool) {
+	var f mpegFrame
+	if len(header) < 4 || header[0] != 0xff || header[1]&0xe0 != 0xe0 {
+		return f, false
+	}
+
+	f.version = int(header[1]>>3) & 0x03
+	f.layer = 4 - int(header[1]>>1)&0x03
+	bitrateIndex := int(header[2] >> 4)
+	rateIndex := int(header[2]>>2) & 0x03
+	if f.version == 1 || f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return f, false
+	}
+
+	table := f.layer - 1
+	if f.version != mpeg1 {
+		table = 3
+		if f.layer > 1 {
+			table = 4
+		}
+	}
+	f.bitrate = mpegBitrates[table][bitrateIndex]
+
+	f.sampleRate = mpegSampleRates[rateIndex]
+	switch f.version {
+	case mpeg2:
+		f.sampleRate /= 2
+	case mpeg25:
+		f.sampleRate /= 4
+	}
+
+	f.padding = int(header[2]>>1) & 0x01
+	f.channelMode = int(header[3] >> 6)
+	return f, true
+}
+
+// samples returns the amount of samples per channel
+// stored in the frame.
+func (f mpegFrame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version != mpeg1:
+		return 576
+	}
+	return 1152
+}
+
+// size returns the length of the frame in bytes,
+// including the header.
+func (f mpegFrame) size() int {
+	if f.layer == 1 {
+		return (12*f.bitrate*1000/f.sampleRate + f.padding) * 4
+	}
+	return f.samples()/8*f.bitrate*1000/f.sampleRate + f.padding
+}
+
+// sideInfo returns the size of the layer III side
+// information that follows the frame header, it is
+// where the Xing header is placed.
+func (f mpegFrame) sideInfo() int {
+	mono := f.channelMode == 3
+	switch {
+	case f.version == mpeg1 && mono:
+		return 17
+	case f.version == mpeg1:
+		return 32
+	case mono:
+		return 9
+	}
+	return 17
+}
+
+// findMpegFrame returns the offset of the first frame
+// in the buffer that is followed by another valid
+// frame with the same version and layer, so a random
+// sync pattern is not taken as a frame.
+func findMpegFrame(data []byte) (int, mpegFrame, error) {
+	for i := 0; i+4 <= len(data); i++ {
+		f, ok := parseMpegFrame(data[i:])
+		if !ok {
+			continue
+		}
+
+		next := i + f.size()
+		if next+4 > len(data) {
+			// The file is too short to check, take it.
+			return i, f, nil
+		}
+		n, ok := parseMpegFrame(data[next:])
+		if ok && n.version == f.version && n.layer == f.layer {
+			return i, f, nil
+		}
+	}
+	return 0, mpegFrame{}, errors.New("MPEG frame not found.")
+}
+
+// readMpegInfo reads the properties of the audio
+// stream in an MPEG file. The duration is taken from
+// the Xing, Info or VBRI header if the first frame has
+// one, otherwise the stream is taken as constant
+// bitrate and the duration is calculated from its size.
+func readMpegInfo(path string) (AudioInfo, error) {
+	var info AudioInfo
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	tag, err := readID3v2(f)
+	if err != nil {
+		return info, err
+	}
+
+	// The audio ends before the ID3v1 tag.
+	end := stat.Size()
+	v1, err := readID3v1(f)
+	if err != nil {
+		return info, err
+	}
+	if v1 != nil {
+		end -= id3v1Size
+	}
+
+	if _, err = f.Seek(tag.size, 0); err != nil {
+		return info, err
+	}
+	data := make([]byte, mpegMaxSync)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return info, err
+	}
+	data = data[:n]
+
+	offset, frame, err := findMpegFrame(data)
+	if err != nil {
+		return info, err
+	}
+
+	info.SampleRate = frame.sampleRate
+	info.ChannelMode = mpegChannelModes[frame.channelMode]
+	info.Channels = 2
+	if frame.channelMode == 3 {
+		info.Channels = 1
+	}
+
+	start := tag.size + int64(offset)
+	audioBytes := end - start
+	frames, size, vbr := mpegVBRHeader(data[offset:], frame)
+	if frames > 0 {
+		info.Duration = time.Duration(frames) * time.Duration(frame.samples()) * time.Second / time.Duration(frame.sampleRate)
+		if size > 0 {
+			audioBytes = int64(size)
+		}
+		if info.Duration > 0 {
+			info.Bitrate = int(audioBytes * 8 * int64(time.Second) / int64(info.Duration) / 1000)
+		}
+		info.VBR = vbr
+		return info, nil
+	}
+
+	info.Bitrate = frame.bitrate
+	if audioBytes > 0 {
+		info.Duration = time.Duration(audioBytes) * 8 * time.Second / time.Duration(frame.bitrate*1000)
+	}
+	return info, nil
+}
+
+// mpegVBRHeader reads the Xing, Info or VBRI header
+// from the first frame. It returns the amount of
+// frames and the size of the stream in bytes, they
+// are zero if the values are not present, and true
+// if the header belongs to a variable bitrate stream.
+// The Info header is the one LAME writes on constant
+// bitrate streams.
+func mpegVBRHeader(data []byte, frame mpegFrame) (int, int, bool) {
+	xing := 4 + frame.sideInfo()
+	if len(data) >= xing+8 {
+		id := string(data[xing : xing+4])
+		if id == "Xing" || id == "Info" {
+			flags := binary.BigEndian.Uint32(data[xing+4:])
+			pos := xing + 8
+			frames, size := 0, 0
+			if flags&0x01 != 0 && len(data) >= pos+4 {
+				frames = int(binary.BigEndian.Uint32(data[pos:]))
+				pos += 4
+			}
+			if flags&0x02 != 0 && len(data) >= pos+4 {
+				size = int(binary.BigEndian.Uint32(data[pos:]))
+			}
+			return frames, size, id == "Xing"
+		}
+	}
+
+	// The VBRI header is always 32 bytes after the
+	// frame header.
+	if len(data) >= 4+32+18 && string(data[36:40]) == "VBRI" {
+		size := int(binary.BigEndian.Uint32(data[46:]))
+		frames := int(binary.BigEndian.Uint32(data[50:]))
+		return frames, size, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+//go:build mp3decoder
+// +build mp3decoder
+
+package musicmgr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// AnalyzeLoudness decodes the MP3 file and measures
+// its loudness. The decoder always returns 16 bits
+// stereo samples, mono streams are duplicated on both
+// channels so only the first one is measured for them,
+// the channel mode is read from the frame header.
+// The decoder is only built with the mp3decoder tag so
+// go-mp3 is not needed to build MuLi, without it the
+// MP3 files do not support the loudness analysis.
+func (mp3Backend) AnalyzeLoudness(path string) (*Loudness, error) {
+	info, err := readMpegInfo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder, err := mp3.NewDecoder(f)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := 2
+	if info.Channels == 1 {
+		channels = 1
+	}
+
+	meter := newLoudnessMeter(decoder.SampleRate(), channels)
+	r := bufio.NewReaderSize(decoder, 64*1024)
+	frame := make([]byte, 4)
+	samples := make([]float64, channels)
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+
+		samples[0] = float64(int16(binary.LittleEndian.Uint16(frame))) / 32768
+		if channels == 2 {
+			samples[1] = float64(int16(binary.LittleEndian.Uint16(frame[2:]))) / 32768
+		}
+		meter.add(samples)
+	}
+	return meter.result(), nil
+}
@@ -19,9 +19,292 @@
 // music files.
 package musicmgr
 
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
 // FileTags defines the tags found in a specific music file.
+// When the tags are written, the empty strings and the
+// zero numbers are ignored and the values already in
+// the file are kept.
 type FileTags struct {
-	Title  string
-	Artist string
-	Album  string
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Composer    string
+	Genre       string
+	Year        int
+	Track       int
+	TrackTotal  int
+	Disc        int
+	DiscTotal   int
+}
+
+// ErrReadOnly is returned when a music file has to be
+// modified while the read only mode is enabled.
+var ErrReadOnly = errors.New("Tags are read only.")
+
+// readOnly disables all the changes in the music files.
+var readOnly bool
+
+// SetReadOnly enables or disables the read only mode.
+// While it is enabled the music files are never
+// modified: the default values for the missing tags
+// are not stored and every function that writes the
+// tags returns ErrReadOnly.
+func SetReadOnly(enabled bool) {
+	readOnly = enabled
+}
+
+// IsReadOnly returns true if the read only mode is
+// enabled.
+func IsReadOnly() bool {
+	return readOnly
+}
+
+// parseNumberPair parses track and disc numbers in the
+// "number/total" form, the total is optional.
+// Zero is returned for the values that are missing or
+// cannot be parsed.
+func parseNumberPair(value string) (int, int) {
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	number, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
+	total := 0
+	if len(parts) > 1 {
+		total, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	return number, total
+}
+
+// formatNumberPair returns the track or disc number in
+// the "number/total" form, the total is only added if
+// it is known.
+func formatNumberPair(number, total int) string {
+	if total > 0 {
+		return strconv.Itoa(number) + "/" + strconv.Itoa(total)
+	}
+	return strconv.Itoa(number)
+}
+
+// parseYear returns the year from a date tag, the date
+// can be just the year or a full timestamp like
+// "2016-05-21".
+func parseYear(value string) int {
+	value = strings.TrimSpace(value)
+	if len(value) > 4 {
+		value = value[:4]
+	}
+	year, err := strconv.Atoi(value)
+	if err != nil || year < 0 {
+		return 0
+	}
+	return year
+}
+
+// titleFromPath returns the song title that is used
+// when the file has no title tag, it is the file name
+// without the extension.
+func titleFromPath(path string) string {
+	_, file := filepath.Split(path)
+	extension := filepath.Ext(file)
+	return file[0 : len(file)-len(extension)]
+}
+
+// IsMusicFile returns true if the file in the
+// specified path has the extension of one of the
+// music formats registered in MuLi.
+func IsMusicFile(path string) bool {
+	return backendFor(path) != nil
+}
+
+// setDefaults completes the Title, Artist and Album
+// with the default values when they are missing and
+// returns the ones that were set.
+func (tags *FileTags) setDefaults(path string) FileTags {
+	var filled FileTags
+	if tags.Title == "" || tags.Title == "unknown" {
+		tags.Title = titleFromPath(path)
+		filled.Title = tags.Title
+	}
+
+	if tags.Artist == "" {
+		tags.Artist = "unknown"
+		filled.Artist = tags.Artist
+	}
+
+	if tags.Album == "" {
+		tags.Album = "unknown"
+		filled.Album = tags.Album
+	}
+	return filled
+}
+
+// defaultTags returns the tags used for the files that
+// cannot be read, the ones inferred from the path are
+// used when possible.
+func defaultTags(path string, inferred FileTags) FileTags {
+	tags := inferred
+	tags.setDefaults(path)
+	return tags
+}
+
+// GetTags returns a FileTags struct with all the
+// information obtained from the tags in the music file,
+// using the backend registered for its extension.
+// Includes the Artist, Album and Song, that get
+// default values if they are missing, and the rest of
+// the tags when they are present.
+// The missing tags are inferred from the file name
+// with the path patterns.
+// If the tags are missing, the default values will
+// be stored on the file, the tags in legacy charsets
+// are also rewritten using Unicode when it is enabled
+// with ConfigureCharset. Nothing is stored when the
+// read only mode is enabled.
+// If the tags are obtained correctly the first
+// return value will be nil.
+func GetTags(path string) (error, FileTags) {
+	return GetTagsFromPath(path, filepath.Base(path))
+}
+
+// GetTagsFromPath works as GetTags but the missing
+// tags are inferred from relPath, the path of the file
+// relative to the root of the Music Library, so the
+// path patterns can also match the directories.
+// The inferred tags are stored on the file as the
+// default values are.
+func GetTagsFromPath(path, relPath string) (error, FileTags) {
+	return readTags(path, relPath, !readOnly)
+}
+
+// ReadTags works as GetTags but the music file is
+// never modified, the default values and the inferred
+// tags are only returned.
+func ReadTags(path string) (error, FileTags) {
+	return readTags(path, filepath.Base(path), false)
+}
+
+// readTags reads the tags of the music file, the
+// default values and the inferred tags are stored on
+// the file only if write is true.
+func readTags(path, relPath string, write bool) (error, FileTags) {
+	inferred := inferTags(relPath)
+	backend := backendFor(path)
+	if backend == nil {
+		return errors.New("Wrong file format."), defaultTags(path, inferred)
+	}
+
+	if charsetConfig.rewrite && write {
+		RepairCharset(path)
+	}
+
+	tags, err := backend.ReadTags(path)
+	if err != nil {
+		return err, defaultTags(path, inferred)
+	}
+
+	filled := tags.fillMissing(inferred)
+	defaults := tags.setDefaults(path)
+	if defaults.Title != "" {
+		filled.Title = defaults.Title
+	}
+	if defaults.Artist != "" {
+		filled.Artist = defaults.Artist
+	}
+	if defaults.Album != "" {
+		filled.Album = defaults.Album
+	}
+
+	if filled != (FileTags{}) && write {
+		backupTags(path)
+		backend.WriteTags(path, filled)
+	}
+	return nil, tags
+}
+
+// SetTags updates the Artist, Album and Title
+// tags with new values in the music file, using
+// the backend registered for its extension.
+func SetTags(artist string, album string, title string, songPath string) error {
+	backend := backendFor(songPath)
+	if backend == nil {
+		return errors.New("Wrong file format.")
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+	backupTags(songPath)
+	return backend.WriteTags(songPath, FileTags{Title: title, Artist: artist, Album: album})
+}
+
+// SetAllTags updates all the non empty tags from the
+// FileTags struct in the music file, using the backend
+// registered for its extension.
+func SetAllTags(tags FileTags, songPath string) error {
+	backend := backendFor(songPath)
+	if backend == nil {
+		return errors.New("Wrong file format.")
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+	backupTags(songPath)
+	return backend.WriteTags(songPath, tags)
+}
+
+// replaceFile writes a new version of the file in the
+// specified path. The write function receives the
+// original file opened for reading and the writer for
+// the new contents.
+// The new file is written next to the original one and
+// renamed when it is complete, so the original file is
+// never left half written.
+func replaceFile(path string, write func(src *os.File, w io.Writer) error) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dir, file := filepath.Split(path)
+	tmp, err := ioutil.TempFile(dir, "."+file+".")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	err = write(src, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(info.Mode())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
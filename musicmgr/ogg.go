@@ -0,0 +1,455 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Ogg page header flags.
+const (
+	oggContinued = 0x01
+	oggFirstPage = 0x02
+)
+
+// oggNoGranule is the granule position used on pages
+// where no packet is finished.
+const oggNoGranule = ^uint64(0)
+
+// oggMaxSegments is the maximum amount of lacing values
+// a single page can hold.
+const oggMaxSegments = 255
+
+// oggCRCTable is the lookup table for the Ogg checksum,
+// it uses the 0x04c11db7 polynomial without reflection.
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggCRC returns the checksum of a whole page, the
+// checksum field inside the page must be zero.
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggPage is a single page from an Ogg stream.
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	sequence   uint32
+	segments   []byte
+	data       []byte
+}
+
+// readOggPage reads the next page from the stream.
+func readOggPage(r io.Reader) (*oggPage, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if string(header[:4]) != "OggS" || header[4] != 0 {
+		return nil, errors.New("Wrong Ogg page.")
+	}
+
+	p := &oggPage{
+		headerType: header[5],
+		granule:    binary.LittleEndian.Uint64(header[6:]),
+		serial:     binary.LittleEndian.Uint32(header[14:]),
+		sequence:   binary.LittleEndian.Uint32(header[18:]),
+		segments:   make([]byte, header[26]),
+	}
+
+	if _, err := io.ReadFull(r, p.segments); err != nil {
+		return nil, err
+	}
+
+	size := 0
+	for _, s := range p.segments {
+		size += int(s)
+	}
+
+	p.data = make([]byte, size)
+	if _, err := io.ReadFull(r, p.data); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(p.bytes()[22:26], header[22:26]) {
+		return nil, errors.New("Wrong Ogg page checksum.")
+	}
+	return p, nil
+}
+
+// size returns the amount of bytes used by the page.
+func (p *oggPage) size() int {
+	return 27 + len(p.segments) + len(p.data)
+}
+
+// bytes encodes the page with the correct checksum.
+func (p *oggPage) bytes() []byte {
+	out := make([]byte, 27, p.size())
+	copy(out, "OggS")
+	out[5] = p.headerType
+	binary.LittleEndian.PutUint64(out[6:], p.granule)
+	binary.LittleEndian.PutUint32(out[14:], p.serial)
+	binary.LittleEndian.PutUint32(out[18:], p.sequence)
+	out[26] = byte(len(p.segments))
+	out = append(out, p.segments...)
+	out = append(out, p.data...)
+	binary.LittleEndian.PutUint32(out[22:], oggCRC(out))
+	return out
+}
+
+// oggHeaders holds the header packets of the first
+// logical stream in an Ogg file, the ones that have to
+// be written again when the comments change.
+// The first packet, the identification header, is not
+// included since it always uses a page on its own that
+// is never modified.
+// pages is the amount of pages used by the packets
+// and start and end are the offsets where these pages
+// are located in the file.
+type oggHeaders struct {
+	serial  uint32
+	opus    bool
+	packets [][]byte
+	pages   int
+	start   int64
+	end     int64
+	comment *vorbisComment
+}
+
+// readOggHeaders reads the header packets of an Ogg
+// Vorbis or Ogg Opus file and parses the comments.
+func readOggHeaders(r io.Reader) (*oggHeaders, error) {
+	br := bufio.NewReader(r)
+	first, err := readOggPage(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if first.headerType&oggFirstPage == 0 || len(first.segments) != 1 || first.segments[0] == 255 {
+		return nil, errors.New("Wrong Ogg identification header.")
+	}
+
+	h := &oggHeaders{serial: first.serial, start: int64(first.size())}
+	total := 0
+	switch {
+	case bytes.HasPrefix(first.data, []byte("\x01vorbis")):
+		total = 2
+	case bytes.HasPrefix(first.data, []byte("OpusHead")):
+		total = 1
+		h.opus = true
+	default:
+		return nil, errors.New("Unknown Ogg codec.")
+	}
+
+	h.end = h.start
+	var packet []byte
+	for len(h.packets) < total {
+		p, err := readOggPage(br)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.serial != h.serial {
+			return nil, errors.New("Multiplexed Ogg streams are not supported.")
+		}
+		h.pages++
+		h.end += int64(p.size())
+
+		offset := 0
+		for i, s := range p.segments {
+			packet = append(packet, p.data[offset:offset+int(s)]...)
+			offset += int(s)
+			if s < 255 {
+				h.packets = append(h.packets, packet)
+				packet = nil
+				if len(h.packets) == total && i != len(p.segments)-1 {
+					return nil, errors.New("Ogg headers do not end on a page.")
+				}
+			}
+		}
+	}
+
+	var data []byte
+	if h.opus {
+		if !bytes.HasPrefix(h.packets[0], []byte("OpusTags")) {
+			return nil, errors.New("Wrong OpusTags header.")
+		}
+		data = h.packets[0][8:]
+	} else {
+		if !bytes.HasPrefix(h.packets[0], []byte("\x03vorbis")) {
+			return nil, errors.New("Wrong Vorbis comment header.")
+		}
+		data = h.packets[0][7:]
+	}
+
+	h.comment, err = parseVorbisComment(data)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// commentPacket encodes the comment header packet
+// with the current comments. Any data found after the
+// comments in the original packet, like the Vorbis
+// framing bit, is kept.
+func (h *oggHeaders) commentPacket(original []byte) []byte {
+	prefix := 7
+	if h.opus {
+		prefix = 8
+	}
+
+	old, err := parseVorbisComment(original[prefix:])
+	trailing := []byte{}
+	if err == nil {
+		trailing = original[prefix+len(old.bytes()):]
+	}
+
+	out := append([]byte{}, original[:prefix]...)
+	out = append(out, h.comment.bytes()...)
+	return append(out, trailing...)
+}
+
+// paginateOgg splits the packets into Ogg pages starting
+// on the specified sequence number. Every packet
+// starts on the first available segment, as the Ogg
+// specification requires, and the last page ends
+// with the last packet.
+func paginateOgg(packets [][]byte, serial, sequence uint32) []*oggPage {
+	var pages []*oggPage
+	page := &oggPage{serial: serial, sequence: sequence, granule: oggNoGranule}
+	for _, packet := range packets {
+		remaining := packet
+		for {
+			if len(page.segments) == oggMaxSegments {
+				pages = append(pages, page)
+				sequence++
+				page = &oggPage{serial: serial, sequence: sequence, granule: oggNoGranule, headerType: oggContinued}
+			}
+
+			length := len(remaining)
+			if length > 255 {
+				length = 255
+			}
+			page.segments = append(page.segments, byte(length))
+			page.data = append(page.data, remaining[:length]...)
+			remaining = remaining[length:]
+			if length < 255 {
+				page.granule = 0
+				break
+			}
+		}
+
+		if len(page.segments) == oggMaxSegments {
+			pages = append(pages, page)
+			sequence++
+			page = &oggPage{serial: serial, sequence: sequence, granule: oggNoGranule}
+		}
+	}
+
+	if len(page.segments) > 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// readOggComment reads the header packets and comments
+// from an Ogg file.
+func readOggComment(path string) (*oggHeaders, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readOggHeaders(f)
+}
+
+// writeOggComment stores the comments from the headers
+// in the Ogg file. The header pages are generated
+// again and the rest of the pages of the stream are
+// renumbered, with their checksums updated, when the
+// amount of header pages changes.
+// If the new header pages have the same size than the
+// old ones they are written in place.
+func writeOggComment(path string, h *oggHeaders) error {
+	packets := make([][]byte, len(h.packets))
+	copy(packets, h.packets)
+	packets[0] = h.commentPacket(h.packets[0])
+
+	pages := paginateOgg(packets, h.serial, 1)
+	var encoded []byte
+	for _, p := range pages {
+		encoded = append(encoded, p.bytes()...)
+	}
+
+	if int64(len(encoded)) == h.end-h.start && len(pages) == h.pages {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(encoded, h.start)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	delta := uint32(len(pages) - h.pages)
+	return replaceFile(path, func(src *os.File, w io.Writer) error {
+		if _, err := io.CopyN(w, src, h.start); err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		if _, err := src.Seek(h.end, 0); err != nil {
+			return err
+		}
+
+		r := bufio.NewReader(src)
+		for {
+			if _, err := r.Peek(1); err == io.EOF {
+				return nil
+			}
+
+			p, err := readOggPage(r)
+			if err != nil {
+				return err
+			}
+
+			if p.serial == h.serial {
+				p.sequence += delta
+			}
+			if _, err = w.Write(p.bytes()); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func init() {
+	RegisterFormat(oggBackend{}, ".ogg", ".oga", ".opus")
+}
+
+// oggBackend manages the comments in Ogg Vorbis and
+// Ogg Opus files.
+type oggBackend struct{}
+
+// ReadTags returns a FileTags struct with
+// all the information obtained from the comments
+// in the Ogg Vorbis or Ogg Opus file.
+func (oggBackend) ReadTags(path string) (FileTags, error) {
+	h, err := readOggComment(path)
+	if err != nil {
+		return FileTags{}, err
+	}
+
+	return h.comment.tags(), nil
+}
+
+// WriteTags updates the comments with the new
+// values in the song Ogg file.
+func (oggBackend) WriteTags(path string, tags FileTags) error {
+	h, err := readOggComment(path)
+	if err != nil {
+		return err
+	}
+
+	h.comment.setTags(tags)
+
+	return writeOggComment(path, h)
+}
+
+// ReadPictures returns the images stored in the
+// comments of the Ogg file.
+func (oggBackend) ReadPictures(path string) ([]Picture, error) {
+	h, err := readOggComment(path)
+	if err != nil {
+		return nil, err
+	}
+	return h.comment.pictures(), nil
+}
+
+// WritePicture stores the picture in the comments of
+// the Ogg file, replacing the pictures of the same
+// type.
+func (oggBackend) WritePicture(path string, picture Picture) error {
+	h, err := readOggComment(path)
+	if err != nil {
+		return err
+	}
+
+	h.comment.setPicture(picture)
+	return writeOggComment(path, h)
+}
+
+// SnapshotTags returns the encoded comments of the Ogg
+// file without the METADATA_BLOCK_PICTURE fields.
+func (oggBackend) SnapshotTags(path string) ([]byte, error) {
+	h, err := readOggComment(path)
+	if err != nil {
+		return nil, err
+	}
+	h.comment.comments = h.comment.pictureFields(false)
+	return h.comment.bytes(), nil
+}
+
+// RestoreTags replaces the comments of the Ogg file
+// with the ones from the snapshot, keeping the
+// METADATA_BLOCK_PICTURE fields the file has now.
+func (oggBackend) RestoreTags(path string, snapshot []byte) error {
+	vc, err := parseVorbisComment(snapshot)
+	if err != nil {
+		return err
+	}
+
+	h, err := readOggComment(path)
+	if err != nil {
+		return err
+	}
+
+	vc.comments = append(vc.pictureFields(false), h.comment.pictureFields(true)...)
+	h.comment = vc
+	return writeOggComment(path, h)
+}
@@ -0,0 +1,268 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testOggCRC computes the Ogg checksum bit by bit, so it
+// does not share the lookup table used by the writer.
+func testOggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// testOggPage is an Ogg page as written by the
+// fixtures and read by the checks.
+type testOggPage struct {
+	flags    byte
+	granule  uint64
+	serial   uint32
+	sequence uint32
+	segments []byte
+	data     []byte
+}
+
+// encode returns the page with its checksum.
+func (p *testOggPage) encode() []byte {
+	out := make([]byte, 27)
+	copy(out, "OggS")
+	out[5] = p.flags
+	binary.LittleEndian.PutUint64(out[6:], p.granule)
+	binary.LittleEndian.PutUint32(out[14:], p.serial)
+	binary.LittleEndian.PutUint32(out[18:], p.sequence)
+	out[26] = byte(len(p.segments))
+	out = append(out, p.segments...)
+	out = append(out, p.data...)
+	binary.LittleEndian.PutUint32(out[22:], testOggCRC(out))
+	return out
+}
+
+// testOggPacketPage returns a page holding the complete
+// packets, they must fit in a single page.
+func testOggPacketPage(flags byte, granule uint64, sequence uint32, packets ...[]byte) *testOggPage {
+	p := &testOggPage{flags: flags, granule: granule, serial: 0x1234, sequence: sequence}
+	for _, packet := range packets {
+		n := len(packet)
+		for ; n >= 255; n -= 255 {
+			p.segments = append(p.segments, 255)
+		}
+		p.segments = append(p.segments, byte(n))
+		p.data = append(p.data, packet...)
+	}
+	return p
+}
+
+// oggFixture returns an Ogg Vorbis, or Ogg Opus, file
+// with the identification and comment headers, the
+// setup header for Vorbis, and some audio pages.
+func oggFixture(opus bool) []byte {
+	comment := vorbisFixture("reference", "TITLE=Fixture", "ARTIST=Someone")
+	var id, headers [][]byte
+	if opus {
+		id = [][]byte{append([]byte("OpusHead"), testPayload(11, 10)...)}
+		headers = [][]byte{append([]byte("OpusTags"), comment...)}
+	} else {
+		id = [][]byte{append([]byte("\x01vorbis"), testPayload(23, 10)...)}
+		headers = [][]byte{
+			append(append([]byte("\x03vorbis"), comment...), 1),
+			append([]byte("\x05vorbis"), testPayload(3000, 11)...),
+		}
+	}
+
+	out := testOggPacketPage(0x02, 0, 0, id...).encode()
+	out = append(out, testOggPacketPage(0, 0, 1, headers...).encode()...)
+	for i := uint32(0); i < 4; i++ {
+		flags := byte(0)
+		if i == 3 {
+			flags = 0x04
+		}
+		packets := [][]byte{
+			testPayload(300+int(i)*100, int64(20+i)),
+			testPayload(700, int64(30+i)),
+			testPayload(90, int64(40+i)),
+		}
+		out = append(out, testOggPacketPage(flags, uint64(i+1)*4096, 2+i, packets...).encode()...)
+	}
+	return out
+}
+
+// readTestOggPages splits the file in pages checking
+// their checksums and sequence numbers.
+func readTestOggPages(t *testing.T, data []byte) []*testOggPage {
+	var pages []*testOggPage
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			t.Fatal("Wrong Ogg page.")
+		}
+		p := &testOggPage{
+			flags:    data[5],
+			granule:  binary.LittleEndian.Uint64(data[6:]),
+			serial:   binary.LittleEndian.Uint32(data[14:]),
+			sequence: binary.LittleEndian.Uint32(data[18:]),
+		}
+		count := int(data[26])
+		if len(data) < 27+count {
+			t.Fatal("Ogg page truncated.")
+		}
+		p.segments = data[27 : 27+count]
+		size := 0
+		for _, s := range p.segments {
+			size += int(s)
+		}
+		if len(data) < 27+count+size {
+			t.Fatal("Ogg page truncated.")
+		}
+		p.data = data[27+count : 27+count+size]
+
+		if !bytes.Equal(p.encode(), data[:27+count+size]) {
+			t.Fatalf("Wrong checksum on the Ogg page %d.", len(pages))
+		}
+		if p.sequence != uint32(len(pages)) {
+			t.Fatalf("Wrong sequence number %d on the Ogg page %d.", p.sequence, len(pages))
+		}
+		pages = append(pages, p)
+		data = data[27+count+size:]
+	}
+	return pages
+}
+
+// checkOgg checks that the file keeps the identification
+// header and the audio pages, only the sequence numbers
+// and checksums of the audio pages can change.
+func checkOgg(t *testing.T, original, data []byte) {
+	oldPages := readTestOggPages(t, original)
+	newPages := readTestOggPages(t, data)
+	if !bytes.Equal(newPages[0].encode(), oldPages[0].encode()) {
+		t.Fatal("The identification header changed.")
+	}
+
+	audio := 4
+	if len(newPages) < audio+2 {
+		t.Fatal("Ogg pages missing.")
+	}
+	for i := 1; i <= audio; i++ {
+		oldPage := oldPages[len(oldPages)-i]
+		newPage := newPages[len(newPages)-i]
+		if newPage.flags != oldPage.flags || newPage.granule != oldPage.granule ||
+			newPage.serial != oldPage.serial || !bytes.Equal(newPage.segments, oldPage.segments) ||
+			!bytes.Equal(newPage.data, oldPage.data) {
+			t.Fatalf("The audio page %d changed.", len(oldPages)-i)
+		}
+	}
+}
+
+func TestOggWriteTagsInPlace(t *testing.T) {
+	for _, opus := range []bool{false, true} {
+		original := oggFixture(opus)
+		path, clean := writeFixture(t, "song.ogg", original)
+		defer clean()
+
+		// A comment of the same size fits in the old pages.
+		err := oggBackend{}.WriteTags(path, FileTags{Title: "Fixturf"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := readFixture(t, path)
+		if len(data) != len(original) {
+			t.Fatal("The file size changed.")
+		}
+		checkOgg(t, original, data)
+
+		tags, err := oggBackend{}.ReadTags(path)
+		if err != nil || tags.Title != "Fixturf" || tags.Artist != "Someone" {
+			t.Fatal(tags, err)
+		}
+	}
+}
+
+func TestOggWriteTagsNewPages(t *testing.T) {
+	for _, opus := range []bool{false, true} {
+		original := oggFixture(opus)
+		path, clean := writeFixture(t, "song.opus", original)
+		defer clean()
+
+		// The comment needs many pages, so the audio
+		// pages are numbered again.
+		artist := strings.Repeat("Long Artist ", 10000)
+		err := oggBackend{}.WriteTags(path, FileTags{Artist: artist, Album: "Álbum"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := readFixture(t, path)
+		if len(readTestOggPages(t, data)) <= len(readTestOggPages(t, original)) {
+			t.Fatal("The comment did not take more pages.")
+		}
+		checkOgg(t, original, data)
+
+		tags, err := oggBackend{}.ReadTags(path)
+		if err != nil || tags.Artist != artist || tags.Album != "Álbum" || tags.Title != "Fixture" {
+			t.Fatal(err)
+		}
+
+		// Going back to a short comment removes pages.
+		err = oggBackend{}.WriteTags(path, FileTags{Artist: "Someone"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data = readFixture(t, path)
+		if len(readTestOggPages(t, data)) != len(readTestOggPages(t, original)) {
+			t.Fatal("The pages of the long comment were not removed.")
+		}
+		checkOgg(t, original, data)
+
+		tags, err = oggBackend{}.ReadTags(path)
+		if err != nil || tags.Artist != "Someone" {
+			t.Fatal(tags, err)
+		}
+	}
+}
+
+func TestOggWritePicture(t *testing.T) {
+	original := oggFixture(false)
+	path, clean := writeFixture(t, "song.ogg", original)
+	defer clean()
+
+	picture := Picture{Type: FrontCover, MimeType: "image/png", Data: testPayload(80000, 12)}
+	err := oggBackend{}.WritePicture(path, picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOgg(t, original, readFixture(t, path))
+	pictures, err := oggBackend{}.ReadPictures(path)
+	if err != nil || len(pictures) != 1 || !bytes.Equal(pictures[0].Data, picture.Data) {
+		t.Fatal("The picture was not stored.", err)
+	}
+}
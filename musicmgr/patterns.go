@@ -0,0 +1,302 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// patternFields are the fields that can be used in the
+// path patterns and the expression that matches them.
+var patternFields = map[string]string{
+	"title":       `([^/]+?)`,
+	"artist":      `([^/]+?)`,
+	"album":       `([^/]+?)`,
+	"albumartist": `([^/]+?)`,
+	"composer":    `([^/]+?)`,
+	"genre":       `([^/]+?)`,
+	"track":       `(\d+)`,
+	"disc":        `(\d+)`,
+	"year":        `(\d{4})`,
+}
+
+// pathPattern is a compiled path pattern, fields has
+// the name of the field captured by every group of the
+// expression.
+type pathPattern struct {
+	expr   *regexp.Regexp
+	fields []string
+}
+
+// pathPatterns are the patterns used to infer the
+// missing tags from the path of the files, in the
+// order they are tried.
+var pathPatterns []pathPattern
+
+// fieldExpr matches the fields in the path patterns.
+var fieldExpr = regexp.MustCompile(`%([a-z]+)%`)
+
+// compilePathPattern converts a path pattern like
+// "%artist%/%album%/%track% - %title%" into a regular
+// expression that matches the end of a path, without
+// the file extension.
+func compilePathPattern(pattern string) (pathPattern, error) {
+	var p pathPattern
+	expr := `(?:^|/)`
+	last := 0
+	for _, m := range fieldExpr.FindAllStringSubmatchIndex(pattern, -1) {
+		name := pattern[m[2]:m[3]]
+		field, ok := patternFields[name]
+		if !ok {
+			return p, errors.New("Unknown field in path pattern: " + name)
+		}
+
+		expr += regexp.QuoteMeta(pattern[last:m[0]]) + field
+		p.fields = append(p.fields, name)
+		last = m[1]
+	}
+	expr += regexp.QuoteMeta(pattern[last:]) + `$`
+
+	if len(p.fields) == 0 {
+		return p, errors.New("Path pattern without fields: " + pattern)
+	}
+
+	var err error
+	p.expr, err = regexp.Compile(expr)
+	return p, err
+}
+
+// SetPathPatterns sets the patterns used to infer the
+// tags that are missing in the music files from their
+// path, like "%artist%/%album%/%track% - %title%".
+// The patterns are matched against the end of the path,
+// every slash separates a directory, and the first one
+// that matches is used.
+// The fields that can be used are %title%, %artist%,
+// %album%, %albumartist%, %composer%, %genre%,
+// %track%, %disc% and %year%.
+func SetPathPatterns(patterns []string) error {
+	var compiled []pathPattern
+	for _, pattern := range patterns {
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+
+		p, err := compilePathPattern(pattern)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, p)
+	}
+
+	pathPatterns = compiled
+	return nil
+}
+
+// inferTags returns the tags obtained from the path of
+// the file with the first path pattern that matches.
+// The path has to be relative to the Music Library so
+// the directories outside it are not taken as tags.
+func inferTags(relPath string) FileTags {
+	var tags FileTags
+	relPath = filepath.ToSlash(relPath)
+	relPath = relPath[:len(relPath)-len(filepath.Ext(relPath))]
+	for _, p := range pathPatterns {
+		m := p.expr.FindStringSubmatch(relPath)
+		if m == nil {
+			continue
+		}
+
+		for i, name := range p.fields {
+			tags.setField(name, m[i+1])
+		}
+		return tags
+	}
+	return tags
+}
+
+// setField stores the value found for one of the
+// pattern fields in the tags.
+func (tags *FileTags) setField(name, value string) {
+	value = strings.TrimSpace(value)
+	number, _ := strconv.Atoi(value)
+	switch name {
+	case "title":
+		tags.Title = value
+	case "artist":
+		tags.Artist = value
+	case "album":
+		tags.Album = value
+	case "albumartist":
+		tags.AlbumArtist = value
+	case "composer":
+		tags.Composer = value
+	case "genre":
+		tags.Genre = value
+	case "track":
+		tags.Track = number
+	case "disc":
+		tags.Disc = number
+	case "year":
+		tags.Year = number
+	}
+}
+
+// field returns the value of one of the pattern fields,
+// the numbers are padded with zeros and the missing
+// text values are "unknown".
+func (tags *FileTags) field(name string) string {
+	var value string
+	switch name {
+	case "title":
+		value = tags.Title
+	case "artist":
+		value = tags.Artist
+	case "album":
+		value = tags.Album
+	case "albumartist":
+		value = tags.AlbumArtist
+	case "composer":
+		value = tags.Composer
+	case "genre":
+		value = tags.Genre
+	case "track":
+		return fmt.Sprintf("%02d", tags.Track)
+	case "disc":
+		return fmt.Sprintf("%02d", tags.Disc)
+	case "year":
+		return fmt.Sprintf("%04d", tags.Year)
+	}
+
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// NamePattern is a pattern with fields that describes
+// a single file or directory name, like
+// "%track% - %title%". It uses the same fields than
+// the path patterns.
+type NamePattern struct {
+	pattern  string
+	compiled pathPattern
+}
+
+// CompileNamePattern checks the pattern and prepares
+// it to parse and generate names.
+func CompileNamePattern(pattern string) (*NamePattern, error) {
+	if strings.Contains(pattern, "/") {
+		return nil, errors.New("Name patterns cannot contain slashes: " + pattern)
+	}
+
+	compiled, err := compilePathPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &NamePattern{pattern: pattern, compiled: compiled}, nil
+}
+
+// Fields returns the names of the fields used in the
+// pattern.
+func (p *NamePattern) Fields() []string {
+	return p.compiled.fields
+}
+
+// Format generates the name for the tags, every value
+// is converted with the escape function before it is
+// added to the name.
+func (p *NamePattern) Format(tags FileTags, escape func(string) string) string {
+	return fieldExpr.ReplaceAllStringFunc(p.pattern, func(m string) string {
+		return escape(tags.field(m[1 : len(m)-1]))
+	})
+}
+
+// Parse returns the tags found in the name, only the
+// fields used in the pattern are set.
+// The second value is false if the name does not match
+// the pattern.
+func (p *NamePattern) Parse(name string) (FileTags, bool) {
+	var tags FileTags
+	m := p.compiled.expr.FindStringSubmatch(name)
+	if m == nil {
+		return tags, false
+	}
+
+	for i, field := range p.compiled.fields {
+		tags.setField(field, m[i+1])
+	}
+	return tags, true
+}
+
+// Apply updates the tags with the values found in the
+// name. The values that are equal to the current ones
+// once they are converted with the escape function are
+// not changed, so the names generated with Format can
+// be parsed again without losing the original values.
+// It returns false if the name does not match the
+// pattern.
+func (p *NamePattern) Apply(tags *FileTags, name string, escape func(string) string) bool {
+	parsed, ok := p.Parse(name)
+	if !ok {
+		return false
+	}
+
+	for _, field := range p.compiled.fields {
+		value := parsed.field(field)
+		if escape(value) != escape(tags.field(field)) {
+			tags.setField(field, value)
+		}
+	}
+	return true
+}
+
+// fillMissing copies the values from inferred to the
+// tags that are empty and returns the ones that were
+// copied.
+func (tags *FileTags) fillMissing(inferred FileTags) FileTags {
+	var filled FileTags
+	fill := func(value *string, inferred string, filledValue *string) {
+		if (*value == "" || *value == "unknown") && inferred != "" {
+			*value = inferred
+			*filledValue = inferred
+		}
+	}
+	fillNumber := func(value *int, inferred int, filledValue *int) {
+		if *value == 0 && inferred != 0 {
+			*value = inferred
+			*filledValue = inferred
+		}
+	}
+
+	fill(&tags.Title, inferred.Title, &filled.Title)
+	fill(&tags.Artist, inferred.Artist, &filled.Artist)
+	fill(&tags.Album, inferred.Album, &filled.Album)
+	fill(&tags.AlbumArtist, inferred.AlbumArtist, &filled.AlbumArtist)
+	fill(&tags.Composer, inferred.Composer, &filled.Composer)
+	fill(&tags.Genre, inferred.Genre, &filled.Genre)
+	fillNumber(&tags.Track, inferred.Track, &filled.Track)
+	fillNumber(&tags.Disc, inferred.Disc, &filled.Disc)
+	fillNumber(&tags.Year, inferred.Year, &filled.Year)
+	return filled
+}
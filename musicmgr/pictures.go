@@ -0,0 +1,129 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	// Image formats used to fill the picture sizes.
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// FrontCover is the picture type used for the front
+// cover of the album, as defined by the ID3v2 APIC
+// frame and also used by FLAC and Vorbis comments.
+const FrontCover = 3
+
+// Picture is an image embedded in a music file.
+type Picture struct {
+	MimeType    string
+	Type        byte
+	Description string
+	Data        []byte
+}
+
+// PictureReader is implemented by the backends that
+// can read the pictures embedded in the music files.
+type PictureReader interface {
+	ReadPictures(path string) ([]Picture, error)
+}
+
+// PictureWriter is implemented by the backends that
+// can embed pictures in the music files.
+// The new picture replaces the ones of the same type.
+type PictureWriter interface {
+	WritePicture(path string, picture Picture) error
+}
+
+// IsImageFile returns true if the file in the
+// specified path has the extension of one of the
+// image formats that can be embedded as album cover.
+func IsImageFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// imageType returns the MIME type of the image, it
+// is detected from the contents and not from the file
+// name.
+func imageType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg", nil
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png", nil
+	}
+	return "", errors.New("Unsupported image format.")
+}
+
+// SetCover embeds the image as the front cover of the
+// music file, replacing the one it already has.
+// Only JPEG and PNG images are supported.
+func SetCover(path string, data []byte) error {
+	writer, ok := backendFor(path).(PictureWriter)
+	if !ok {
+		return errors.New("Pictures not supported.")
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+
+	mime, err := imageType(data)
+	if err != nil {
+		return err
+	}
+	backupTags(path)
+	return writer.WritePicture(path, Picture{MimeType: mime, Type: FrontCover, Data: data})
+}
+
+// GetCover returns the picture to use as the album
+// cover from the ones embedded in the music file.
+// The front cover is preferred, if the file does
+// not have one the first picture is returned.
+// It returns nil if the file has no pictures.
+func GetCover(path string) (*Picture, error) {
+	reader, ok := backendFor(path).(PictureReader)
+	if !ok {
+		return nil, errors.New("Pictures not supported.")
+	}
+
+	pictures, err := reader.ReadPictures(path)
+	if err != nil || len(pictures) == 0 {
+		return nil, err
+	}
+
+	for i := range pictures {
+		if pictures[i].Type == FrontCover {
+			return &pictures[i], nil
+		}
+	}
+	return &pictures[0], nil
+}
+
+// HasCover returns true if the music file has an
+// embedded picture that can be used as album cover.
+func HasCover(path string) bool {
+	cover, err := GetCover(path)
+	return err == nil && cover != nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TagReader reads the tags stored in a music file.
+// The values that are not found in the file are
+// returned empty, the default values are defined
+// by GetTags.
+type TagReader interface {
+	ReadTags(path string) (FileTags, error)
+}
+
+// TagWriter stores the tags in a music file.
+type TagWriter interface {
+	WriteTags(path string, tags FileTags) error
+}
+
+// TagBackend is the implementation of a music
+// format, it reads and writes the tags for all
+// the files with the extensions it is registered with.
+type TagBackend interface {
+	TagReader
+	TagWriter
+}
+
+// registry holds the backends for every registered
+// extension.
+var registry struct {
+	sync.RWMutex
+	backends map[string]TagBackend
+}
+
+// RegisterFormat adds a music format to MuLi.
+// Every file with one of the specified extensions
+// will be scanned and its tags will be managed by
+// the backend. The extensions include the dot and
+// are not case sensitive.
+// If an extension was already registered the new
+// backend replaces the old one.
+func RegisterFormat(backend TagBackend, extensions ...string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.backends == nil {
+		registry.backends = make(map[string]TagBackend)
+	}
+
+	for _, ext := range extensions {
+		registry.backends[strings.ToLower(ext)] = backend
+	}
+}
+
+// Extensions returns all the registered extensions
+// sorted alphabetically.
+func Extensions() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	var extensions []string
+	for ext := range registry.backends {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// backendFor returns the backend registered for the
+// extension of the specified file or nil if the format
+// is not supported.
+func backendFor(path string) TagBackend {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	return registry.backends[strings.ToLower(filepath.Ext(path))]
+}
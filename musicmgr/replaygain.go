@@ -0,0 +1,99 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// replayGainReference is the loudness, in LUFS, that
+// the ReplayGain 2.0 values bring the songs to.
+const replayGainReference = -18.0
+
+// ReplayGain holds the values stored in the
+// REPLAYGAIN_* tags. The gains are in dB and the peaks
+// are relative to full scale.
+type ReplayGain struct {
+	TrackGain float64
+	TrackPeak float64
+	AlbumGain float64
+	AlbumPeak float64
+}
+
+// Gain returns the ReplayGain adjustment, in dB, that
+// has to be applied to reach the reference loudness.
+func (l *Loudness) Gain() float64 {
+	return replayGainReference - l.Integrated
+}
+
+// Silent returns true when none of the blocks in the
+// song was loud enough to be measured.
+func (l *Loudness) Silent() bool {
+	return math.IsInf(l.Integrated, -1)
+}
+
+// values returns the ReplayGain tags with the text
+// format used by most of the players.
+func (rg ReplayGain) values() [][2]string {
+	return [][2]string{
+		{"REPLAYGAIN_TRACK_GAIN", fmt.Sprintf("%.2f dB", rg.TrackGain)},
+		{"REPLAYGAIN_TRACK_PEAK", fmt.Sprintf("%.6f", rg.TrackPeak)},
+		{"REPLAYGAIN_ALBUM_GAIN", fmt.Sprintf("%.2f dB", rg.AlbumGain)},
+		{"REPLAYGAIN_ALBUM_PEAK", fmt.Sprintf("%.6f", rg.AlbumPeak)},
+	}
+}
+
+// LoudnessAnalyzer is implemented by the backends that
+// can decode the audio in the music files to measure
+// its loudness.
+type LoudnessAnalyzer interface {
+	AnalyzeLoudness(path string) (*Loudness, error)
+}
+
+// ReplayGainWriter is implemented by the backends that
+// can store the ReplayGain values in the music files.
+type ReplayGainWriter interface {
+	WriteReplayGain(path string, rg ReplayGain) error
+}
+
+// AnalyzeLoudness decodes the music file and measures
+// its loudness, using the backend registered for its
+// extension.
+func AnalyzeLoudness(path string) (*Loudness, error) {
+	analyzer, ok := backendFor(path).(LoudnessAnalyzer)
+	if !ok {
+		return nil, errors.New("Loudness analysis not supported.")
+	}
+	return analyzer.AnalyzeLoudness(path)
+}
+
+// SetReplayGain stores the ReplayGain values in the
+// music file, using the backend registered for its
+// extension.
+func SetReplayGain(path string, rg ReplayGain) error {
+	writer, ok := backendFor(path).(ReplayGainWriter)
+	if !ok {
+		return errors.New("ReplayGain tags not supported.")
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+	backupTags(path)
+	return writer.WriteReplayGain(path, rg)
+}
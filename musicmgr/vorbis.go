@@ -0,0 +1,272 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package musicmgr
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// vorbisComment holds the contents of a Vorbis comment
+// header, as used by FLAC and Ogg files.
+// The comments are kept in the "FIELD=value" form and
+// in the original order so the ones that are not
+// modified by MuLi are written back untouched.
+type vorbisComment struct {
+	vendor   string
+	comments []string
+}
+
+// parseVorbisComment decodes a Vorbis comment header.
+// The data must start on the vendor length, without
+// any packet type or framing bytes.
+func parseVorbisComment(data []byte) (*vorbisComment, error) {
+	if len(data) < 8 {
+		return nil, errors.New("Vorbis comment too short.")
+	}
+
+	vendorLen := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if vendorLen < 0 || vendorLen > len(data)-4 {
+		return nil, errors.New("Wrong Vorbis vendor length.")
+	}
+
+	vc := &vorbisComment{vendor: string(data[:vendorLen])}
+	data = data[vendorLen:]
+
+	count := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("Vorbis comment truncated.")
+		}
+		length := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if length < 0 || length > len(data) {
+			return nil, errors.New("Wrong Vorbis comment length.")
+		}
+		vc.comments = append(vc.comments, string(data[:length]))
+		data = data[length:]
+	}
+	return vc, nil
+}
+
+// get returns the first value stored for the field,
+// the field names are case insensitive.
+func (vc *vorbisComment) get(field string) string {
+	values := vc.values(field)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// values returns all the values stored for the field,
+// the field names are case insensitive.
+func (vc *vorbisComment) values(field string) []string {
+	var values []string
+	for _, c := range vc.comments {
+		eq := strings.IndexByte(c, '=')
+		if eq < 0 {
+			continue
+		}
+		if strings.EqualFold(c[:eq], field) {
+			values = append(values, c[eq+1:])
+		}
+	}
+	return values
+}
+
+// set replaces all the values stored for the field
+// with the new value. The first occurrence keeps its
+// position in the list.
+func (vc *vorbisComment) set(field, value string) {
+	field = strings.ToUpper(field)
+	newComment := field + "=" + value
+	replaced := false
+	comments := vc.comments[:0]
+	for _, c := range vc.comments {
+		eq := strings.IndexByte(c, '=')
+		if eq >= 0 && strings.EqualFold(c[:eq], field) {
+			if replaced {
+				continue
+			}
+			c = newComment
+			replaced = true
+		}
+		comments = append(comments, c)
+	}
+
+	if !replaced {
+		comments = append(comments, newComment)
+	}
+	vc.comments = comments
+}
+
+// bytes encodes the Vorbis comment header, it does not
+// include any packet type or framing bytes.
+func (vc *vorbisComment) bytes() []byte {
+	size := 8 + len(vc.vendor)
+	for _, c := range vc.comments {
+		size += 4 + len(c)
+	}
+
+	out := make([]byte, 0, size)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(vc.vendor)))
+	out = append(out, length[:]...)
+	out = append(out, vc.vendor...)
+	binary.LittleEndian.PutUint32(length[:], uint32(len(vc.comments)))
+	out = append(out, length[:]...)
+	for _, c := range vc.comments {
+		binary.LittleEndian.PutUint32(length[:], uint32(len(c)))
+		out = append(out, length[:]...)
+		out = append(out, c...)
+	}
+	return out
+}
+
+// first returns the value of the first field from the
+// list that is present in the comments.
+func (vc *vorbisComment) first(fields ...string) string {
+	for _, field := range fields {
+		if value := vc.get(field); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// tags returns the FileTags stored in the comments.
+// The totals can be found in their own fields or
+// together with the numbers, like "3/12".
+func (vc *vorbisComment) tags() FileTags {
+	tags := FileTags{
+		Title:       vc.get("TITLE"),
+		Artist:      vc.get("ARTIST"),
+		Album:       vc.get("ALBUM"),
+		AlbumArtist: vc.first("ALBUMARTIST", "ALBUM ARTIST"),
+		Composer:    vc.get("COMPOSER"),
+		Genre:       parseGenre(vc.get("GENRE")),
+		Year:        parseYear(vc.first("DATE", "YEAR")),
+	}
+
+	tags.Track, tags.TrackTotal = parseNumberPair(vc.get("TRACKNUMBER"))
+	if total, _ := strconv.Atoi(vc.first("TRACKTOTAL", "TOTALTRACKS")); total > 0 {
+		tags.TrackTotal = total
+	}
+	tags.Disc, tags.DiscTotal = parseNumberPair(vc.get("DISCNUMBER"))
+	if total, _ := strconv.Atoi(vc.first("DISCTOTAL", "TOTALDISCS")); total > 0 {
+		tags.DiscTotal = total
+	}
+	return tags
+}
+
+// setTags stores the non empty values from the FileTags
+// in the comments.
+func (vc *vorbisComment) setTags(tags FileTags) {
+	texts := []struct {
+		field string
+		value string
+	}{
+		{"TITLE", tags.Title},
+		{"ARTIST", tags.Artist},
+		{"ALBUM", tags.Album},
+		{"ALBUMARTIST", tags.AlbumArtist},
+		{"COMPOSER", tags.Composer},
+		{"GENRE", tags.Genre},
+	}
+	for _, t := range texts {
+		if t.value != "" {
+			vc.set(t.field, t.value)
+		}
+	}
+
+	if tags.Year > 0 {
+		vc.set("DATE", strconv.Itoa(tags.Year))
+	}
+	if tags.Track > 0 {
+		vc.set("TRACKNUMBER", strconv.Itoa(tags.Track))
+	}
+	if tags.TrackTotal > 0 {
+		vc.set("TRACKTOTAL", strconv.Itoa(tags.TrackTotal))
+	}
+	if tags.Disc > 0 {
+		vc.set("DISCNUMBER", strconv.Itoa(tags.Disc))
+	}
+	if tags.DiscTotal > 0 {
+		vc.set("DISCTOTAL", strconv.Itoa(tags.DiscTotal))
+	}
+}
+
+// pictures returns the images stored in the
+// METADATA_BLOCK_PICTURE fields, they hold FLAC
+// picture blocks encoded in base64.
+func (vc *vorbisComment) pictures() []Picture {
+	var pictures []Picture
+	for _, value := range vc.values("METADATA_BLOCK_PICTURE") {
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		p, err := parseFlacPicture(data)
+		if err == nil && len(p.Data) > 0 {
+			pictures = append(pictures, p)
+		}
+	}
+	return pictures
+}
+
+// pictureFields returns the METADATA_BLOCK_PICTURE
+// fields when pictures is true, or all the other
+// fields when it is false.
+func (vc *vorbisComment) pictureFields(pictures bool) []string {
+	var fields []string
+	for _, c := range vc.comments {
+		eq := strings.IndexByte(c, '=')
+		picture := eq >= 0 && strings.EqualFold(c[:eq], "METADATA_BLOCK_PICTURE")
+		if picture == pictures {
+			fields = append(fields, c)
+		}
+	}
+	return fields
+}
+
+// setPicture stores the picture in a new
+// METADATA_BLOCK_PICTURE field, replacing the pictures
+// of the same type.
+func (vc *vorbisComment) setPicture(p Picture) {
+	comments := vc.comments[:0]
+	for _, c := range vc.comments {
+		eq := strings.IndexByte(c, '=')
+		if eq >= 0 && strings.EqualFold(c[:eq], "METADATA_BLOCK_PICTURE") {
+			data, err := base64.StdEncoding.DecodeString(c[eq+1:])
+			if err == nil {
+				if old, err := parseFlacPicture(data); err == nil && old.Type == p.Type {
+					continue
+				}
+			}
+		}
+		comments = append(comments, c)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(encodeFlacPicture(p))
+	vc.comments = append(comments, "METADATA_BLOCK_PICTURE="+encoded)
+}
@@ -28,11 +28,21 @@ import (
 )
 
 // FileTags defines the tags found in a specific music file.
+// Name and Duration (in seconds) are used for the
+// #EXTINF lines and are filled when the playlist file
+// is generated.
+// Rule is true for the songs added by the rules of a
+// smart playlist, they are written without the #MULI
+// line so they are not stored in the playlist when it
+// is read again.
 type PlaylistFile struct {
-	Title  string
-	Artist string
-	Album  string
-	Path   string
+	Title    string
+	Artist   string
+	Album    string
+	Path     string
+	Name     string
+	Duration int
+	Rule     bool `json:"-"`
 }
 
 // CheckPlaylistFile opens a Playlist file and checks that
@@ -105,6 +115,7 @@ func DeletePlaylist(playlist, mPoint string) error {
 	path := mPoint + "playlists/" + playlist
 	src, err := os.Stat(path)
 	if err == nil && src.IsDir() {
+		DeleteRules(playlist, mPoint)
 		os.Remove(path)
 	}
 
@@ -117,6 +128,21 @@ func DeletePlaylist(playlist, mPoint string) error {
 	return nil
 }
 
+// extinf returns the #EXTINF line for the song, the
+// duration is -1 when it is not known.
+func extinf(s PlaylistFile) string {
+	duration := s.Duration
+	if duration <= 0 {
+		duration = -1
+	}
+
+	name := s.Name
+	if name == "" {
+		name = s.Artist + " - " + s.Title
+	}
+	return fmt.Sprintf("#EXTINF:%d,%s\n", duration, name)
+}
+
 // RegeneratePlaylistFile creates the playlist file from the
 // information in the database.
 func RegeneratePlaylistFile(songs []PlaylistFile, playlist, mPoint string) error {
@@ -151,31 +177,37 @@ func RegeneratePlaylistFile(songs []PlaylistFile, playlist, mPoint string) error
 	glog.Infof("Total songs: %d\n", len(songs))
 	for _, s := range songs {
 		fmt.Printf("Adding song: %s\n", s.Title)
-		_, err = f.WriteString("#MULI ")
-		if err != nil {
-			glog.Infof("Cannot write on file.")
-		}
-		_, err = f.WriteString(s.Artist)
-		if err != nil {
-			glog.Infof("Cannot write on file.")
-		}
-		_, err = f.WriteString(" - ")
-		if err != nil {
-			glog.Infof("Cannot write on file.")
-		}
-		_, err = f.WriteString(s.Album)
-		if err != nil {
-			glog.Infof("Cannot write on file.")
-		}
-		_, err = f.WriteString(" - ")
-		if err != nil {
-			glog.Infof("Cannot write on file.")
-		}
-		_, err = f.WriteString(s.Title)
-		if err != nil {
-			glog.Infof("Cannot write on file.")
+		if !s.Rule {
+			_, err = f.WriteString("#MULI ")
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
+			_, err = f.WriteString(s.Artist)
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
+			_, err = f.WriteString(" - ")
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
+			_, err = f.WriteString(s.Album)
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
+			_, err = f.WriteString(" - ")
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
+			_, err = f.WriteString(s.Title)
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
+			_, err = f.WriteString("\n")
+			if err != nil {
+				glog.Infof("Cannot write on file.")
+			}
 		}
-		_, err = f.WriteString("\n")
+		_, err = f.WriteString(extinf(s))
 		if err != nil {
 			glog.Infof("Cannot write on file.")
 		}
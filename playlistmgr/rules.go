@@ -0,0 +1,79 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package playlistmgr
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// RulesName is the name of the file inside a playlist
+// Directory that holds the rules of a smart playlist.
+const RulesName = ".rules"
+
+// RulesPath returns the path of the rules file of the
+// playlist.
+func RulesPath(playlist, mPoint string) string {
+	if mPoint[len(mPoint)-1] != '/' {
+		mPoint = mPoint + "/"
+	}
+	return mPoint + "playlists/" + playlist + "/" + RulesName
+}
+
+// ReadRules returns the rules of the playlist and the
+// time they were modified, the text is empty if the
+// playlist has no rules.
+func ReadRules(playlist, mPoint string) (string, time.Time, error) {
+	path := RulesPath(playlist, mPoint)
+	src, err := os.Stat(path)
+	if err != nil || src.IsDir() {
+		return "", time.Time{}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return string(data), src.ModTime(), nil
+}
+
+// DeleteRules removes the rules of the playlist, it
+// becomes a regular playlist again.
+func DeleteRules(playlist, mPoint string) error {
+	err := os.Remove(RulesPath(playlist, mPoint))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MoveRules moves the rules of a playlist when it is
+// renamed.
+func MoveRules(oldName, newName, mPoint string) error {
+	oldPath := RulesPath(oldName, mPoint)
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil
+	}
+
+	newPath := RulesPath(newName, mPoint)
+	err := os.MkdirAll(newPath[:len(newPath)-len(RulesName)], 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package main
+
+import (
+	"github.com/dankomiocevic/mulifs/store"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/golang/glog"
+)
+
+// The search directory holds a Directory for every
+// query, like "artist:radiohead year:<2000", with all
+// the Songs that match it. The queries created with
+// mkdir are saved and listed, any other valid query
+// can still be looked up directly.
+// Inside the search Directory the album field of the
+// Dir holds the query.
+
+// searchLookup finds a query Directory or a Song
+// inside one of them.
+func (d *Dir) searchLookup(name string) (fs.Node, error) {
+	if len(d.album) < 1 {
+		err := store.CheckSearch(name)
+		if err != nil {
+			glog.Info(err)
+			return nil, fuse.ENOENT
+		}
+		return &Dir{fs: d.fs, artist: d.artist, album: name, mPoint: d.mPoint}, nil
+	}
+
+	artist, album, song, err := store.GetSearchSong(d.album, name)
+	if err != nil {
+		glog.Info(err)
+		return nil, fuse.ENOENT
+	}
+
+	extension := filepath.Ext(song)
+	songName := song[:len(song)-len(extension)]
+	return &File{artist: artist, album: album, song: songName, name: song, mPoint: d.mPoint}, nil
+}
+
+// searchReadDirAll lists the saved queries or the
+// Songs that match a query.
+func (d *Dir) searchReadDirAll() ([]fuse.Dirent, error) {
+	var a []fuse.Dirent
+	var err error
+	if len(d.album) < 1 {
+		a, err = store.ListSearches()
+	} else {
+		a, err = store.ListSearchSongs(d.album)
+	}
+
+	if err != nil {
+		glog.Info(err)
+		return nil, fuse.ENOENT
+	}
+	return a, nil
+}
+
+// searchMkdir saves a new query.
+func (d *Dir) searchMkdir(name string) (fs.Node, error) {
+	if len(d.album) > 0 {
+		return nil, fuse.EPERM
+	}
+
+	err := store.CreateSearch(name)
+	if err != nil {
+		glog.Infof("Error creating search: %s\n", err)
+		return nil, fuse.EIO
+	}
+	return &Dir{fs: d.fs, artist: d.artist, album: name, mPoint: d.mPoint}, nil
+}
+
+// searchRemove deletes a saved query, the Songs inside
+// the results cannot be removed.
+func (d *Dir) searchRemove(req *fuse.RemoveRequest) error {
+	if len(d.album) > 0 || !req.Dir {
+		glog.Info("The search results are read only.")
+		return fuse.EPERM
+	}
+
+	err := store.DeleteSearch(req.Name)
+	if err != nil {
+		glog.Info(err)
+		return fuse.ENOENT
+	}
+	return nil
+}
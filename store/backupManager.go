@@ -0,0 +1,329 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// TagBackup is a copy of the tags of a music file taken
+// right before MuLi modified them.
+// Artist and Album are the compatible names of the
+// values found in the tags at that moment, they are
+// used to find the backups of an album.
+// Snapshot holds the tags as they were stored in the
+// file, it can only be used by musicmgr.RestoreTags.
+type TagBackup struct {
+	Path     string
+	Time     time.Time
+	Artist   string
+	Album    string
+	Snapshot []byte
+}
+
+// maxBackupsPerFile is the amount of backups kept for
+// every music file.
+const maxBackupsPerFile = 10
+
+// backupPrefix returns the prefix of the keys of the
+// backups of a music file in the Backups bucket.
+func backupPrefix(path string) []byte {
+	return append(pathKey(path), 0)
+}
+
+// backupKey returns the key of a backup in the Backups
+// bucket, the keys start with the path of the file so
+// the backups of a file are together and sorted by the
+// time they were taken.
+func backupKey(path string, t time.Time, sequence uint64) []byte {
+	prefix := backupPrefix(path)
+	key := make([]byte, len(prefix)+16)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[len(prefix)+8:], sequence)
+	return key
+}
+
+// fileBackups returns the keys of the backups of the
+// music file in the specified path, the oldest first.
+func fileBackups(bucket *bolt.Bucket, path string) [][]byte {
+	var keys [][]byte
+	prefix := backupPrefix(path)
+	c := bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	return keys
+}
+
+// pruneBackups deletes the oldest backups of the music
+// file that exceed maxBackupsPerFile. The backups kept
+// are always the newest ones without gaps between
+// them, so RestoreSince brings back the exact tags of
+// any time after the oldest backup kept.
+func pruneBackups(bucket *bolt.Bucket, path string) error {
+	keys := fileBackups(bucket, path)
+	if len(keys) <= maxBackupsPerFile {
+		return nil
+	}
+
+	for _, k := range keys[:len(keys)-maxBackupsPerFile] {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupName returns the compatible name used for the
+// Artist or Album of a backup, it is "unknown" when
+// the tag is missing as it is on the database.
+func backupName(name string) string {
+	if name == "" {
+		name = "unknown"
+	}
+	return GetCompatibleString(name)
+}
+
+// storeBackup saves the tags of a music file in the
+// Backups bucket, it is called by musicmgr before
+// the tags are modified.
+func storeBackup(path string, snapshot []byte, tags musicmgr.FileTags) {
+	backup := TagBackup{
+		Path:     path,
+		Time:     time.Now().UTC(),
+		Artist:   backupName(tags.Artist),
+		Album:    backupName(tags.Album),
+		Snapshot: snapshot,
+	}
+
+	err := update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("Backups"))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(backup)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(backupKey(path, backup.Time, sequence), encoded)
+		if err != nil {
+			return err
+		}
+		return pruneBackups(bucket, path)
+	})
+
+	if err != nil {
+		glog.Errorf("Cannot backup the tags of %s: %s\n", path, err)
+	}
+}
+
+// moveBackups updates the path of the backups when a
+// music file is moved.
+func moveBackups(oldPath, newPath string) error {
+	return update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Backups"))
+		if bucket == nil {
+			return nil
+		}
+
+		prefix := backupPrefix(oldPath)
+		for _, k := range fileBackups(bucket, oldPath) {
+			var backup TagBackup
+			value := bucket.Get(k)
+			if err := json.Unmarshal(value, &backup); err != nil {
+				return err
+			}
+
+			backup.Path = newPath
+			encoded, err := json.Marshal(backup)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+
+			newKey := append(backupPrefix(newPath), k[len(prefix):]...)
+			if err = bucket.Put(newKey, encoded); err != nil {
+				return err
+			}
+		}
+		return pruneBackups(bucket, newPath)
+	})
+}
+
+// forgetSong deletes from the database the Song
+// stored with the specified file path.
+func forgetSong(path string) error {
+	return update(func(tx *bolt.Tx) error {
+		artist, album, key, err := songByPath(tx, path)
+		if err == fuse.ENOENT {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		root := tx.Bucket([]byte("Artists"))
+		if root == nil {
+			return nil
+		}
+
+		artistBucket := root.Bucket([]byte(artist))
+		if artistBucket == nil {
+			return nil
+		}
+
+		albumBucket := artistBucket.Bucket([]byte(album))
+		if albumBucket == nil {
+			return nil
+		}
+		return removeSong(tx, albumBucket, artist, album, key)
+	})
+}
+
+// refreshSong stores the Song in the database again
+// with the tags found in the file. The file is not
+// modified, even if the tags are missing, so it keeps
+// the restored tags.
+func refreshSong(path string) error {
+	err := forgetSong(path)
+	if err != nil {
+		return err
+	}
+
+	_, tags := musicmgr.ReadTags(path)
+
+	return StoreNewSong(&tags, path)
+}
+
+// restoreBackups restores the tags of the files with
+// backups that match the filter, using the oldest
+// matching backup for every file. The backups used are
+// deleted and the Songs are updated in the database.
+// Only the backups with keys that start with prefix
+// are checked.
+// It returns the amount of files restored.
+func restoreBackups(prefix []byte, match func(backup *TagBackup) bool) (int, error) {
+	var paths []string
+	oldest := make(map[string]*TagBackup)
+	keys := make(map[string][][]byte)
+	err := view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Backups"))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			backup := &TagBackup{}
+			if json.Unmarshal(v, backup) != nil || !match(backup) {
+				continue
+			}
+
+			if oldest[backup.Path] == nil {
+				oldest[backup.Path] = backup
+				paths = append(paths, backup.Path)
+			}
+			keys[backup.Path] = append(keys[backup.Path], append([]byte{}, k...))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	var used [][]byte
+	for _, path := range paths {
+		glog.Infof("Restoring the tags of %s from %s\n", path, oldest[path].Time)
+		err = musicmgr.RestoreTags(path, oldest[path].Snapshot)
+		if err != nil {
+			glog.Errorf("Cannot restore the tags of %s: %s\n", path, err)
+			continue
+		}
+
+		restored++
+		used = append(used, keys[path]...)
+		if err = refreshSong(path); err != nil {
+			glog.Errorf("Cannot update %s in the database: %s\n", path, err)
+		}
+	}
+
+	err = update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Backups"))
+		for _, k := range used {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return restored, err
+}
+
+// RestoreFile restores the original tags of the music
+// file in the specified path.
+// It returns an error if there are no backups for it.
+func RestoreFile(path string) error {
+	restored, err := restoreBackups(backupPrefix(path), func(backup *TagBackup) bool {
+		return true
+	})
+	if err == nil && restored == 0 {
+		err = errors.New("No backup found.")
+	}
+	return err
+}
+
+// RestoreAlbum restores the original tags of the music
+// files that belonged to the Album before MuLi modified
+// them, even if they were moved later.
+// It returns the amount of files restored.
+func RestoreAlbum(artist, album string) (int, error) {
+	artist = GetCompatibleString(artist)
+	album = GetCompatibleString(album)
+	return restoreBackups(nil, func(backup *TagBackup) bool {
+		return backup.Artist == artist && backup.Album == album
+	})
+}
+
+// RestoreSince reverts every change made in the tags
+// after the specified time, the files get the tags
+// they had at that moment.
+// It returns the amount of files restored.
+func RestoreSince(since time.Time) (int, error) {
+	return restoreBackups(nil, func(backup *TagBackup) bool {
+		return !backup.Time.Before(since)
+	})
+}
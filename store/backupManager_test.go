@@ -0,0 +1,71 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+)
+
+// TestPruneBackups checks that only the newest backups
+// of a file are kept.
+func TestPruneBackups(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	err := InitDB(filepath.Join(mPoint, "muli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB()
+
+	path := mPoint + "song.mp3"
+	for i := 0; i < maxBackupsPerFile+5; i++ {
+		storeBackup(path, []byte{byte(i)}, musicmgr.FileTags{})
+	}
+
+	var kept []byte
+	err = view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Backups"))
+		for _, k := range fileBackups(bucket, path) {
+			var backup TagBackup
+			if err := json.Unmarshal(bucket.Get(k), &backup); err != nil {
+				return err
+			}
+			kept = append(kept, backup.Snapshot...)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kept) != maxBackupsPerFile {
+		t.Fatalf("%d backups kept, expected %d.", len(kept), maxBackupsPerFile)
+	}
+	for i, b := range kept {
+		if int(b) != i+5 {
+			t.Fatalf("The backups kept are not the newest ones: %v", kept)
+		}
+	}
+}
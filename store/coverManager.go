@@ -0,0 +1,193 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// CoverFiles are the names of the virtual files that
+// serve the album cover inside the Album directories.
+var CoverFiles = []string{"cover.jpg", "folder.jpg"}
+
+// IsCoverFile returns true if the name is one of the
+// virtual album cover files.
+func IsCoverFile(name string) bool {
+	for _, cover := range CoverFiles {
+		if name == cover {
+			return true
+		}
+	}
+	return false
+}
+
+// albumSongs returns all the songs in the Album, in
+// the same order they are listed.
+func albumSongs(artist, album string) ([]SongStore, error) {
+	var songs []SongStore
+	err := view(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		if root == nil {
+			return fuse.EIO
+		}
+
+		artistBucket := root.Bucket([]byte(artist))
+		if artistBucket == nil {
+			return fuse.ENOENT
+		}
+
+		albumBucket := artistBucket.Bucket([]byte(album))
+		if albumBucket == nil {
+			return fuse.ENOENT
+		}
+
+		c := albumBucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if k[0] == '.' {
+				continue
+			}
+
+			var song SongStore
+			err := json.Unmarshal(v, &song)
+			if err != nil {
+				continue
+			}
+			songs = append(songs, song)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return songs, nil
+}
+
+// HasAlbumCover returns true if any of the songs
+// in the Album has an embedded picture.
+func HasAlbumCover(artist, album string) bool {
+	songs, err := albumSongs(artist, album)
+	if err != nil {
+		return false
+	}
+
+	for _, song := range songs {
+		if song.HasCover {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAlbumCover returns the image to serve as the
+// Album cover, it is the picture embedded in the
+// first song of the Album that has one.
+// It returns a fuse.ENOENT error if the Album has
+// no pictures.
+func GetAlbumCover(artist, album string) ([]byte, error) {
+	glog.Infof("Getting cover for Artist: %s Album: %s\n", artist, album)
+	songs, err := albumSongs(artist, album)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, song := range songs {
+		if !song.HasCover {
+			continue
+		}
+
+		cover, err := musicmgr.GetCover(song.SongFullPath)
+		if err != nil {
+			glog.Infof("Cannot read the cover from %s: %s\n", song.SongFullPath, err)
+			continue
+		}
+		if cover != nil {
+			return cover.Data, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// SetAlbumCover embeds the image as the front cover
+// of every song in the Album and updates the database
+// accordingly.
+// The songs that cannot be updated are skipped, an
+// error is only returned if none of them could be
+// updated.
+func SetAlbumCover(artist, album string, data []byte) error {
+	glog.Infof("Setting cover for Artist: %s Album: %s\n", artist, album)
+	songs, err := albumSongs(artist, album)
+	if err != nil {
+		return err
+	}
+
+	var updated []string
+	for _, song := range songs {
+		err = musicmgr.SetCover(song.SongFullPath, data)
+		if err != nil {
+			glog.Infof("Cannot set the cover in %s: %s\n", song.SongFullPath, err)
+			continue
+		}
+		updated = append(updated, song.SongPath)
+	}
+
+	if len(updated) == 0 {
+		if err == nil {
+			err = errors.New("Album has no songs.")
+		}
+		return err
+	}
+
+	return update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		artistBucket := root.Bucket([]byte(artist))
+		if artistBucket == nil {
+			return errors.New("Artist not found.")
+		}
+		albumBucket := artistBucket.Bucket([]byte(album))
+		if albumBucket == nil {
+			return errors.New("Album not found.")
+		}
+
+		for _, name := range updated {
+			songJson := albumBucket.Get([]byte(name))
+			if songJson == nil {
+				continue
+			}
+
+			var song SongStore
+			err := json.Unmarshal(songJson, &song)
+			if err != nil {
+				continue
+			}
+
+			song.HasCover = true
+			encoded, err := json.Marshal(song)
+			if err != nil {
+				return err
+			}
+			albumBucket.Put([]byte(name), encoded)
+		}
+		return nil
+	})
+}
@@ -36,10 +36,12 @@ func deleteDrop(path string) {
  *  The user can copy/create files into this directory and
  *  the files will be organized to the correct directory
  *  based on the file tags.
+ *  The missing tags are inferred from the file name
+ *  with the path patterns.
  */
 func HandleDrop(path, rootPoint string) error {
 	glog.Infof("Handle drop with path: %s\n", path)
-	err, fileTags := musicmgr.GetMp3Tags(path)
+	err, fileTags := musicmgr.GetTags(path)
 	if err != nil {
 		deleteDrop(path)
 		return fuse.EIO
@@ -59,6 +61,10 @@ func HandleDrop(path, rootPoint string) error {
 		return err
 	}
 
+	if CustomLayout() {
+		return dropToLayout(path, rootPoint, &fileTags)
+	}
+
 	//_, file := filepath.Split(path)
 	newPath := rootPoint + artist + "/" + album + "/"
 	os.MkdirAll(newPath, 0777)
@@ -70,6 +76,11 @@ func HandleDrop(path, rootPoint string) error {
 		return fuse.EIO
 	}
 
+	err = moveBackups(path, newPath+file)
+	if err != nil {
+		glog.Infof("Error updating the tag backups: %s\n", err)
+	}
+
 	_, err = CreateSong(artist, album, fileTags.Title+extension, newPath)
 	deleteDrop(path)
 	if err != nil {
@@ -78,6 +89,50 @@ func HandleDrop(path, rootPoint string) error {
 	return err
 }
 
+/** Moves a file from the drop directory to the path
+ *  generated by the layout and adds it to the database.
+ *  If there is another file in that path the dropped
+ *  file is left in the drop directory and fuse.EEXIST
+ *  is returned. The move is recorded in the journal.
+ */
+func dropToLayout(path, rootPoint string, fileTags *musicmgr.FileTags) error {
+	newPath := LayoutPath(*fileTags, filepath.Ext(path), rootPoint)
+	err := checkLayoutTarget(path, newPath)
+	if err != nil {
+		return err
+	}
+
+	intent := moveIntent{
+		Kind:       moveDrop,
+		OldPath:    path,
+		NewPath:    newPath,
+		MountPoint: rootPoint,
+		Tags:       *fileTags,
+	}
+	key, err := beginMove(&intent)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	err = os.MkdirAll(filepath.Dir(newPath), 0777)
+	if err == nil {
+		err = os.Rename(path, newPath)
+	}
+	if err != nil {
+		glog.Infof("Error moving the song: %s\n", err)
+		endMove(key)
+		return fuse.EIO
+	}
+
+	err = finishRetag(&intent)
+	if err != nil {
+		glog.Infof("Error storing song in the DB: %s\n", err)
+		return err
+	}
+	endMove(key)
+	return nil
+}
+
 /** Returns the path of a file in the drop directory.
  */
 func GetDropFilePath(name, mPoint string) (string, error) {
@@ -0,0 +1,273 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// genreTag returns the Genre stored in the tags for the
+// name of a Genre Directory. If there are Songs with
+// that Genre their Genre is used, so the original
+// spelling is kept, otherwise the underscores of the
+// name are changed back to spaces.
+func genreTag(name string) string {
+	genre := strings.Replace(name, "_", " ", -1)
+	view(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(GenresIndex))
+		if root == nil {
+			return nil
+		}
+
+		b := root.Bucket([]byte(GetCompatibleString(name)))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys := strings.SplitN(string(k), "/", 3)
+			if len(keys) != 3 {
+				continue
+			}
+
+			song, err := getSong(tx, keys[0], keys[1], keys[2])
+			if err == nil && song.Genre != "" {
+				genre = song.Genre
+				return nil
+			}
+		}
+		return nil
+	})
+	return genre
+}
+
+// getSong returns a Song from the Artists Bucket.
+func getSong(tx *bolt.Tx, artist, album, song string) (SongStore, error) {
+	var songStore SongStore
+	root := tx.Bucket([]byte("Artists"))
+	if root == nil {
+		return songStore, fuse.ENOENT
+	}
+
+	artistBucket := root.Bucket([]byte(artist))
+	if artistBucket == nil {
+		return songStore, fuse.ENOENT
+	}
+
+	albumBucket := artistBucket.Bucket([]byte(album))
+	if albumBucket == nil {
+		return songStore, fuse.ENOENT
+	}
+
+	songJson := albumBucket.Get([]byte(song))
+	if songJson == nil {
+		return songStore, fuse.ENOENT
+	}
+
+	err := json.Unmarshal(songJson, &songStore)
+	return songStore, err
+}
+
+// setSongsGenre changes the Genre of the Songs in the
+// song files and in the database. When a custom layout
+// is used the files are also moved to their new path.
+func setSongsGenre(songs []storedSong, name, mPoint string) error {
+	if len(songs) == 0 {
+		return fuse.ENOENT
+	}
+
+	genre := genreTag(name)
+	newTags := make([]musicmgr.FileTags, len(songs))
+	for n, s := range songs {
+		newTags[n] = s.tags
+		newTags[n].Genre = genre
+	}
+
+	if CustomLayout() {
+		err := layoutTargets(songs, newTags, mPoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	for n, s := range songs {
+		tags := newTags[n]
+		glog.Infof("Changing the Genre of %s to %s\n", s.song.SongFullPath, genre)
+
+		var err error
+		if CustomLayout() {
+			err = retagSong(s, tags, mPoint)
+		} else {
+			err = musicmgr.SetAllTags(musicmgr.FileTags{Genre: genre}, s.song.SongFullPath)
+			if err == nil {
+				err = UpdateSongTags(s.artist, s.album, s.key, &tags)
+			}
+		}
+
+		if err != nil {
+			glog.Infof("Cannot change the Genre of %s: %s\n", s.song.SongFullPath, err)
+			return fuse.EIO
+		}
+	}
+	return nil
+}
+
+// artistSongs returns the Songs of the Album, or of
+// every Album of the Artist when album is empty.
+func artistSongs(tx *bolt.Tx, artist, album string) ([]storedSong, error) {
+	root := tx.Bucket([]byte("Artists"))
+	if root == nil {
+		return nil, fuse.ENOENT
+	}
+
+	artistBucket := root.Bucket([]byte(artist))
+	if artistBucket == nil {
+		return nil, fuse.ENOENT
+	}
+
+	var albums []string
+	if album != "" {
+		albums = append(albums, album)
+	} else {
+		artistBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				albums = append(albums, string(k))
+			}
+			return nil
+		})
+	}
+
+	var songs []storedSong
+	for _, a := range albums {
+		albumBucket := artistBucket.Bucket([]byte(a))
+		if albumBucket == nil {
+			return nil, fuse.ENOENT
+		}
+
+		var keys []string
+		albumBucket.ForEach(func(k, v []byte) error {
+			if v != nil && k[0] != '.' {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+
+		for _, key := range keys {
+			s, err := loadStoredSong(tx, artist, a, key)
+			if err != nil {
+				continue
+			}
+			songs = append(songs, s)
+		}
+	}
+	return songs, nil
+}
+
+// SetGenre changes the Genre of a Song, or every Song
+// in an Album when song is empty, or every Song of an
+// Artist when album is also empty.
+// The name is the one of the Genre Directory.
+func SetGenre(artist, album, song, name, mPoint string) error {
+	var songs []storedSong
+	err := view(func(tx *bolt.Tx) error {
+		if song == "" {
+			var err error
+			songs, err = artistSongs(tx, artist, album)
+			return err
+		}
+
+		s, err := loadStoredSong(tx, artist, album, song)
+		if err != nil {
+			return err
+		}
+		songs = append(songs, s)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return setSongsGenre(songs, name, mPoint)
+}
+
+// SetIndexGenre changes the Genre of the Songs inside
+// the entry of an index specified by the levels, the
+// levels are the value, Artist, Album and Song.
+func SetIndexGenre(index string, levels []string, name, mPoint string) error {
+	if len(levels) < 1 || len(levels) > 4 {
+		return fuse.EPERM
+	}
+
+	var songs []storedSong
+	err := view(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(index))
+		if root == nil || root.Bucket([]byte(levels[0])) == nil {
+			return fuse.ENOENT
+		}
+
+		var prefix []byte
+		if len(levels) > 1 {
+			prefix = []byte(strings.Join(levels[1:], "/"))
+			if len(levels) < 4 {
+				prefix = append(prefix, '/')
+			}
+		}
+
+		c := root.Bucket([]byte(levels[0])).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if len(levels) == 4 && len(k) != len(prefix) {
+				continue
+			}
+
+			keys := strings.SplitN(string(k), "/", 3)
+			if len(keys) != 3 {
+				continue
+			}
+
+			s, err := loadStoredSong(tx, keys[0], keys[1], keys[2])
+			if err != nil {
+				continue
+			}
+			songs = append(songs, s)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return setSongsGenre(songs, name, mPoint)
+}
+
+// SetLayoutGenre changes the Genre of the Songs inside
+// the directory or file of the layout specified by the
+// levels.
+func SetLayoutGenre(levels []string, name, mPoint string) error {
+	songs, err := layoutSongs(levels)
+	if err != nil {
+		return err
+	}
+	return setSongsGenre(songs, name, mPoint)
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dankomiocevic/mulifs/musicmgr"
+)
+
+// TestGenreTag checks that the Genre written in the
+// tags keeps the spelling of the Genre and not the
+// name of its Directory.
+func TestGenreTag(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	err := InitDB(filepath.Join(mPoint, "muli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB()
+
+	songs := []musicmgr.FileTags{
+		{Title: "One", Artist: "Band", Album: "First", Genre: "Hip Hop"},
+		{Title: "Two", Artist: "Band", Album: "First", Genre: "Rock"},
+	}
+	for _, tags := range songs {
+		path := mPoint + tags.Title + ".mp3"
+		err = ioutil.WriteFile(path, []byte("AUDIO"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = StoreNewSong(&tags, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := map[string]string{
+		"Hip_Hop":       "Hip Hop",
+		"Rock":          "Rock",
+		"Drum_and_Bass": "Drum and Bass",
+	}
+	for name, genre := range names {
+		if got := genreTag(name); got != genre {
+			t.Errorf("The Genre of %s is %q, expected %q.", name, got, genre)
+		}
+	}
+
+	err = SetIndexGenre(GenresIndex, []string{"Rock"}, "Hip_Hop", mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, tags := musicmgr.GetTags(mPoint + "Two.mp3")
+	if err != nil || tags.Genre != "Hip Hop" {
+		t.Errorf("Wrong Genre in the tags: %q %v", tags.Genre, err)
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+)
+
+// Names of the root Buckets of the secondary indexes.
+const (
+	GenresIndex  = "Genres"
+	YearsIndex   = "Years"
+	DecadesIndex = "Decades"
+)
+
+// PathsIndex is the root Bucket that maps the path of
+// every Song file to the Artist, Album and Song Keys
+// separated by slashes.
+const PathsIndex = "Paths"
+
+// index is a secondary index of the Songs, value
+// returns the name of the Bucket where a Song is
+// stored inside the root Bucket of the index.
+type index struct {
+	bucket string
+	value  func(song *SongStore) string
+}
+
+// indexes are all the secondary indexes kept for
+// the Songs.
+// Every index has a Bucket for every value and each
+// one of them has a Key for every Song with that value,
+// the Keys are formed with the Artist, Album and Song
+// Keys separated by slashes.
+var indexes = []index{
+	{GenresIndex, genreValue},
+	{YearsIndex, yearValue},
+	{DecadesIndex, decadeValue},
+}
+
+// genreValue returns the compatible name of the Genre
+// of the Song.
+func genreValue(song *SongStore) string {
+	genre := GetCompatibleString(song.Genre)
+	if genre == "" {
+		return "unknown"
+	}
+	return genre
+}
+
+// yearValue returns the year of the Song.
+func yearValue(song *SongStore) string {
+	if song.Year <= 0 {
+		return "unknown"
+	}
+	return strconv.Itoa(song.Year)
+}
+
+// decadeValue returns the decade of the Song, like
+// 1990s.
+func decadeValue(song *SongStore) string {
+	if song.Year <= 0 {
+		return "unknown"
+	}
+	return strconv.Itoa(song.Year/10*10) + "s"
+}
+
+// indexKey returns the Key of a Song in the indexes.
+func indexKey(artist, album, song string) []byte {
+	return []byte(artist + "/" + album + "/" + song)
+}
+
+// pathKey returns the Key of a Song file in the
+// Paths index.
+func pathKey(path string) []byte {
+	return []byte(filepath.Clean(path))
+}
+
+// indexSong adds the Song to all the indexes, to the
+// Paths and Layout indexes and stores its tags in the
+// search index.
+func indexSong(tx *bolt.Tx, artist, album, key string, song *SongStore) error {
+	for _, idx := range indexes {
+		root, err := tx.CreateBucketIfNotExists([]byte(idx.bucket))
+		if err != nil {
+			return err
+		}
+
+		b, err := root.CreateBucketIfNotExists([]byte(idx.value(song)))
+		if err != nil {
+			return err
+		}
+
+		err = b.Put(indexKey(artist, album, key), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := indexPath(tx, artist, album, key, song)
+	if err != nil {
+		return err
+	}
+
+	err = indexLayout(tx, artist, album, key, song)
+	if err != nil {
+		return err
+	}
+
+	search, err := tx.CreateBucketIfNotExists([]byte(SearchIndex))
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(newSearchEntry(artist, album, song))
+	if err != nil {
+		return err
+	}
+	return search.Put(indexKey(artist, album, key), encoded)
+}
+
+// unindexSong removes the Song from all the indexes,
+// the values that have no more Songs are deleted.
+func unindexSong(tx *bolt.Tx, artist, album, key string, song *SongStore) error {
+	for _, idx := range indexes {
+		root := tx.Bucket([]byte(idx.bucket))
+		if root == nil {
+			continue
+		}
+
+		value := []byte(idx.value(song))
+		b := root.Bucket(value)
+		if b == nil {
+			continue
+		}
+
+		err := b.Delete(indexKey(artist, album, key))
+		if err != nil {
+			return err
+		}
+
+		if k, _ := b.Cursor().First(); k == nil {
+			if err = root.DeleteBucket(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The path is only removed if it still belongs to
+	// this Song.
+	paths := tx.Bucket([]byte(PathsIndex))
+	if paths != nil && song.SongFullPath != "" {
+		value := paths.Get(pathKey(song.SongFullPath))
+		if bytes.Equal(value, indexKey(artist, album, key)) {
+			err := paths.Delete(pathKey(song.SongFullPath))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := unindexLayout(tx, artist, album, key)
+	if err != nil {
+		return err
+	}
+
+	if search := tx.Bucket([]byte(SearchIndex)); search != nil {
+		return search.Delete(indexKey(artist, album, key))
+	}
+	return nil
+}
+
+// songByPath returns the Artist, Album and Song Keys of
+// the Song stored with the file path.
+func songByPath(tx *bolt.Tx, path string) (string, string, string, error) {
+	paths := tx.Bucket([]byte(PathsIndex))
+	if paths == nil {
+		return "", "", "", fuse.ENOENT
+	}
+
+	value := paths.Get(pathKey(path))
+	if value == nil {
+		return "", "", "", fuse.ENOENT
+	}
+
+	keys := strings.SplitN(string(value), "/", 3)
+	if len(keys) != 3 {
+		return "", "", "", fuse.EIO
+	}
+	return keys[0], keys[1], keys[2], nil
+}
+
+// putSong stores the Song in the Album Bucket and
+// updates the indexes.
+func putSong(tx *bolt.Tx, albumBucket *bolt.Bucket, artist, album, key string, song *SongStore) error {
+	err := removeSong(tx, albumBucket, artist, album, key)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(song)
+	if err != nil {
+		return err
+	}
+
+	err = albumBucket.Put([]byte(key), encoded)
+	if err != nil {
+		return err
+	}
+	return indexSong(tx, artist, album, key, song)
+}
+
+// removeSong deletes the Song from the Album Bucket
+// and from the indexes.
+func removeSong(tx *bolt.Tx, albumBucket *bolt.Bucket, artist, album, key string) error {
+	songJson := albumBucket.Get([]byte(key))
+	if songJson == nil {
+		return nil
+	}
+
+	var song SongStore
+	if json.Unmarshal(songJson, &song) == nil {
+		err := unindexSong(tx, artist, album, key, &song)
+		if err != nil {
+			return err
+		}
+	}
+	return albumBucket.Delete([]byte(key))
+}
+
+// unindexAlbum removes all the Songs of the Album from
+// the indexes, it is used before the Album Bucket is
+// deleted.
+func unindexAlbum(tx *bolt.Tx, artistBucket *bolt.Bucket, artist, album string) error {
+	albumBucket := artistBucket.Bucket([]byte(album))
+	if albumBucket == nil {
+		return nil
+	}
+
+	return albumBucket.ForEach(func(k, v []byte) error {
+		var song SongStore
+		if v == nil || k[0] == '.' || json.Unmarshal(v, &song) != nil {
+			return nil
+		}
+		return unindexSong(tx, artist, album, string(k), &song)
+	})
+}
+
+// unindexArtist removes all the Songs of the Artist
+// from the indexes, it is used before the Artist
+// Bucket is deleted.
+func unindexArtist(tx *bolt.Tx, root *bolt.Bucket, artist string) error {
+	artistBucket := root.Bucket([]byte(artist))
+	if artistBucket == nil {
+		return nil
+	}
+
+	return artistBucket.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return unindexAlbum(tx, artistBucket, artist, string(k))
+	})
+}
+
+// indexPath adds the file of the Song to the Paths
+// index, Songs without a file are skipped.
+func indexPath(tx *bolt.Tx, artist, album, key string, song *SongStore) error {
+	if song.SongFullPath == "" {
+		return nil
+	}
+
+	paths, err := tx.CreateBucketIfNotExists([]byte(PathsIndex))
+	if err != nil {
+		return err
+	}
+	return paths.Put(pathKey(song.SongFullPath), indexKey(artist, album, key))
+}
+
+// rebuildPathsIndex creates the Paths index again from
+// the Songs in the Artists Bucket, the other indexes
+// are not modified.
+func rebuildPathsIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(PathsIndex)) != nil {
+		if err := tx.DeleteBucket([]byte(PathsIndex)); err != nil {
+			return err
+		}
+	}
+	return forEachSong(tx, indexPath)
+}
+
+// rebuildIndexes creates all the indexes again from
+// the Songs in the Artists Bucket.
+func rebuildIndexes(tx *bolt.Tx) error {
+	names := []string{SearchIndex, PathsIndex, LayoutIndex, LayoutSongsIndex}
+	for _, idx := range indexes {
+		names = append(names, idx.bucket)
+	}
+
+	for _, name := range names {
+		if tx.Bucket([]byte(name)) == nil {
+			continue
+		}
+		if err := tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	return forEachSong(tx, indexSong)
+}
+
+// forEachSong calls fn for every Song stored in the
+// Artists Bucket, with the Artist, Album and Song Keys.
+// It stops on the first error returned by fn.
+func forEachSong(tx *bolt.Tx, fn func(tx *bolt.Tx, artist, album, key string, song *SongStore) error) error {
+	root := tx.Bucket([]byte("Artists"))
+	if root == nil {
+		return nil
+	}
+
+	return root.ForEach(func(artist, v []byte) error {
+		artistBucket := root.Bucket(artist)
+		if v != nil || artistBucket == nil {
+			return nil
+		}
+
+		return artistBucket.ForEach(func(album, v []byte) error {
+			albumBucket := artistBucket.Bucket(album)
+			if v != nil || albumBucket == nil {
+				return nil
+			}
+
+			return albumBucket.ForEach(func(k, v []byte) error {
+				var song SongStore
+				if k[0] == '.' || json.Unmarshal(v, &song) != nil {
+					return nil
+				}
+				return fn(tx, string(artist), string(album), string(k), &song)
+			})
+		})
+	})
+}
+
+// indexEntries returns the names of the entries found
+// in an index for the levels, the first level is the
+// value of the index, followed by the Artist and the
+// Album.
+func indexEntries(tx *bolt.Tx, name string, levels []string) ([]string, error) {
+	root := tx.Bucket([]byte(name))
+	if root == nil {
+		return nil, fuse.ENOENT
+	}
+
+	var entries []string
+	if len(levels) == 0 {
+		err := root.ForEach(func(k, v []byte) error {
+			if v == nil {
+				entries = append(entries, string(k))
+			}
+			return nil
+		})
+		return entries, err
+	}
+
+	b := root.Bucket([]byte(levels[0]))
+	if b == nil {
+		return nil, fuse.ENOENT
+	}
+
+	var prefix []byte
+	if len(levels) > 1 {
+		prefix = []byte(strings.Join(levels[1:], "/") + "/")
+	}
+
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		entry := string(k[len(prefix):])
+		if i := strings.Index(entry, "/"); i >= 0 {
+			entry = entry[:i]
+		}
+		if len(entries) == 0 || entries[len(entries)-1] != entry {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fuse.ENOENT
+	}
+	return entries, nil
+}
+
+// ListIndex returns the Dirent for the values of the
+// index or the Artists, Albums or Songs inside one of
+// them, the levels specify the value, Artist and Album.
+func ListIndex(name string, levels []string) ([]fuse.Dirent, error) {
+	if len(levels) > 3 {
+		return nil, fuse.ENOENT
+	}
+
+	var a []fuse.Dirent
+	err := view(func(tx *bolt.Tx) error {
+		entries, err := indexEntries(tx, name, levels)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			var node fuse.Dirent
+			node.Name = entry
+			node.Type = fuse.DT_Dir
+			if len(levels) == 3 {
+				node.Type = fuse.DT_File
+			}
+			a = append(a, node)
+		}
+		return nil
+	})
+	return a, err
+}
+
+// GetIndexEntry checks that the entry of the index
+// specified by the levels exists, the levels are the
+// value, Artist, Album and Song.
+func GetIndexEntry(name string, levels []string) error {
+	if len(levels) < 1 || len(levels) > 4 {
+		return fuse.ENOENT
+	}
+
+	return view(func(tx *bolt.Tx) error {
+		entries, err := indexEntries(tx, name, levels[:len(levels)-1])
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry == levels[len(levels)-1] {
+				return nil
+			}
+		}
+		return fuse.ENOENT
+	})
+}
@@ -0,0 +1,424 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
+	"github.com/golang/glog"
+)
+
+// JournalBucket is the root Bucket where the moves are
+// recorded before they run, they are deleted once the
+// move is finished.
+const JournalBucket = "Journal"
+
+// Kinds of moves recorded in the journal.
+// moveRetag is a Song that gets new tags and is moved
+// to their path in the layout, moveDrop is a file moved
+// from the drop Directory to the layout.
+const (
+	moveSong   = "song"
+	moveAlbum  = "album"
+	moveArtist = "artist"
+	moveRetag  = "retag"
+	moveDrop   = "drop"
+)
+
+// moveIntent is a move recorded in the journal with
+// everything needed to finish it or undo it after a
+// crash.
+// OldName and NewName are only used for the Songs,
+// OldName is the Key of the Song and NewName the name
+// received by MoveSongs. OldPath and NewPath are the
+// full paths of the Song file and Song is the Song as
+// it was stored before the move. Tags are the new tags
+// of a retagged or dropped Song.
+type moveIntent struct {
+	Kind       string
+	OldArtist  string
+	OldAlbum   string
+	OldName    string
+	NewArtist  string
+	NewAlbum   string
+	NewName    string
+	OldPath    string
+	NewPath    string
+	MountPoint string
+	Song       SongStore
+	Tags       musicmgr.FileTags
+}
+
+// beginMove stores the move in the journal and returns
+// its Key.
+// The moves are not recorded when the current Store is
+// not the Bolt one, a nil Key is returned then.
+func beginMove(intent *moveIntent) ([]byte, error) {
+	if _, ok := backend.(boltStore); !ok {
+		return nil, nil
+	}
+
+	var key []byte
+	err := update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(JournalBucket))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(intent)
+		if err != nil {
+			return err
+		}
+
+		key = make([]byte, 8)
+		binary.BigEndian.PutUint64(key, sequence)
+		return bucket.Put(key, encoded)
+	})
+
+	if err != nil {
+		glog.Errorf("Cannot record the move in the journal: %s\n", err)
+		return nil, err
+	}
+	return key, nil
+}
+
+// endMove deletes a finished move from the journal.
+func endMove(key []byte) {
+	if key == nil {
+		return
+	}
+
+	err := update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(JournalBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+
+	if err != nil {
+		glog.Errorf("Cannot delete the move from the journal: %s\n", err)
+	}
+}
+
+// fileExists returns true if there is a file in the
+// specified path.
+func fileExists(path string) bool {
+	src, err := os.Stat(path)
+	return err == nil && !src.IsDir()
+}
+
+// putStoredSong stores the Song as it is in the
+// specified Artist and Album.
+func putStoredSong(artist, album, key string, song *SongStore) error {
+	return update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		if root == nil {
+			return fuse.EIO
+		}
+
+		artistBucket := root.Bucket([]byte(artist))
+		if artistBucket == nil {
+			return errors.New("Artist not found.")
+		}
+
+		albumBucket := artistBucket.Bucket([]byte(album))
+		if albumBucket == nil {
+			return errors.New("Album not found.")
+		}
+		return putSong(tx, albumBucket, artist, album, key, song)
+	})
+}
+
+// rollbackSongMove undoes a Song move that did not
+// rename the file yet, the Song and its playlists are
+// stored again as they were.
+func rollbackSongMove(i *moveIntent) error {
+	glog.Infof("Rolling back the move of %s\n", i.OldPath)
+	_, err := GetSong(i.OldArtist, i.OldAlbum, i.OldName)
+	if err != nil && i.Song.SongPath != "" {
+		err = putStoredSong(i.OldArtist, i.OldAlbum, i.OldName, &i.Song)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pl := range i.Song.Playlists {
+		file := playlistmgr.PlaylistFile{
+			Title:  i.OldName,
+			Artist: i.OldArtist,
+			Album:  i.OldAlbum,
+		}
+
+		AddFileToPlaylist(file, pl)
+		RegeneratePlaylistFile(pl, i.MountPoint)
+	}
+	return nil
+}
+
+// finishSongMove runs the steps of a Song move after
+// the file was renamed, the steps that were already
+// done are run again without changing the result so it
+// also finishes an interrupted move.
+// If the Song cannot be created in the new Album it is
+// stored from the tags of the file, so the file is not
+// left out of the database.
+// It returns the Key of the Song in the new Album.
+func finishSongMove(i *moveIntent) (string, error) {
+	// Keep the backups of the tags with the file.
+	err := moveBackups(i.OldPath, i.NewPath)
+	if err != nil {
+		glog.Infof("Cannot update the tag backups: %s\n", err)
+	}
+
+	// Delete the song from the database
+	newDir := filepath.Dir(i.NewPath) + "/"
+	newFileName := filepath.Base(i.NewPath)
+	sameSong := i.OldArtist == i.NewArtist && i.OldAlbum == i.NewAlbum && i.OldName == newFileName
+	if _, err := GetSong(i.OldArtist, i.OldAlbum, i.OldName); err == nil && !sameSong {
+		err = DeleteSong(i.OldArtist, i.OldAlbum, i.OldName, i.MountPoint)
+		if err != nil {
+			glog.Infof("Cannot delete song: %s\n", err)
+		}
+	}
+
+	// With a custom layout the file name does not match
+	// the Song Key, the Song is always stored from the
+	// tags of the file.
+	if CustomLayout() {
+		title := i.NewName[:len(i.NewName)-len(filepath.Ext(i.NewName))]
+		musicmgr.SetTags(i.NewArtist, i.NewAlbum, title, i.NewPath)
+		_, tags := musicmgr.GetTags(i.NewPath)
+		newFileName = GetCompatibleString(tags.Title) + filepath.Ext(i.NewPath)
+		err = StoreNewSong(&tags, i.NewPath)
+		if err != nil {
+			return newFileName, err
+		}
+	} else {
+		// Change the tags in the file.
+		musicmgr.SetTags(i.NewArtist, i.NewAlbum, i.NewName, i.NewPath)
+		// Add the song again to the database.
+		_, err = CreateSong(i.NewArtist, i.NewAlbum, i.NewName, newDir)
+		if err != nil {
+			glog.Infof("Cannot create song in the db: %s\n", err)
+			_, tags := musicmgr.GetTags(i.NewPath)
+			newFileName = GetCompatibleString(tags.Title) + filepath.Ext(i.NewPath)
+			return newFileName, StoreNewSong(&tags, i.NewPath)
+		}
+
+		// Keep the rest of the tags from the file.
+		_, tags := musicmgr.GetTags(i.NewPath)
+		err = UpdateSongTags(i.NewArtist, i.NewAlbum, newFileName, &tags)
+		if err != nil {
+			glog.Infof("Cannot update the song tags in the db: %s\n", err)
+		}
+	}
+
+	// Add the song to all the playlists.
+	for _, pl := range i.Song.Playlists {
+		file := playlistmgr.PlaylistFile{
+			Title:  newFileName,
+			Artist: i.NewArtist,
+			Album:  i.NewAlbum,
+			Path:   newDir,
+		}
+
+		AddFileToPlaylist(file, pl)
+		RegeneratePlaylistFile(pl, i.MountPoint)
+	}
+	return newFileName, nil
+}
+
+// finishRetag runs the steps of a retagged or dropped
+// Song after its tags were written, the file is moved
+// to the new path if it is still in the old one and
+// the Song is stored again from the new tags. The
+// steps that were already done are run again without
+// changing the result so it also finishes an
+// interrupted move.
+func finishRetag(i *moveIntent) error {
+	if i.OldPath != i.NewPath && fileExists(i.OldPath) {
+		err := os.MkdirAll(filepath.Dir(i.NewPath), 0777)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(i.OldPath, i.NewPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.OldPath != i.NewPath {
+		err := moveBackups(i.OldPath, i.NewPath)
+		if err != nil {
+			glog.Infof("Cannot update the tag backups: %s\n", err)
+		}
+	}
+
+	if i.OldName != "" {
+		if _, err := GetSong(i.OldArtist, i.OldAlbum, i.OldName); err == nil {
+			err = DeleteSong(i.OldArtist, i.OldAlbum, i.OldName, i.MountPoint)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tags := i.Tags
+	err := StoreNewSong(&tags, i.NewPath)
+	if err != nil {
+		return err
+	}
+
+	// Add the song to all the playlists again.
+	for _, pl := range i.Song.Playlists {
+		file := playlistmgr.PlaylistFile{
+			Title:  GetCompatibleString(tags.Title) + filepath.Ext(i.NewPath),
+			Artist: GetCompatibleString(tags.Artist),
+			Album:  GetCompatibleString(tags.Album),
+		}
+
+		AddFileToPlaylist(file, pl)
+		RegeneratePlaylistFile(pl, i.MountPoint)
+	}
+	return nil
+}
+
+// recoverMove finishes or undoes a move found in the
+// journal.
+// The Songs whose file was not renamed are rolled back,
+// the rest are finished. A retagged Song is always
+// finished, its tags are written again if the file was
+// not renamed yet. A dropped file that is still in the
+// drop Directory is left there. The Albums and Artists that
+// still exist are moved again without recording them
+// in the journal twice, the Songs that were already
+// moved are not in them anymore.
+func recoverMove(i *moveIntent) error {
+	switch i.Kind {
+	case moveSong:
+		if i.OldPath != i.NewPath && fileExists(i.OldPath) {
+			return rollbackSongMove(i)
+		}
+
+		if !fileExists(i.NewPath) {
+			glog.Errorf("The file of the moved song %s was not found.\n", i.NewPath)
+			return nil
+		}
+
+		_, err := finishSongMove(i)
+		return err
+	case moveRetag:
+		path := i.NewPath
+		if fileExists(i.OldPath) {
+			path = i.OldPath
+		}
+		if !fileExists(path) {
+			glog.Errorf("The file of the retagged song %s was not found.\n", i.NewPath)
+			return nil
+		}
+
+		if path == i.OldPath {
+			err := musicmgr.SetAllTags(i.Tags, path)
+			if err != nil {
+				return err
+			}
+		}
+		return finishRetag(i)
+	case moveDrop:
+		if fileExists(i.OldPath) {
+			return nil
+		}
+
+		if !fileExists(i.NewPath) {
+			glog.Errorf("The file of the dropped song %s was not found.\n", i.NewPath)
+			return nil
+		}
+		return finishRetag(i)
+	case moveAlbum:
+		if _, err := GetAlbumPath(i.OldArtist, i.OldAlbum); err != nil {
+			return nil
+		}
+		return moveAlbumSongs(i.OldArtist, i.OldAlbum, i.NewArtist, i.NewAlbum, i.MountPoint, false)
+	case moveArtist:
+		if _, err := GetArtistPath(i.OldArtist); err != nil {
+			return nil
+		}
+		return moveArtistAlbums(i.OldArtist, i.NewArtist, i.MountPoint, false)
+	}
+
+	glog.Errorf("Unknown move in the journal: %s\n", i.Kind)
+	return nil
+}
+
+// recoverMoves finishes or undoes the moves left in the
+// journal by a crash, it is called by InitDB.
+// The newest moves are recovered first, so the Songs
+// of an Album are settled before the Album is moved
+// again. The moves that cannot be recovered stay in the
+// journal for the next time.
+func recoverMoves() {
+	var keys [][]byte
+	var intents []moveIntent
+	err := view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(JournalBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var intent moveIntent
+			if err := json.Unmarshal(v, &intent); err != nil {
+				glog.Errorf("Cannot read the move %x from the journal: %s\n", k, err)
+				continue
+			}
+			keys = append(keys, append([]byte{}, k...))
+			intents = append(intents, intent)
+		}
+		return nil
+	})
+
+	if err != nil {
+		glog.Errorf("Cannot read the journal: %s\n", err)
+		return
+	}
+
+	for n := range intents {
+		glog.Infof("Recovering the %s move from %s/%s/%s\n", intents[n].Kind, intents[n].OldArtist, intents[n].OldAlbum, intents[n].OldName)
+		err = recoverMove(&intents[n])
+		if err != nil {
+			glog.Errorf("Cannot recover the move: %s\n", err)
+			continue
+		}
+		endMove(keys[n])
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
+)
+
+// checkJournal fails if there are moves left in the
+// journal.
+func checkJournal(t *testing.T) {
+	err := view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(JournalBucket))
+		if bucket == nil {
+			return nil
+		}
+		if k, _ := bucket.Cursor().First(); k != nil {
+			t.Errorf("The move %x was left in the journal.", k)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestJournalSongMoves interrupts two Song moves, one
+// after renaming the file and one before, and checks
+// that they are settled when the database is opened
+// again.
+func TestJournalSongMoves(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	dbPath := filepath.Join(mPoint, "muli.db")
+	err := InitDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artist, album, one := addTestSong(t, mPoint, "Band", "First", "One.mp3")
+	_, _, two := addTestSong(t, mPoint, "Band", "First", "Two.mp3")
+	other, err := CreateAlbum(artist, "Second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(mPoint+artist+"/"+other, 0777)
+
+	_, err = CreatePlaylist("Mix", mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(mPoint+"playlists/Mix", 0777)
+	err = AddFileToPlaylist(playlistmgr.PlaylistFile{Title: one, Artist: artist, Album: album}, "Mix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{one, two} {
+		song, err := GetSong(artist, album, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = beginMove(&moveIntent{
+			Kind:       moveSong,
+			OldArtist:  artist,
+			OldAlbum:   album,
+			OldName:    name,
+			NewArtist:  artist,
+			NewAlbum:   other,
+			NewName:    name,
+			OldPath:    mPoint + artist + "/" + album + "/" + name,
+			NewPath:    mPoint + artist + "/" + other + "/" + name,
+			MountPoint: mPoint,
+			Song:       song,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first move stops after renaming the file and
+	// the second one after deleting the Song.
+	DeletePlaylistSong("Mix", one, true)
+	err = os.Rename(mPoint+artist+"/"+album+"/"+one, mPoint+artist+"/"+other+"/"+one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DeleteSong(artist, album, two, mPoint)
+	CloseDB()
+
+	err = InitDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB()
+
+	if got := direntNames(ListSongs(artist, other)); got != ".description,"+one {
+		t.Errorf("The moved Song was not finished: %s", got)
+	}
+	if got := direntNames(ListSongs(artist, album)); got != ".description,"+two {
+		t.Errorf("The Song that was not moved was not rolled back: %s", got)
+	}
+	file, err := GetPlaylistFile("Mix", one)
+	if err != nil || file.Album != other {
+		t.Errorf("The playlist was not updated: %v %v", file, err)
+	}
+	checkJournal(t)
+}
+
+// TestJournalRetag interrupts a Song that gets new
+// tags in a custom layout and checks that the change
+// is finished when the database is opened again.
+func TestJournalRetag(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+	defer SetLayout("")
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	err := SetLayout("%artist%/%title%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(mPoint, "muli.db")
+	err = InitDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := addLayoutSong(t, mPoint, musicmgr.FileTags{Title: "One", Artist: "Band", Album: "First"})
+	waiting := addLayoutSong(t, mPoint, musicmgr.FileTags{Title: "Two", Artist: "Band", Album: "First"})
+
+	songs, err := layoutSongs([]string{"Band"})
+	if err != nil || len(songs) != 2 {
+		t.Fatal(songs, err)
+	}
+
+	for _, s := range songs {
+		tags := s.tags
+		tags.Title = "New " + tags.Title
+		intent := moveIntent{
+			Kind:       moveRetag,
+			OldArtist:  s.artist,
+			OldAlbum:   s.album,
+			OldName:    s.key,
+			OldPath:    s.song.SongFullPath,
+			NewPath:    LayoutPath(tags, ".mp3", mPoint),
+			MountPoint: mPoint,
+			Song:       s.song,
+			Tags:       tags,
+		}
+		_, err = beginMove(&intent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first Song stops after renaming the file,
+		// the tags of the second one are not written.
+		if s.song.SongFullPath == renamed {
+			err = musicmgr.SetAllTags(tags, renamed)
+			if err == nil {
+				err = os.Rename(renamed, intent.NewPath)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	CloseDB()
+
+	err = InitDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB()
+
+	if got := direntNames(ListLayout([]string{"Band"})); got != "New_One.mp3,New_Two.mp3" {
+		t.Errorf("The Songs were not retagged: %s", got)
+	}
+	if got := direntNames(ListSongs("Band", "First")); got != ".description,New_One.mp3,New_Two.mp3" {
+		t.Errorf("The old Songs were left: %s", got)
+	}
+	if _, err = os.Stat(waiting); !os.IsNotExist(err) {
+		t.Errorf("The file %s was not moved: %v", waiting, err)
+	}
+	checkAlbum(t, mPoint+"Band/New_Two.mp3", "New Two", "First")
+	checkJournal(t)
+}
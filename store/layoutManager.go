@@ -0,0 +1,557 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// DefaultLayout is the layout used when no other one
+// is configured, it matches the Artist and Album
+// Buckets in the database.
+const DefaultLayout = "%artist%/%album%/%title%"
+
+// Names of the root Buckets of the layout index.
+// LayoutIndex has a Key for every Song formed with the
+// names of its directories and file in the layout
+// separated by slashes, a zero byte and the Artist,
+// Album and Song Keys separated by slashes.
+// LayoutSongsIndex maps the Artist, Album and Song Keys
+// to the Key of the Song in LayoutIndex.
+const (
+	LayoutIndex      = "Layout"
+	LayoutSongsIndex = "LayoutSongs"
+)
+
+// layoutKey is the Key in the Meta Bucket where the
+// template used to build the layout index is stored.
+const layoutKey = "layout"
+
+// layout holds the patterns of the directory layout,
+// one for every directory level and one for the
+// Song files.
+// They are nil when the default layout is used.
+var layout struct {
+	template string
+	dirs     []*musicmgr.NamePattern
+	file     *musicmgr.NamePattern
+}
+
+// SetLayout sets the template that generates the
+// directories and file names of the Songs, like
+// "%genre%/%albumartist%/%year% - %album%/%track% %title%".
+// Every slash separates a directory level and the last
+// level is the name of the Song file, without the
+// extension. The fields are the same used by the path
+// patterns.
+// If the database is open the layout index is built
+// again for the new layout.
+func SetLayout(template string) error {
+	layout.template = ""
+	layout.dirs = nil
+	layout.file = nil
+
+	template = strings.Trim(strings.TrimSpace(template), "/")
+	if template == "" || template == DefaultLayout {
+		return syncLayout()
+	}
+
+	levels := strings.Split(template, "/")
+	if len(levels) < 2 {
+		return errors.New("The layout needs at least one directory.")
+	}
+
+	var dirs []*musicmgr.NamePattern
+	for _, level := range levels {
+		p, err := musicmgr.CompileNamePattern(level)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, p)
+	}
+
+	layout.template = template
+	layout.dirs = dirs[:len(dirs)-1]
+	layout.file = dirs[len(dirs)-1]
+	return syncLayout()
+}
+
+// syncLayout builds the layout index again if the
+// database is open.
+func syncLayout() error {
+	if db == nil {
+		return nil
+	}
+	return update(syncLayoutIndex)
+}
+
+// CustomLayout returns true if the Songs are organized
+// with a layout different than the default one.
+func CustomLayout() bool {
+	return layout.file != nil
+}
+
+// LayoutDepth returns the amount of directory levels
+// in the layout.
+func LayoutDepth() int {
+	return len(layout.dirs)
+}
+
+// layoutEscape converts the values used in the layout
+// names, they get the same characters than the rest of
+// the names in MuLi.
+func layoutEscape(value string) string {
+	name := GetCompatibleString(value)
+	if name == "" {
+		name = "unknown"
+	}
+	return name
+}
+
+// layoutNames returns the names of the directories and
+// the file of a Song in the layout.
+func layoutNames(tags musicmgr.FileTags, extension string) []string {
+	names := make([]string, 0, len(layout.dirs)+1)
+	for _, p := range layout.dirs {
+		names = append(names, p.Format(tags, layoutEscape))
+	}
+	return append(names, layout.file.Format(tags, layoutEscape)+extension)
+}
+
+// LayoutPath returns the path where a Song file with
+// the specified tags is stored in the Music Library,
+// using the layout.
+func LayoutPath(tags musicmgr.FileTags, extension, mPoint string) string {
+	names := layoutNames(tags, extension)
+	return filepath.Join(append([]string{mPoint}, names...)...)
+}
+
+// layoutMovePath returns the path of a Song file moved
+// by MoveSongs when a custom layout is used, it is the
+// path of the Song in the layout with the new Artist,
+// Album and name.
+// The directories of the path are created.
+func layoutMovePath(artist, album, key, newArtist, newAlbum, newName, mPoint string) (string, error) {
+	var s storedSong
+	err := view(func(tx *bolt.Tx) error {
+		var err error
+		s, err = loadStoredSong(tx, artist, album, key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	tags := s.tags
+	extension := filepath.Ext(newName)
+	tags.Title = newName[:len(newName)-len(extension)]
+	if newArtist != artist {
+		tags.Artist = newArtist
+	}
+	if newAlbum != album {
+		tags.Album = newAlbum
+	}
+
+	path := LayoutPath(tags, extension, mPoint)
+	return path, os.MkdirAll(filepath.Dir(path), 0777)
+}
+
+// layoutEntry returns the Key of a Song in the
+// LayoutIndex.
+func layoutEntry(names []string, artist, album, key string) []byte {
+	return []byte(strings.Join(names, "/") + "\x00" + string(indexKey(artist, album, key)))
+}
+
+// layoutPrefix returns the prefix of the Keys in the
+// LayoutIndex of the Songs inside the directory or file
+// of the layout specified by the levels.
+func layoutPrefix(levels []string) []byte {
+	if len(levels) == 0 {
+		return nil
+	}
+
+	separator := "/"
+	if len(levels) == len(layout.dirs)+1 {
+		separator = "\x00"
+	}
+	return []byte(strings.Join(levels, "/") + separator)
+}
+
+// indexLayout adds the Song to the layout index, it
+// does nothing when the default layout is used.
+func indexLayout(tx *bolt.Tx, artist, album, key string, song *SongStore) error {
+	if !CustomLayout() {
+		return nil
+	}
+
+	entries, err := tx.CreateBucketIfNotExists([]byte(LayoutIndex))
+	if err != nil {
+		return err
+	}
+
+	songs, err := tx.CreateBucketIfNotExists([]byte(LayoutSongsIndex))
+	if err != nil {
+		return err
+	}
+
+	artistName, albumName := storedNames(tx, artist, album)
+	names := layoutNames(song.fileTags(artistName, albumName), filepath.Ext(key))
+	entry := layoutEntry(names, artist, album, key)
+	err = entries.Put(entry, indexKey(artist, album, key))
+	if err != nil {
+		return err
+	}
+	return songs.Put(indexKey(artist, album, key), entry)
+}
+
+// unindexLayout removes the Song from the layout index.
+func unindexLayout(tx *bolt.Tx, artist, album, key string) error {
+	songs := tx.Bucket([]byte(LayoutSongsIndex))
+	if songs == nil {
+		return nil
+	}
+
+	entry := songs.Get(indexKey(artist, album, key))
+	if entry == nil {
+		return nil
+	}
+
+	if entries := tx.Bucket([]byte(LayoutIndex)); entries != nil {
+		err := entries.Delete(append([]byte{}, entry...))
+		if err != nil {
+			return err
+		}
+	}
+	return songs.Delete(indexKey(artist, album, key))
+}
+
+// syncLayoutIndex builds the layout index again when
+// the layout is not the one it was built with, the
+// template is stored in the Meta Bucket.
+func syncLayoutIndex(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(MetaBucket))
+	if err != nil {
+		return err
+	}
+
+	if string(meta.Get([]byte(layoutKey))) == layout.template {
+		return nil
+	}
+
+	glog.Info("Building the layout index.")
+	for _, name := range []string{LayoutIndex, LayoutSongsIndex} {
+		if tx.Bucket([]byte(name)) == nil {
+			continue
+		}
+		if err = tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	err = forEachSong(tx, indexLayout)
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(layoutKey), []byte(layout.template))
+}
+
+// layoutSongs returns the Songs inside the directory
+// or file of the layout specified by the levels.
+func layoutSongs(levels []string) ([]storedSong, error) {
+	var found []storedSong
+	err := view(func(tx *bolt.Tx) error {
+		entries := tx.Bucket([]byte(LayoutIndex))
+		if entries == nil {
+			return nil
+		}
+
+		prefix := layoutPrefix(levels)
+		c := entries.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			keys := strings.SplitN(string(v), "/", 3)
+			if len(keys) != 3 {
+				continue
+			}
+
+			s, err := loadStoredSong(tx, keys[0], keys[1], keys[2])
+			if err != nil {
+				continue
+			}
+			found = append(found, s)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// ListLayout returns the Dirent for the directories or
+// Song files inside the directory of the layout
+// specified by the levels.
+func ListLayout(levels []string) ([]fuse.Dirent, error) {
+	if len(levels) > len(layout.dirs) {
+		return nil, fuse.ENOENT
+	}
+
+	var a []fuse.Dirent
+	err := view(func(tx *bolt.Tx) error {
+		entries := tx.Bucket([]byte(LayoutIndex))
+		if entries == nil {
+			return nil
+		}
+
+		seen := make(map[string]bool)
+		prefix := layoutPrefix(levels)
+		c := entries.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			name := k[len(prefix):]
+			name = name[:bytes.IndexAny(name, "/\x00")]
+			if seen[string(name)] {
+				continue
+			}
+			seen[string(name)] = true
+
+			var node fuse.Dirent
+			node.Name = string(name)
+			node.Type = fuse.DT_Dir
+			if len(levels) == len(layout.dirs) {
+				node.Type = fuse.DT_File
+			}
+			a = append(a, node)
+		}
+		return nil
+	})
+	return a, err
+}
+
+// layoutEntryKeys returns the Artist, Album and Song
+// Keys of the first Song inside the directory or file
+// of the layout specified by the levels.
+func layoutEntryKeys(levels []string) (string, string, string, error) {
+	var keys []string
+	err := view(func(tx *bolt.Tx) error {
+		entries := tx.Bucket([]byte(LayoutIndex))
+		if entries == nil {
+			return fuse.ENOENT
+		}
+
+		prefix := layoutPrefix(levels)
+		k, v := entries.Cursor().Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return fuse.ENOENT
+		}
+
+		keys = strings.SplitN(string(v), "/", 3)
+		if len(keys) != 3 {
+			return fuse.EIO
+		}
+		return nil
+	})
+
+	if err != nil {
+		return "", "", "", err
+	}
+	return keys[0], keys[1], keys[2], nil
+}
+
+// GetLayoutDir checks that the directory of the layout
+// specified by the levels has Songs inside.
+func GetLayoutDir(levels []string) error {
+	if len(levels) > len(layout.dirs) {
+		return fuse.ENOENT
+	}
+
+	_, _, _, err := layoutEntryKeys(levels)
+	return err
+}
+
+// GetLayoutSong returns the Artist, Album and Song
+// keys in the database of the Song file of the layout
+// specified by the levels, the last level is the name
+// of the file.
+func GetLayoutSong(levels []string) (string, string, string, error) {
+	if len(levels) != len(layout.dirs)+1 {
+		return "", "", "", fuse.ENOENT
+	}
+	return layoutEntryKeys(levels)
+}
+
+// RenameLayout renames a directory or a Song file of
+// the layout. The levels specify the old and the new
+// location, they must be in the same depth. The new
+// names are parsed with the patterns of the layout and
+// the tags of every Song inside are changed to match
+// them, then the Songs are moved to their new path.
+func RenameLayout(oldLevels, newLevels []string, mPoint string) error {
+	if len(oldLevels) != len(newLevels) || len(oldLevels) > len(layout.dirs)+1 {
+		return fuse.EPERM
+	}
+
+	isFile := len(oldLevels) == len(layout.dirs)+1
+	names := append([]string{}, newLevels...)
+	if isFile {
+		last := len(names) - 1
+		extension := filepath.Ext(oldLevels[last])
+		if filepath.Ext(names[last]) != extension {
+			glog.Info("Cannot change the file extension.")
+			return fuse.EPERM
+		}
+		names[last] = names[last][:len(names[last])-len(extension)]
+	}
+
+	songs, err := layoutSongs(oldLevels)
+	if err != nil {
+		return err
+	}
+	if len(songs) == 0 {
+		return fuse.ENOENT
+	}
+
+	// All the names are checked before changing any file,
+	// so a name that does not match the layout leaves the
+	// directory as it was.
+	newTags := make([]musicmgr.FileTags, len(songs))
+	for n, s := range songs {
+		newTags[n] = s.tags
+		for i, name := range names {
+			p := layout.file
+			if i < len(layout.dirs) {
+				p = layout.dirs[i]
+			}
+
+			if !p.Apply(&newTags[n], name, layoutEscape) {
+				glog.Infof("The name %s does not match the layout.\n", name)
+				return fuse.EPERM
+			}
+		}
+	}
+
+	err = layoutTargets(songs, newTags, mPoint)
+	if err != nil {
+		return err
+	}
+
+	for n, s := range songs {
+		err = retagSong(s, newTags[n], mPoint)
+		if err != nil {
+			glog.Infof("Cannot change the tags of %s: %s\n", s.song.SongFullPath, err)
+			return fuse.EIO
+		}
+	}
+	return nil
+}
+
+// checkLayoutTarget returns fuse.EEXIST if a Song file
+// cannot be moved from path to newPath because there
+// is another file there.
+func checkLayoutTarget(path, newPath string) error {
+	if filepath.Clean(path) == filepath.Clean(newPath) {
+		return nil
+	}
+
+	_, err := os.Lstat(newPath)
+	if err == nil {
+		glog.Infof("The file %s already exists.\n", newPath)
+		return fuse.EEXIST
+	}
+	if !os.IsNotExist(err) {
+		glog.Infof("Cannot check the file %s: %s\n", newPath, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// layoutTargets checks that the Songs can be moved to
+// the paths of their new tags in the layout before any
+// of them is changed. It returns fuse.EEXIST when two
+// Songs get the same path or there is another file in
+// one of the paths.
+func layoutTargets(songs []storedSong, tags []musicmgr.FileTags, mPoint string) error {
+	targets := make(map[string]bool)
+	for n, s := range songs {
+		path := s.song.SongFullPath
+		newPath := LayoutPath(tags[n], filepath.Ext(path), mPoint)
+		if targets[newPath] {
+			glog.Infof("Two Songs get the path %s in the layout.\n", newPath)
+			return fuse.EEXIST
+		}
+		targets[newPath] = true
+
+		err := checkLayoutTarget(path, newPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retagSong stores the new tags in the Song file,
+// moves it to the path that matches them in the layout
+// and updates the database.
+// The change is recorded in the journal once the path
+// is checked, it is finished the next time the
+// database is opened if it is interrupted.
+func retagSong(s storedSong, tags musicmgr.FileTags, mPoint string) error {
+	if tags == s.tags {
+		return nil
+	}
+
+	path := s.song.SongFullPath
+	newPath := LayoutPath(tags, filepath.Ext(path), mPoint)
+	err := checkLayoutTarget(path, newPath)
+	if err != nil {
+		return err
+	}
+
+	intent := moveIntent{
+		Kind:       moveRetag,
+		OldArtist:  s.artist,
+		OldAlbum:   s.album,
+		OldName:    s.key,
+		OldPath:    path,
+		NewPath:    newPath,
+		MountPoint: mPoint,
+		Song:       s.song,
+		Tags:       tags,
+	}
+	key, err := beginMove(&intent)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	// Nothing is changed when the tags cannot be written.
+	err = musicmgr.SetAllTags(tags, path)
+	if err != nil {
+		endMove(key)
+		return err
+	}
+
+	err = finishRetag(&intent)
+	if err != nil {
+		return err
+	}
+	endMove(key)
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+)
+
+// addLayoutSong creates a Song file with the tags in
+// its path of the layout and stores it in the database.
+func addLayoutSong(t *testing.T, mPoint string, tags musicmgr.FileTags) string {
+	path := LayoutPath(tags, ".mp3", mPoint)
+	os.MkdirAll(filepath.Dir(path), 0777)
+	err := ioutil.WriteFile(path, []byte("AUDIO"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = musicmgr.SetAllTags(tags, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = StoreNewSong(&tags, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkAlbum fails if the Song file does not have the
+// title and album in its tags.
+func checkAlbum(t *testing.T, path, title, album string) {
+	err, tags := musicmgr.GetTags(path)
+	if err != nil || tags.Title != title || tags.Album != album {
+		t.Errorf("The file %s lost its tags: %v %v", path, tags, err)
+	}
+}
+
+// TestLayoutSamePath checks that a Song is not moved
+// over another file that has the same path in the
+// layout.
+func TestLayoutSamePath(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+	defer SetLayout("")
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	err := SetLayout("%artist%/%title%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InitDB(filepath.Join(mPoint, "muli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB()
+
+	one := addLayoutSong(t, mPoint, musicmgr.FileTags{Title: "One", Artist: "Band", Album: "First"})
+	two := addLayoutSong(t, mPoint, musicmgr.FileTags{Title: "Two", Artist: "Band", Album: "Second"})
+
+	err = RenameLayout([]string{"Band", "Two.mp3"}, []string{"Band", "One.mp3"}, mPoint)
+	if err != fuse.EEXIST {
+		t.Fatalf("Renamed over another Song: %v", err)
+	}
+	checkAlbum(t, one, "One", "First")
+	checkAlbum(t, two, "Two", "Second")
+
+	// A dropped file with the same tags stays in the
+	// drop directory.
+	drop := mPoint + "drop/One.mp3"
+	os.MkdirAll(mPoint+"drop", 0777)
+	err = ioutil.WriteFile(drop, []byte("AUDIO"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = musicmgr.SetAllTags(musicmgr.FileTags{Title: "One", Artist: "Band", Album: "Third"}, drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = HandleDrop(drop, mPoint)
+	if err != fuse.EEXIST {
+		t.Fatalf("Dropped over another Song: %v", err)
+	}
+	checkAlbum(t, one, "One", "First")
+	checkAlbum(t, drop, "One", "Third")
+}
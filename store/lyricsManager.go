@@ -0,0 +1,116 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/json"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// LyricsName returns the name of the virtual lyrics
+// file for a Song, it is the Song name with the .lrc
+// extension so the players find it next to the Song.
+func LyricsName(song string) string {
+	return song[:len(song)-len(filepath.Ext(song))] + ".lrc"
+}
+
+// lyricsSong returns the Song that matches the name of
+// a lyrics file in the Album.
+// It returns a fuse.ENOENT error if there is no Song
+// for the lyrics file.
+func lyricsSong(artist, album, name string) (SongStore, error) {
+	songs, err := albumSongs(artist, album)
+	if err != nil {
+		return SongStore{}, err
+	}
+
+	for _, song := range songs {
+		if LyricsName(song.SongPath) == name {
+			return song, nil
+		}
+	}
+	return SongStore{}, fuse.ENOENT
+}
+
+// HasSongLyrics returns true if the lyrics file
+// belongs to a Song in the Album that has embedded
+// lyrics.
+func HasSongLyrics(artist, album, name string) bool {
+	song, err := lyricsSong(artist, album, name)
+	return err == nil && song.HasLyrics
+}
+
+// GetSongLyrics returns the lyrics embedded in the
+// Song that matches the lyrics file, in LRC format.
+// It returns a fuse.ENOENT error if the Song does not
+// exist or has no lyrics.
+func GetSongLyrics(artist, album, name string) ([]byte, error) {
+	glog.Infof("Getting lyrics %s for Artist: %s Album: %s\n", name, artist, album)
+	song, err := lyricsSong(artist, album, name)
+	if err != nil {
+		return nil, err
+	}
+
+	lyrics, err := musicmgr.GetLyrics(song.SongFullPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(lyrics) == 0 {
+		return nil, fuse.ENOENT
+	}
+	return []byte(lyrics), nil
+}
+
+// SetSongLyrics embeds the lyrics in the Song that
+// matches the lyrics file and updates the database
+// accordingly.
+func SetSongLyrics(artist, album, name string, data []byte) error {
+	glog.Infof("Setting lyrics %s for Artist: %s Album: %s\n", name, artist, album)
+	song, err := lyricsSong(artist, album, name)
+	if err != nil {
+		return err
+	}
+
+	err = musicmgr.SetLyrics(song.SongFullPath, string(data))
+	if err != nil {
+		return err
+	}
+
+	return update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		artistBucket := root.Bucket([]byte(artist))
+		if artistBucket == nil {
+			return fuse.ENOENT
+		}
+		albumBucket := artistBucket.Bucket([]byte(album))
+		if albumBucket == nil {
+			return fuse.ENOENT
+		}
+
+		song.HasLyrics = musicmgr.HasLyrics(song.SongFullPath)
+		encoded, err := json.Marshal(song)
+		if err != nil {
+			return err
+		}
+		return albumBucket.Put([]byte(song.SongPath), encoded)
+	})
+}
@@ -0,0 +1,1071 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
+	"github.com/golang/glog"
+)
+
+// memoryArtist is an Artist kept by the memoryStore
+// with its description and Albums.
+// The description is nil until it is stored, like the
+// ".description" Key of a Bolt Bucket.
+type memoryArtist struct {
+	desc   *ArtistStore
+	albums map[string]*memoryAlbum
+}
+
+// memoryAlbum is an Album kept by the memoryStore
+// with its description and Songs.
+type memoryAlbum struct {
+	desc  *AlbumStore
+	songs map[string]SongStore
+}
+
+// memoryStore is a Store that keeps everything in
+// memory, nothing is written to disk except the files
+// that are moved or deleted.
+// It follows the same rules than the Bolt store so the
+// filesystem and the tools can run on top of it without
+// a database file. The listings are built with the same
+// helpers than the Bolt ones.
+type memoryStore struct {
+	mu        sync.RWMutex
+	artists   map[string]*memoryArtist
+	playlists map[string]map[string]playlistmgr.PlaylistFile
+}
+
+// NewMemoryStore returns an empty Store that keeps the
+// information in memory, it can be used with SetStore.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		artists:   make(map[string]*memoryArtist),
+		playlists: make(map[string]map[string]playlistmgr.PlaylistFile),
+	}
+}
+
+// mountRoot returns the mount point ending with a
+// slash.
+func mountRoot(mPoint string) string {
+	if mPoint[len(mPoint)-1] != '/' {
+		return mPoint + "/"
+	}
+	return mPoint
+}
+
+// copySong returns a copy of the SongStore that does
+// not share the Playlists slice.
+func copySong(song SongStore) SongStore {
+	if song.Playlists != nil {
+		song.Playlists = append([]string{}, song.Playlists...)
+	}
+	return song
+}
+
+// name returns the name of the Artist stored in its
+// description, the key is used when there is none.
+func (a *memoryArtist) name(key string) string {
+	if a.desc == nil || a.desc.ArtistName == "" {
+		return key
+	}
+	return a.desc.ArtistName
+}
+
+// name returns the name of the Album stored in its
+// description, the key is used when there is none.
+func (b *memoryAlbum) name(key string) string {
+	if b.desc == nil || b.desc.AlbumName == "" {
+		return key
+	}
+	return b.desc.AlbumName
+}
+
+// addAlbumName adds the Album to the description of
+// the Artist if it is not there yet.
+func (a *memoryArtist) addAlbumName(album string) {
+	if a.desc == nil {
+		return
+	}
+
+	for _, name := range a.desc.ArtistAlbums {
+		if name == album {
+			return
+		}
+	}
+	a.desc.ArtistAlbums = append(a.desc.ArtistAlbums, album)
+}
+
+// removeAlbumName removes the Album from the
+// description of the Artist.
+func (a *memoryArtist) removeAlbumName(album string) {
+	if a.desc == nil {
+		return
+	}
+
+	for i, name := range a.desc.ArtistAlbums {
+		if name == album {
+			a.desc.ArtistAlbums = append(a.desc.ArtistAlbums[:i], a.desc.ArtistAlbums[i+1:]...)
+			return
+		}
+	}
+}
+
+// descriptionKeys returns the sorted keys with the
+// ".description" Key added when there is a
+// description.
+func descriptionKeys(keys []string, hasDescription bool) []string {
+	if hasDescription {
+		keys = append(keys, ".description")
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+// album returns the Album of an Artist or
+// fuse.ENOENT if any of them does not exist.
+func (m *memoryStore) album(artist, album string) (*memoryAlbum, error) {
+	a, ok := m.artists[artist]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	b, ok := a.albums[album]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return b, nil
+}
+
+// albumSongCopies returns copies of the Songs of the Album
+// with the SongName replaced by their Key, as they are
+// stored in the playlists.
+func albumSongCopies(b *memoryAlbum) []SongStore {
+	var songs []SongStore
+	for _, key := range sortedKeys(b.songs) {
+		song := copySong(b.songs[key])
+		song.SongName = key
+		songs = append(songs, song)
+	}
+	return songs
+}
+
+// removeSongsFromPlaylists removes the deleted songs from
+// their playlists and regenerates the playlist files.
+// It must be called without holding the lock.
+func (m *memoryStore) removeSongsFromPlaylists(songs []SongStore, mPoint string) {
+	for _, v := range songs {
+		for _, list := range v.Playlists {
+			m.DeletePlaylistSong(list, v.SongName, true)
+			m.RegeneratePlaylistFile(list, mPoint)
+		}
+	}
+}
+
+// ListArtists returns the Artists sorted by name.
+func (m *memoryStore) ListArtists() ([]fuse.Dirent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var a []fuse.Dirent
+	for _, k := range sortedKeys(m.artists) {
+		a = append(a, bucketDirent(k, true))
+	}
+	return a, nil
+}
+
+// GetArtistPath checks that the Artist exists.
+func (m *memoryStore) GetArtistPath(artist string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.artists[artist]; !ok {
+		return "", fuse.ENOENT
+	}
+	return artist, nil
+}
+
+// CreateArtist creates a new Artist from a Raw name.
+func (m *memoryStore) CreateArtist(nameRaw string) (string, error) {
+	name := GetCompatibleString(nameRaw)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.artists[name]; ok {
+		return name, fuse.EEXIST
+	}
+
+	m.artists[name] = &memoryArtist{
+		desc: &ArtistStore{
+			ArtistName:   nameRaw,
+			ArtistPath:   name,
+			ArtistAlbums: []string{},
+		},
+		albums: make(map[string]*memoryAlbum),
+	}
+	return name, nil
+}
+
+// DeleteArtist deletes the Artist, removes its songs
+// from the playlists and deletes the song files.
+func (m *memoryStore) DeleteArtist(artist, mPoint string) error {
+	glog.Infof("Deleting Artist: %s\n", artist)
+	m.mu.Lock()
+	a, ok := m.artists[artist]
+	if !ok {
+		m.mu.Unlock()
+		return fuse.ENOENT
+	}
+
+	var songList []SongStore
+	for _, album := range sortedKeys(a.albums) {
+		songList = append(songList, albumSongCopies(a.albums[album])...)
+	}
+	delete(m.artists, artist)
+	m.mu.Unlock()
+
+	m.removeSongsFromPlaylists(songList, mPoint)
+	for _, v := range songList {
+		os.Remove(v.SongFullPath)
+	}
+	return nil
+}
+
+// MoveArtist moves every Album of the Artist into
+// the new Artist, the files are moved as well.
+// It stops on the first Album that cannot be moved and
+// the old Artist is kept.
+func (m *memoryStore) MoveArtist(oldArtist, newArtist, mPoint string) error {
+	glog.Infof("Moving Artist from: %s to  %s\n", oldArtist, newArtist)
+	if len(oldArtist) < 1 || len(newArtist) < 1 {
+		return fuse.EIO
+	}
+
+	newName := GetCompatibleString(newArtist)
+	newPath := mountRoot(mPoint) + newName + "/"
+	src, err := os.Stat(newPath)
+	if err != nil || !src.IsDir() {
+		err := os.Mkdir(newPath, 0777)
+		if err != nil {
+			glog.Infof("Cannot create the new directory: %s.", err)
+			return fuse.EIO
+		}
+	}
+
+	m.mu.Lock()
+	old, ok := m.artists[oldArtist]
+	if !ok {
+		m.mu.Unlock()
+		glog.Info("Source Artist not found.")
+		return errors.New("Artist not found")
+	}
+
+	albums := sortedKeys(old.albums)
+	if _, ok := m.artists[newName]; !ok {
+		m.artists[newName] = &memoryArtist{
+			desc: &ArtistStore{
+				ArtistName:   newArtist,
+				ArtistPath:   newName,
+				ArtistAlbums: []string{},
+			},
+			albums: make(map[string]*memoryAlbum),
+		}
+	}
+	m.mu.Unlock()
+
+	glog.Infof("Moving %d albums.\n", len(albums))
+	for _, element := range albums {
+		err = m.MoveAlbum(oldArtist, element, newName, element, mPoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	delete(m.artists, oldArtist)
+	m.mu.Unlock()
+	return nil
+}
+
+// ListAlbums returns the Albums of the Artist and its
+// description sorted by name.
+func (m *memoryStore) ListAlbums(artist string) ([]fuse.Dirent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.artists[artist]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	var dirents []fuse.Dirent
+	for _, k := range descriptionKeys(sortedKeys(a.albums), a.desc != nil) {
+		_, isAlbum := a.albums[k]
+		dirents = append(dirents, bucketDirent(k, isAlbum))
+	}
+	return dirents, nil
+}
+
+// GetAlbumPath checks that the Artist and Album exist.
+func (m *memoryStore) GetAlbumPath(artist, album string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, err := m.album(artist, album); err != nil {
+		return "", err
+	}
+	return artist, nil
+}
+
+// CreateAlbum creates an Album for the Artist from a
+// Raw name and adds it to the Artist description.
+func (m *memoryStore) CreateAlbum(artist, nameRaw string) (string, error) {
+	name := GetCompatibleString(nameRaw)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.artists[artist]
+	if !ok {
+		return name, fuse.ENOENT
+	}
+
+	if _, ok := a.albums[name]; ok {
+		return name, fuse.EEXIST
+	}
+
+	a.albums[name] = &memoryAlbum{
+		desc:  &AlbumStore{AlbumName: nameRaw, AlbumPath: name},
+		songs: make(map[string]SongStore),
+	}
+	a.addAlbumName(name)
+	return name, nil
+}
+
+// DeleteAlbum deletes the Album, removes its songs
+// from the playlists and deletes the song files.
+func (m *memoryStore) DeleteAlbum(artist, album, mPoint string) error {
+	m.mu.Lock()
+	a, ok := m.artists[artist]
+	if !ok {
+		m.mu.Unlock()
+		return errors.New("Artist not found.")
+	}
+
+	var songList []SongStore
+	if b, ok := a.albums[album]; ok {
+		songList = albumSongCopies(b)
+	}
+	delete(a.albums, album)
+	a.removeAlbumName(album)
+	m.mu.Unlock()
+
+	m.removeSongsFromPlaylists(songList, mPoint)
+	for _, v := range songList {
+		os.Remove(v.SongFullPath)
+	}
+	return nil
+}
+
+// MoveAlbum moves every Song of the Album into the new
+// Album, the files are moved as well.
+// It stops on the first Song that cannot be moved and
+// the old Album is kept.
+func (m *memoryStore) MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
+	glog.Infof("Moving Album from Artist: %s, Album: %s to Artist: %s, Album: %s\n", oldArtist, oldAlbum, newArtist, newAlbum)
+	if len(oldArtist) < 1 || len(newArtist) < 1 || len(oldAlbum) < 1 || len(newAlbum) < 1 {
+		glog.Info("Cannot change Album to Artist.")
+		return fuse.EPERM
+	}
+
+	newName := GetCompatibleString(newAlbum)
+	newPath := mountRoot(mPoint) + newArtist + "/" + newName + "/"
+	src, err := os.Stat(newPath)
+	if err != nil || !src.IsDir() {
+		err := os.Mkdir(newPath, 0777)
+		if err != nil {
+			glog.Infof("Cannot create the new directory: %s.", err)
+			return fuse.EIO
+		}
+	}
+
+	m.mu.Lock()
+	a, ok := m.artists[newArtist]
+	if !ok {
+		m.mu.Unlock()
+		glog.Info("Destination Artist not found.")
+		return errors.New("Artist not found.")
+	}
+
+	old, ok := m.artists[oldArtist]
+	if !ok {
+		m.mu.Unlock()
+		glog.Info("Source Artist not found.")
+		return errors.New("Artist not found")
+	}
+
+	oldAlbumStore, ok := old.albums[oldAlbum]
+	if !ok {
+		m.mu.Unlock()
+		glog.Info("Source Album not found.")
+		return errors.New("Album not found")
+	}
+
+	if _, ok := a.albums[newName]; !ok {
+		a.albums[newName] = &memoryAlbum{
+			desc:  &AlbumStore{AlbumName: newAlbum, AlbumPath: newName},
+			songs: make(map[string]SongStore),
+		}
+	}
+	a.addAlbumName(newName)
+	songs := sortedKeys(oldAlbumStore.songs)
+	m.mu.Unlock()
+
+	glog.Infof("Moving %d songs.\n", len(songs))
+	for _, key := range songs {
+		err = m.moveSong(oldArtist, oldAlbum, key, newArtist, newName, mPoint)
+		if err != nil {
+			glog.Infof("Cannot move the song %s: %s\n", key, err)
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	if old, ok := m.artists[oldArtist]; ok {
+		delete(old.albums, oldAlbum)
+		old.removeAlbumName(oldAlbum)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// moveSong moves a Song file into the directory of the
+// new Album, writes the new tags and moves the Song and
+// its playlist entries.
+func (m *memoryStore) moveSong(oldArtist, oldAlbum, key, newArtist, newAlbum, mPoint string) error {
+	m.mu.RLock()
+	b, err := m.album(oldArtist, oldAlbum)
+	var song SongStore
+	if err == nil {
+		var ok bool
+		if song, ok = b.songs[key]; !ok {
+			err = fuse.ENOENT
+		}
+	}
+
+	var artistName, albumName string
+	if err == nil {
+		var dest *memoryAlbum
+		dest, err = m.album(newArtist, newAlbum)
+		if err == nil {
+			artistName = m.artists[newArtist].name(newArtist)
+			albumName = dest.name(newAlbum)
+		}
+	}
+	m.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	newFullPath := mountRoot(mPoint) + newArtist + "/" + newAlbum + "/" + key
+	err = os.Rename(song.SongFullPath, newFullPath)
+	if err != nil {
+		return err
+	}
+	musicmgr.SetTags(artistName, albumName, song.SongName, newFullPath)
+
+	m.mu.Lock()
+	if b, err := m.album(oldArtist, oldAlbum); err == nil {
+		delete(b.songs, key)
+	}
+
+	song.SongFullPath = newFullPath
+	if dest, err := m.album(newArtist, newAlbum); err == nil {
+		dest.songs[key] = song
+	}
+
+	for _, list := range song.Playlists {
+		if file, ok := m.playlists[list][key]; ok {
+			file.Artist = newArtist
+			file.Album = newAlbum
+			file.Path = newFullPath
+			m.playlists[list][key] = file
+		}
+	}
+	m.mu.Unlock()
+
+	for _, list := range song.Playlists {
+		m.RegeneratePlaylistFile(list, mPoint)
+	}
+	return nil
+}
+
+// WalkAlbums calls fn for every Album with the full
+// paths of its songs, the lock is released before
+// calling fn.
+func (m *memoryStore) WalkAlbums(fn func(artist, album string, paths []string) error) error {
+	type albumPaths struct {
+		artist string
+		album  string
+		paths  []string
+	}
+
+	m.mu.RLock()
+	var albums []albumPaths
+	for _, artist := range sortedKeys(m.artists) {
+		a := m.artists[artist]
+		for _, album := range sortedKeys(a.albums) {
+			b := a.albums[album]
+			paths := []string{}
+			for _, key := range sortedKeys(b.songs) {
+				paths = append(paths, b.songs[key].SongFullPath)
+			}
+			albums = append(albums, albumPaths{artist, album, paths})
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, a := range albums {
+		if err := fn(a.artist, a.album, a.paths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListSongs returns the description, the Songs, their
+// lyrics and the cover files of the Album.
+func (m *memoryStore) ListSongs(artist, album string) ([]fuse.Dirent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, err := m.album(artist, album)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := descriptionKeys(sortedKeys(b.songs), b.desc != nil)
+	return songDirents(keys, b.songs), nil
+}
+
+// GetSong returns the SongStore of the Song.
+func (m *memoryStore) GetSong(artist, album, song string) (SongStore, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, err := m.album(artist, album)
+	if err != nil {
+		return SongStore{}, err
+	}
+
+	s, ok := b.songs[song]
+	if !ok {
+		return SongStore{}, fuse.ENOENT
+	}
+	return copySong(s), nil
+}
+
+// GetFilePath returns the full path to the Song file.
+func (m *memoryStore) GetFilePath(artist, album, song string) (string, error) {
+	s, err := m.GetSong(artist, album, song)
+	if err != nil {
+		return "", err
+	}
+	return s.SongFullPath, nil
+}
+
+// GetSongByPath returns the Artist, Album and Song
+// stored for the file in the specified path.
+func (m *memoryStore) GetSongByPath(path string) (string, string, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.songByPath(path)
+}
+
+// songByPath looks for the Song of the file in the
+// specified path, the caller must hold the lock.
+func (m *memoryStore) songByPath(path string) (string, string, string, error) {
+	path = filepath.Clean(path)
+	for artist, a := range m.artists {
+		for album, b := range a.albums {
+			for key, song := range b.songs {
+				if song.SongFullPath != "" && filepath.Clean(song.SongFullPath) == path {
+					return artist, album, key, nil
+				}
+			}
+		}
+	}
+	return "", "", "", fuse.ENOENT
+}
+
+// StoreNewSong stores the Song from its tags creating
+// the Artist and Album when they do not exist.
+func (m *memoryStore) StoreNewSong(song *musicmgr.FileTags, path string) error {
+	artistPath := GetCompatibleString(song.Artist)
+	albumPath := GetCompatibleString(song.Album)
+	songPath := GetCompatibleString(song.Title)
+
+	var songStore SongStore
+	songStore.SongName = song.Title
+	songStore.SongPath = songPath + filepath.Ext(path)
+	songStore.SongFullPath = path
+	songStore.setTags(song)
+	songStore.setFileInfo(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Remove the previous entry of the file when its
+	// tags placed it in a different Song.
+	oldArtist, oldAlbum, oldSong, err := m.songByPath(path)
+	if err == nil {
+		delete(m.artists[oldArtist].albums[oldAlbum].songs, oldSong)
+	}
+
+	a, ok := m.artists[artistPath]
+	if !ok {
+		a = &memoryArtist{albums: make(map[string]*memoryAlbum)}
+		m.artists[artistPath] = a
+	}
+	if a.desc == nil {
+		a.desc = &ArtistStore{
+			ArtistName:   song.Artist,
+			ArtistPath:   artistPath,
+			ArtistAlbums: []string{},
+		}
+	}
+	a.addAlbumName(albumPath)
+
+	b, ok := a.albums[albumPath]
+	if !ok {
+		b = &memoryAlbum{songs: make(map[string]SongStore)}
+		a.albums[albumPath] = b
+	}
+	b.desc = &AlbumStore{AlbumName: song.Album, AlbumPath: albumPath}
+	b.songs[songStore.SongPath] = songStore
+	return nil
+}
+
+// CreateSong creates a Song in the Artist and Album from
+// a Raw name and the directory where the file is.
+func (m *memoryStore) CreateSong(artist, album, nameRaw, path string) (string, error) {
+	glog.Infof("Adding song to the DB: %s with Artist: %s and Album: %s\n", nameRaw, artist, album)
+	extension := filepath.Ext(nameRaw)
+	if !musicmgr.IsMusicFile(nameRaw) {
+		return "", errors.New("Wrong file format.")
+	}
+
+	nameRaw = nameRaw[:len(nameRaw)-len(extension)]
+	name := GetCompatibleString(nameRaw)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.artists[artist]
+	if !ok {
+		return name + extension, errors.New("Artist not found.")
+	}
+
+	b, ok := a.albums[album]
+	if !ok {
+		return name + extension, errors.New("Album not found.")
+	}
+
+	b.songs[name+extension] = SongStore{
+		SongName:     nameRaw,
+		SongPath:     name + extension,
+		SongFullPath: path + name + extension,
+	}
+	return name + extension, nil
+}
+
+// UpdateSongTags stores the tags read from the song
+// file, the name and paths are not modified.
+func (m *memoryStore) UpdateSongTags(artist, album, song string, tags *musicmgr.FileTags) error {
+	path, err := m.GetFilePath(artist, album, song)
+	if err != nil {
+		return err
+	}
+
+	// Read the song file before taking the lock.
+	var info SongStore
+	info.setFileInfo(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.album(artist, album)
+	if err != nil {
+		return err
+	}
+
+	s, ok := b.songs[song]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	s.setTags(tags)
+	if s.SongFullPath == path {
+		s.copyFileInfo(&info)
+	}
+	b.songs[song] = s
+	return nil
+}
+
+// DeleteSong deletes the Song and removes it from its
+// playlists.
+func (m *memoryStore) DeleteSong(artist, album, song, mPoint string) error {
+	glog.Infof("Deleting song: %s with Artist: %s and Album: %s\n", song, artist, album)
+	if song[0] == '.' {
+		return nil
+	}
+
+	m.mu.Lock()
+	a, ok := m.artists[artist]
+	if !ok {
+		m.mu.Unlock()
+		return errors.New("Artist not found.")
+	}
+
+	b, ok := a.albums[album]
+	if !ok {
+		m.mu.Unlock()
+		return errors.New("Album not found.")
+	}
+
+	songData := copySong(b.songs[song])
+	songData.SongName = song
+	delete(b.songs, song)
+	m.mu.Unlock()
+
+	m.removeSongsFromPlaylists([]SongStore{songData}, mPoint)
+	return nil
+}
+
+// WalkSongs calls fn for every Song with the full path
+// and the stored tags, the lock is released before
+// calling fn.
+func (m *memoryStore) WalkSongs(fn func(path string, tags musicmgr.FileTags) error) error {
+	m.mu.RLock()
+	var songs []storedSong
+	for _, artist := range sortedKeys(m.artists) {
+		a := m.artists[artist]
+		for _, album := range sortedKeys(a.albums) {
+			b := a.albums[album]
+			for _, key := range sortedKeys(b.songs) {
+				song := b.songs[key]
+				songs = append(songs, storedSong{
+					song: song,
+					tags: song.fileTags(a.name(artist), b.name(album)),
+				})
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, s := range songs {
+		if err := fn(s.song.SongFullPath, s.tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDescription returns the description of the Artist,
+// Album or Song as a JSON object.
+func (m *memoryStore) GetDescription(artist, album, name string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.artists[artist]
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	var value interface{}
+	if len(album) < 1 {
+		if name != ".description" || a.desc == nil {
+			return "", fuse.ENOENT
+		}
+		value = a.desc
+	} else {
+		b, ok := a.albums[album]
+		if !ok {
+			return "", fuse.ENOENT
+		}
+
+		if name == ".description" {
+			if b.desc == nil {
+				return "", fuse.ENOENT
+			}
+
+			albumStore := *b.desc
+			albumStore.AlbumDuration = 0
+			for _, song := range b.songs {
+				albumStore.AlbumDuration += song.Duration
+			}
+			value = albumStore
+		} else {
+			song, ok := b.songs[name]
+			if !ok {
+				return "", fuse.ENOENT
+			}
+			value = song
+		}
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded) + "\n", nil
+}
+
+// ListPlaylists returns the playlists sorted by name.
+func (m *memoryStore) ListPlaylists() ([]fuse.Dirent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var a []fuse.Dirent
+	for _, k := range sortedKeys(m.playlists) {
+		a = append(a, bucketDirent(k, true))
+	}
+	return a, nil
+}
+
+// GetPlaylistPath checks that the playlist exists.
+func (m *memoryStore) GetPlaylistPath(playlist string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.playlists[playlist]; !ok {
+		return playlist, errors.New("Playlist not exists.")
+	}
+	return playlist, nil
+}
+
+// GetPlaylistFile returns the PlaylistFile stored for
+// the song in the playlist.
+func (m *memoryStore) GetPlaylistFile(playlist, song string) (playlistmgr.PlaylistFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.playlists[playlist]
+	if !ok {
+		return playlistmgr.PlaylistFile{}, errors.New("Playlist not exists.")
+	}
+
+	file, ok := p[song]
+	if !ok {
+		return playlistmgr.PlaylistFile{}, errors.New("Song not found.")
+	}
+	return file, nil
+}
+
+// ListPlaylistSongs returns the songs of the playlist
+// and the files dropped inside it.
+func (m *memoryStore) ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
+	m.mu.RLock()
+	var a []fuse.Dirent
+	for _, k := range sortedKeys(m.playlists[playlist]) {
+		a = append(a, bucketDirent(k, false))
+	}
+	m.mu.RUnlock()
+
+	return append(a, listPlaylistDrops(playlist, mPoint)...), nil
+}
+
+// CreatePlaylist creates the playlist if it does not
+// exist.
+func (m *memoryStore) CreatePlaylist(name, mPoint string) (string, error) {
+	glog.Infof("Creating Playlist with name: %s\n", name)
+	name = GetCompatibleString(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.playlists[name]; !ok {
+		m.playlists[name] = make(map[string]playlistmgr.PlaylistFile)
+	}
+	return name, nil
+}
+
+// setPlaylistLink replaces the playlist oldName with
+// newName in the song, an empty newName removes it.
+func (m *memoryStore) setPlaylistLink(file playlistmgr.PlaylistFile, oldName, newName string) {
+	b, err := m.album(file.Artist, file.Album)
+	if err != nil {
+		return
+	}
+
+	song, ok := b.songs[file.Title]
+	if !ok {
+		return
+	}
+
+	var lists []string
+	for _, list := range song.Playlists {
+		if list != oldName {
+			lists = append(lists, list)
+		} else if newName != "" {
+			lists = append(lists, newName)
+		}
+	}
+	song.Playlists = lists
+	b.songs[file.Title] = song
+}
+
+// DeletePlaylist deletes the playlist, the links from
+// its songs and the playlist directory.
+func (m *memoryStore) DeletePlaylist(name, mPoint string) error {
+	m.mu.Lock()
+	for _, file := range m.playlists[name] {
+		m.setPlaylistLink(file, name, "")
+	}
+	delete(m.playlists, name)
+	m.mu.Unlock()
+
+	return playlistmgr.DeletePlaylist(name, mPoint)
+}
+
+// RenamePlaylist moves the playlist and changes the
+// links in every song.
+func (m *memoryStore) RenamePlaylist(oldName, newName, mPoint string) (string, error) {
+	glog.Infof("Renaming %s playlist to %s.\n", oldName, newName)
+	newName = GetCompatibleString(newName)
+	m.mu.Lock()
+	old, ok := m.playlists[oldName]
+	if !ok {
+		m.mu.Unlock()
+		return newName, nil
+	}
+
+	p, ok := m.playlists[newName]
+	if !ok {
+		p = make(map[string]playlistmgr.PlaylistFile)
+		m.playlists[newName] = p
+	}
+
+	for k, file := range old {
+		m.setPlaylistLink(file, oldName, newName)
+		p[k] = file
+	}
+	delete(m.playlists, oldName)
+	m.mu.Unlock()
+
+	playlistmgr.MoveRules(oldName, newName, mPoint)
+	playlistmgr.DeletePlaylist(oldName, mPoint)
+	return newName, nil
+}
+
+// AddFileToPlaylist adds the song to the playlist and
+// links the playlist from the song.
+func (m *memoryStore) AddFileToPlaylist(file playlistmgr.PlaylistFile, playlistName string) error {
+	path, err := m.GetFilePath(file.Artist, file.Album, file.Title)
+	if err != nil {
+		return errors.New("Playlist item not found in MuLi.")
+	}
+	file.Path = path
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.playlists[playlistName]
+	if !ok {
+		glog.Errorf("Error opening %s playlist.\n", playlistName)
+		return errors.New("Error opening playlist bucket.")
+	}
+
+	b, err := m.album(file.Artist, file.Album)
+	if err != nil {
+		return errors.New("Error opening album bucket.")
+	}
+
+	song, ok := b.songs[file.Title]
+	if !ok {
+		return errors.New("Error opening song json.")
+	}
+
+	p[file.Title] = file
+	for _, list := range song.Playlists {
+		if list == playlistName {
+			return nil
+		}
+	}
+
+	song.Playlists = append(song.Playlists, playlistName)
+	b.songs[file.Title] = song
+	return nil
+}
+
+// DeletePlaylistSong deletes the song from the
+// playlist, the link from the song is only removed
+// when force is false.
+func (m *memoryStore) DeletePlaylistSong(playlist, name string, force bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.playlists[playlist]
+	if !ok {
+		glog.Infof("Cannot open Playlist: %s\n", playlist)
+		return errors.New("Error opening Playlist bucket.")
+	}
+
+	if file, ok := p[name]; ok && !force {
+		m.setPlaylistLink(file, playlist, "")
+	}
+	delete(p, name)
+	return nil
+}
+
+// RegeneratePlaylistFile writes the playlist file with
+// the songs of the playlist.
+func (m *memoryStore) RegeneratePlaylistFile(name, mPoint string) error {
+	glog.Infof("Regenerating playlist for name: %s\n", name)
+	m.mu.RLock()
+	p, ok := m.playlists[name]
+	if !ok {
+		m.mu.RUnlock()
+		glog.Infof("Playlist %s not exists", name)
+		return errors.New("Playlist not exists.")
+	}
+
+	var a []playlistmgr.PlaylistFile
+	for _, k := range sortedKeys(p) {
+		file := p[k]
+		if artist, ok := m.artists[file.Artist]; ok {
+			if b, ok := artist.albums[file.Album]; ok {
+				if song, ok := b.songs[file.Title]; ok {
+					file.Name = artist.name(file.Artist) + " - " + song.SongName
+					file.Duration = song.Duration
+				}
+			}
+		}
+		a = append(a, file)
+	}
+	m.mu.RUnlock()
+
+	return playlistmgr.RegeneratePlaylistFile(a, name, mPoint)
+}
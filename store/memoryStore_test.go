@@ -0,0 +1,248 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
+)
+
+// direntNames returns the names of the Dirent separated
+// by commas.
+func direntNames(a []fuse.Dirent, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	names := make([]string, len(a))
+	for i, d := range a {
+		names[i] = d.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// tempMount returns a temporary directory used as the
+// mount point, the returned function deletes it.
+func tempMount(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mulistore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir + "/", func() { os.RemoveAll(dir) }
+}
+
+// addTestSong creates the Artist, Album and Song file
+// and stores the Song in the current Store.
+func addTestSong(t *testing.T, mPoint, artist, album, song string) (string, string, string) {
+	artistKey, err := CreateArtist(artist)
+	if err != nil && err != fuse.EEXIST {
+		t.Fatal(err)
+	}
+
+	albumKey, err := CreateAlbum(artistKey, album)
+	if err != nil && err != fuse.EEXIST {
+		t.Fatal(err)
+	}
+
+	dir := mPoint + artistKey + "/" + albumKey + "/"
+	file := GetCompatibleString(strings.TrimSuffix(song, ".mp3")) + ".mp3"
+	os.MkdirAll(dir, 0777)
+	err = ioutil.WriteFile(dir+file, []byte("AUDIO"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	songKey, err := CreateSong(artistKey, albumKey, song, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return artistKey, albumKey, songKey
+}
+
+// storeScenario runs the same operations on the current
+// Store and returns what the filesystem would see after
+// each one of them.
+func storeScenario(t *testing.T, mPoint string) []string {
+	var seen []string
+	artist, album, song := addTestSong(t, mPoint, "The Band", "First Album", "Song One.mp3")
+	addTestSong(t, mPoint, "The Band", "First Album", "Song Two.mp3")
+	seen = append(seen,
+		direntNames(ListArtists()),
+		direntNames(ListAlbums(artist)),
+		direntNames(ListSongs(artist, album)))
+
+	playlist, err := CreatePlaylist("Mix", mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(mPoint+"playlists/"+playlist, 0777)
+	err = AddFileToPlaylist(playlistmgr.PlaylistFile{Title: song, Artist: artist, Album: album}, playlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen = append(seen, direntNames(ListPlaylistSongs(playlist, mPoint)))
+
+	_, err = CreateArtist("Other_Band")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(mPoint+"Other_Band", 0777)
+	err = MoveAlbum(artist, album, "Other_Band", "Second_Album", mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := GetSong("Other_Band", "Second_Album", song)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := GetPlaylistFile(playlist, song)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen = append(seen,
+		direntNames(ListAlbums(artist)),
+		direntNames(ListAlbums("Other_Band")),
+		direntNames(ListSongs("Other_Band", "Second_Album")),
+		strings.TrimPrefix(moved.SongFullPath, mPoint),
+		strings.Join(moved.Playlists, ","),
+		file.Artist+"/"+file.Album+"/"+file.Title)
+
+	err = MoveArtist("Other_Band", "Moved_Band", mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen = append(seen,
+		direntNames(ListArtists()),
+		direntNames(ListAlbums("Moved_Band")),
+		direntNames(ListSongs("Moved_Band", "Second_Album")))
+
+	err = DeleteSong("Moved_Band", "Second_Album", song, mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(seen,
+		direntNames(ListSongs("Moved_Band", "Second_Album")),
+		direntNames(ListPlaylistSongs(playlist, mPoint)))
+}
+
+func TestMemoryStoreMatchesBolt(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	err := InitDB(filepath.Join(mPoint, "muli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bolt := storeScenario(t, mPoint+"bolt/")
+	CloseDB()
+
+	SetStore(NewMemoryStore())
+	memory := storeScenario(t, mPoint+"memory/")
+	if !reflect.DeepEqual(bolt, memory) {
+		t.Errorf("The stores do not match:\nbolt:   %q\nmemory: %q", bolt, memory)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+	SetStore(NewMemoryStore())
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+
+	if _, err := CreateArtist("The Band"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateArtist("The Band"); err != fuse.EEXIST {
+		t.Errorf("Creating an existing Artist returned %v", err)
+	}
+	if _, err := CreateAlbum("Nobody", "Album"); err != fuse.ENOENT {
+		t.Errorf("Creating an Album without Artist returned %v", err)
+	}
+
+	artist, album, song := addTestSong(t, mPoint, "The Band", "First Album", "Song One.mp3")
+	desc, err := GetDescription(artist, "", ".description")
+	if err != nil || !strings.Contains(desc, album) {
+		t.Errorf("Wrong Artist description %q: %v", desc, err)
+	}
+
+	path, err := GetFilePath(artist, album, song)
+	if err != nil || path != mPoint+"The_Band/First_Album/Song_One.mp3" {
+		t.Errorf("Wrong file path %q: %v", path, err)
+	}
+
+	a, b, c, err := GetSongByPath(path)
+	if err != nil || a != artist || b != album || c != song {
+		t.Errorf("Wrong Song for %s: %s/%s/%s %v", path, a, b, c, err)
+	}
+
+	if _, err = GetSong(artist, album, "Missing.mp3"); err != fuse.ENOENT {
+		t.Errorf("Getting a missing Song returned %v", err)
+	}
+
+	err = DeleteAlbum(artist, album, mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := direntNames(ListAlbums(artist)); got != ".description" {
+		t.Errorf("The Album was not deleted: %s", got)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("The Song file was not deleted: %v", err)
+	}
+}
+
+func TestMemoryStoreMoveAlbum(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+
+	// The moves must not use the current Store.
+	m := NewMemoryStore()
+	SetStore(m)
+	mPoint, remove := tempMount(t)
+	defer remove()
+	artist, album, song := addTestSong(t, mPoint, "The Band", "First Album", "Song One.mp3")
+	m.CreateArtist("Other Band")
+	os.Mkdir(mPoint+"Other_Band", 0777)
+	SetStore(NewMemoryStore())
+
+	err := m.MoveAlbum(artist, album, "Other_Band", "Second_Album", mPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := direntNames(m.ListSongs("Other_Band", "Second_Album")); got != ".description,"+song {
+		t.Errorf("The Song was not moved: %s", got)
+	}
+	if _, err = m.GetAlbumPath(artist, album); err != fuse.ENOENT {
+		t.Errorf("The old Album was not deleted: %v", err)
+	}
+	if _, err = os.Stat(mPoint + "Other_Band/Second_Album/" + song); err != nil {
+		t.Errorf("The Song file was not moved: %v", err)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/dankomiocevic/mulifs/musicmgr"
-	"github.com/dankomiocevic/mulifs/playlistmgr"
 	"os"
 	"path/filepath"
 
@@ -36,12 +35,17 @@ import (
 // and updates the tags to match the new location.
 // It also moves the actual file into the new
 // location.
+// The move is recorded in the journal before it
+// starts, if it is interrupted before the file is
+// renamed it is rolled back and if not it is finished
+// the next time the database is opened. The move stays
+// in the journal when it fails.
 func MoveSongs(oldArtist, oldAlbum, oldName, newArtist, newAlbum, newName, path, mPoint string) (string, error) {
 	glog.Infof("Moving song from Artist: %s, Album: %s, name: %s and path: %s to Artist: %s, Album: %s, name: %s\n", oldArtist, oldAlbum, oldName, path, newArtist, newAlbum, newName)
 
 	// Check file extension.
 	extension := filepath.Ext(path)
-	if extension != ".mp3" {
+	if !musicmgr.IsMusicFile(path) {
 		glog.Info("Wrong file format.")
 		return "", errors.New("Wrong file format.")
 	}
@@ -58,6 +62,36 @@ func MoveSongs(oldArtist, oldAlbum, oldName, newArtist, newAlbum, newName, path,
 	songStore, err := GetSong(oldArtist, oldAlbum, oldName)
 	if err != nil {
 		glog.Infof("Cannot get the file from the database: %s\n", err)
+		return "", err
+	}
+
+	// With a custom layout the file is moved to the path
+	// of its new tags in the layout.
+	if CustomLayout() {
+		newFullPath, err = layoutMovePath(oldArtist, oldAlbum, oldName, newArtist, newAlbum, newName, mPoint)
+		if err != nil {
+			glog.Infof("Cannot get the path in the layout: %s\n", err)
+			return "", err
+		}
+	}
+
+	// Record the move before changing anything.
+	intent := moveIntent{
+		Kind:       moveSong,
+		OldArtist:  oldArtist,
+		OldAlbum:   oldAlbum,
+		OldName:    oldName,
+		NewArtist:  newArtist,
+		NewAlbum:   newAlbum,
+		NewName:    newName,
+		OldPath:    path,
+		NewPath:    newFullPath,
+		MountPoint: mPoint,
+		Song:       songStore,
+	}
+	key, err := beginMove(&intent)
+	if err != nil {
+		return "", fuse.EIO
 	}
 
 	// Delete the song from all the playlists
@@ -65,42 +99,25 @@ func MoveSongs(oldArtist, oldAlbum, oldName, newArtist, newAlbum, newName, path,
 		DeletePlaylistSong(pl, oldName, true)
 	}
 
-	// Rename the file
+	// Rename the file, once it is renamed the move
+	// is always finished.
 	err = os.Rename(path, newFullPath)
 	if err != nil {
 		glog.Infof("Cannot rename the file: %s\n", err)
+		rollbackErr := rollbackSongMove(&intent)
+		if rollbackErr != nil {
+			glog.Errorf("Cannot roll back the move: %s\n", rollbackErr)
+		} else {
+			endMove(key)
+		}
 		return "", err
 	}
 
-	// Delete the song from the database
-	err = DeleteSong(oldArtist, oldAlbum, oldName, mPoint)
-	if err != nil {
-		glog.Infof("Cannot delete song: %s\n", err)
-		return "", err
-	}
-
-	// Change the tags in the file.
-	musicmgr.SetMp3Tags(newArtist, newAlbum, newName, newFullPath)
-	// Add the song again to the database.
-	_, err = CreateSong(newArtist, newAlbum, newName, newPath)
+	newFileName, err = finishSongMove(&intent)
 	if err != nil {
-		glog.Infof("Cannot create song in the db: %s\n", err)
 		return "", err
 	}
-
-	// Add the song to all the playlists.
-	for _, pl := range songStore.Playlists {
-		file := playlistmgr.PlaylistFile{
-			Title:  newName,
-			Artist: newArtist,
-			Album:  newAlbum,
-			Path:   newPath,
-		}
-
-		AddFileToPlaylist(file, pl)
-		RegeneratePlaylistFile(pl, mPoint)
-	}
-
+	endMove(key)
 	return newFileName, nil
 }
 
@@ -110,17 +127,10 @@ func MoveSongs(oldArtist, oldAlbum, oldName, newArtist, newAlbum, newName, path,
 func processNewArtist(newArtist, oldArtist string) ([]string, error) {
 	var albums []string
 
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		glog.Error("Error opening the database.")
-		return nil, err
-	}
-	defer db.Close()
-
 	newArtistRaw := newArtist
 	newArtist = GetCompatibleString(newArtist)
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 
 		// Get oldArtist Bucket
@@ -186,17 +196,10 @@ func processNewArtist(newArtist, oldArtist string) ([]string, error) {
 func processNewAlbum(newArtist, newAlbum, oldArtist, oldAlbum string) ([][]byte, error) {
 	var songs [][]byte
 
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		glog.Error("Error opening the database.")
-		return nil, err
-	}
-	defer db.Close()
-
 	newAlbumRaw := newAlbum
 	newAlbum = GetCompatibleString(newAlbum)
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(newArtist))
 		if artistBucket == nil {
@@ -314,7 +317,17 @@ func processNewAlbum(newArtist, newAlbum, oldArtist, oldAlbum string) ([][]byte,
 // and updates the tags to match the new location
 // on every song inside the album.
 // It also moves the actual files into the new location.
-func MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
+// The move is recorded in the journal and it is run
+// again if it is interrupted or if a Song cannot be
+// moved.
+func (boltStore) MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
+	return moveAlbumSongs(oldArtist, oldAlbum, newArtist, newAlbum, mPoint, true)
+}
+
+// moveAlbumSongs moves the Album, it is only recorded
+// in the journal if journal is true, the journal uses
+// it to run a move again without recording it twice.
+func moveAlbumSongs(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string, journal bool) error {
 	glog.Infof("Moving Album from Artist: %s, Album: %s to Artist: %s, Album: %s\n", oldArtist, oldAlbum, newArtist, newAlbum)
 
 	// Check that the file is being moved in the same level
@@ -345,9 +358,26 @@ func MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
 		}
 	}
 
+	var key []byte
+	if journal {
+		key, err = beginMove(&moveIntent{
+			Kind:       moveAlbum,
+			OldArtist:  oldArtist,
+			OldAlbum:   oldAlbum,
+			NewArtist:  newArtist,
+			NewAlbum:   newAlbum,
+			MountPoint: mPoint,
+		})
+		if err != nil {
+			return fuse.EIO
+		}
+	}
+
 	var songs [][]byte
 	songs, err = processNewAlbum(newArtist, newAlbum, oldArtist, oldAlbum)
 	if err != nil {
+		// Nothing was changed yet.
+		endMove(key)
 		return err
 	}
 
@@ -360,23 +390,24 @@ func MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
 			glog.Info("Cannot unmarshall JSON")
 			continue
 		}
-		MoveSongs(oldArtist, oldAlbum, song.SongPath, newArtist, newAlbum, song.SongPath, song.SongFullPath, mPoint)
-	}
-
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		glog.Error("Error opening the database.")
-		return err
+		_, err = MoveSongs(oldArtist, oldAlbum, song.SongPath, newArtist, newAlbum, song.SongPath, song.SongFullPath, mPoint)
+		if err != nil {
+			glog.Infof("Cannot move the song %s: %s\n", song.SongPath, err)
+			return err
+		}
 	}
-	defer db.Close()
 
 	// Finally delete the old Artist bucket
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(oldArtist))
 		if artistBucket == nil {
 			return errors.New("Artist not found.")
 		}
+		err = unindexAlbum(tx, artistBucket, oldArtist, oldAlbum)
+		if err != nil {
+			return err
+		}
 		err = artistBucket.DeleteBucket([]byte(oldAlbum))
 		return err
 	})
@@ -384,6 +415,7 @@ func MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
 	if err != nil {
 		return fuse.EIO
 	}
+	endMove(key)
 	return nil
 }
 
@@ -392,7 +424,18 @@ func MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
 // and updates the tags to match the new location
 // on every song inside every album.
 // It also moves the actual files into the new location.
-func MoveArtist(oldArtist, newArtist, mPoint string) error {
+// The move is recorded in the journal and it is run
+// again if it is interrupted or if an Album cannot be
+// moved.
+func (boltStore) MoveArtist(oldArtist, newArtist, mPoint string) error {
+	return moveArtistAlbums(oldArtist, newArtist, mPoint, true)
+}
+
+// moveArtistAlbums moves the Artist, it is only
+// recorded in the journal if journal is true, the
+// journal uses it to run a move again without
+// recording it twice.
+func moveArtistAlbums(oldArtist, newArtist, mPoint string, journal bool) error {
 	glog.Infof("Moving Artist from: %s to  %s\n", oldArtist, newArtist)
 
 	// Check that all the information is ready
@@ -416,28 +459,44 @@ func MoveArtist(oldArtist, newArtist, mPoint string) error {
 		}
 	}
 
+	var key []byte
+	if journal {
+		key, err = beginMove(&moveIntent{
+			Kind:       moveArtist,
+			OldArtist:  oldArtist,
+			NewArtist:  newArtist,
+			MountPoint: mPoint,
+		})
+		if err != nil {
+			return fuse.EIO
+		}
+	}
+
 	var albums []string
 	albums, err = processNewArtist(newArtist, oldArtist)
 	if err != nil {
+		// Nothing was changed yet.
+		endMove(key)
 		return err
 	}
 
 	glog.Infof("Moving %d albums.\n", len(albums))
 	// Move all the songs inside the Album
 	for _, element := range albums {
-		MoveAlbum(oldArtist, element, newArtist, element, mPoint)
-	}
-
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		glog.Error("Error opening the database.")
-		return err
+		err = moveAlbumSongs(oldArtist, element, newArtist, element, mPoint, journal)
+		if err != nil {
+			glog.Infof("Cannot move the album %s: %s\n", element, err)
+			return err
+		}
 	}
-	defer db.Close()
 
 	// Finally delete the old Album bucket
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
+		err = unindexArtist(tx, root, oldArtist)
+		if err != nil {
+			return err
+		}
 		err = root.DeleteBucket([]byte(oldArtist))
 		return err
 	})
@@ -445,5 +504,6 @@ func MoveArtist(oldArtist, newArtist, mPoint string) error {
 	if err != nil {
 		return fuse.EIO
 	}
+	endMove(key)
 	return nil
 }
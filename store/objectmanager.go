@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 	"unicode"
 
 	"bazil.org/fuse"
@@ -42,6 +43,43 @@ var config struct {
 	DbPath string
 }
 
+// db is the database shared by all the functions in the
+// store, it is opened by InitDB and stays open until
+// CloseDB is called.
+// The lookups use read transactions that can run at
+// the same time, only the changes are serialized.
+var db *bolt.DB
+
+// openTimeout is the time to wait for the lock of a
+// database that is being used by another process.
+const openTimeout = 5 * time.Second
+
+// ErrNoDatabase is returned by the functions that need
+// the database when it was not opened with InitDB, for
+// example when the store uses a memory backend.
+var ErrNoDatabase = errors.New("The database is not open.")
+
+// view runs a read transaction on the shared database.
+func view(fn func(*bolt.Tx) error) error {
+	if db == nil {
+		return ErrNoDatabase
+	}
+	return db.View(fn)
+}
+
+// update runs a read-write transaction on the shared
+// database.
+func update(fn func(*bolt.Tx) error) error {
+	if db == nil {
+		return ErrNoDatabase
+	}
+	return db.Update(fn)
+}
+
+// boltStore is the Store backed by the shared Bolt
+// database, it is the one used after InitDB.
+type boltStore struct{}
+
 // ArtistStore is the information for a specific artist
 // to be stored in the database.
 type ArtistStore struct {
@@ -52,59 +90,230 @@ type ArtistStore struct {
 
 // AlbumStore is the information for a specific album
 // to be stored in the database.
+// AlbumDuration is the length of all the songs in
+// seconds, it is calculated every time the description
+// is generated.
 type AlbumStore struct {
-	AlbumName string
-	AlbumPath string
+	AlbumName     string
+	AlbumPath     string
+	AlbumDuration int
 }
 
 // SongStore is the information for a specific song
 // to be stored in the database.
+// It also keeps the tags read from the song file that
+// are not used to build the directory structure and
+// the properties of the audio stream, Duration is in
+// seconds and Bitrate in kbps.
 type SongStore struct {
 	SongName     string
 	SongPath     string
 	SongFullPath string
 	Playlists    []string
+	AlbumArtist  string
+	Composer     string
+	Genre        string
+	Year         int
+	Track        int
+	TrackTotal   int
+	Disc         int
+	DiscTotal    int
+	HasCover     bool
+	HasLyrics    bool
+	Duration     int
+	Bitrate      int
+	SampleRate   int
+	ChannelMode  string
+	VBR          bool
+}
+
+// setTags copies the tags that are not part of the
+// directory structure from the song file tags.
+func (s *SongStore) setTags(tags *musicmgr.FileTags) {
+	s.AlbumArtist = tags.AlbumArtist
+	s.Composer = tags.Composer
+	s.Genre = tags.Genre
+	s.Year = tags.Year
+	s.Track = tags.Track
+	s.TrackTotal = tags.TrackTotal
+	s.Disc = tags.Disc
+	s.DiscTotal = tags.DiscTotal
+}
+
+// fileTags returns the tags of the song file as they
+// are stored in the database, the Artist and Album
+// names come from their descriptions.
+func (s *SongStore) fileTags(artist, album string) musicmgr.FileTags {
+	return musicmgr.FileTags{
+		Title:       s.SongName,
+		Artist:      artist,
+		Album:       album,
+		AlbumArtist: s.AlbumArtist,
+		Composer:    s.Composer,
+		Genre:       s.Genre,
+		Year:        s.Year,
+		Track:       s.Track,
+		TrackTotal:  s.TrackTotal,
+		Disc:        s.Disc,
+		DiscTotal:   s.DiscTotal,
+	}
+}
+
+// setFileInfo reads the information that does not come
+// from the tags directly from the song file, like the
+// embedded cover, the lyrics and the audio properties.
+func (s *SongStore) setFileInfo(path string) {
+	s.HasCover = musicmgr.HasCover(path)
+	s.HasLyrics = musicmgr.HasLyrics(path)
+
+	info, err := musicmgr.GetAudioInfo(path)
+	if err != nil {
+		return
+	}
+	s.Duration = int(info.Duration.Seconds() + 0.5)
+	s.Bitrate = info.Bitrate
+	s.SampleRate = info.SampleRate
+	s.ChannelMode = info.ChannelMode
+	s.VBR = info.VBR
 }
 
-// InitDB initializes the database with the
-// specified configuration and returns nil if
-// there was no problem.
+// copyFileInfo copies the information read by
+// setFileInfo from another Song, it is used to read
+// the song file before the transaction starts.
+func (s *SongStore) copyFileInfo(info *SongStore) {
+	s.HasCover = info.HasCover
+	s.HasLyrics = info.HasLyrics
+	s.Duration = info.Duration
+	s.Bitrate = info.Bitrate
+	s.SampleRate = info.SampleRate
+	s.ChannelMode = info.ChannelMode
+	s.VBR = info.VBR
+}
+
+// InitDB opens the database with the specified
+// configuration and returns nil if there was no
+// problem.
+// The database stays open until CloseDB is called,
+// calling InitDB again closes the previous one.
+// The databases created by older versions of MuLi are
+// upgraded to the current schema version.
 func InitDB(path string) error {
-	db, err := bolt.Open(path, 0600, nil)
+	if err := CloseDB(); err != nil {
+		return err
+	}
+
+	opened, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
 	if err != nil {
+		if err == bolt.ErrTimeout {
+			return errors.New("The database is being used by another process.")
+		}
 		return err
 	}
-	defer db.Close()
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = opened.Update(func(tx *bolt.Tx) error {
+		// A new database is created with the current
+		// schema version, it needs no migrations.
+		if tx.Bucket([]byte("Artists")) == nil {
+			err = writeSchemaVersion(tx, SchemaVersion())
+			if err != nil {
+				glog.Errorf("Error storing the schema version: %s", err)
+				return err
+			}
+		}
+
 		_, err = tx.CreateBucketIfNotExists([]byte("Artists"))
 		if err != nil {
 			glog.Errorf("Error creating bucket: %s", err)
 			return fmt.Errorf("Error creating bucket: %s", err)
 		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte("Backups"))
+		if err != nil {
+			glog.Errorf("Error creating bucket: %s", err)
+			return fmt.Errorf("Error creating bucket: %s", err)
+		}
 		return nil
 	})
 
+	if err == nil {
+		err = migrateDB(opened, path)
+	}
+
+	if err == nil {
+		err = opened.Update(syncLayoutIndex)
+	}
+
 	if err != nil {
+		opened.Close()
 		return err
 	}
 
+	db = opened
 	config.DbPath = path
+	// Keep the original tags before they are modified.
+	musicmgr.SetBackupFunc(storeBackup)
+	// Settle the moves interrupted by a crash.
+	recoverMoves()
 	return nil
 }
 
+// CloseDB closes the database opened by InitDB.
+func CloseDB() error {
+	if db == nil {
+		return nil
+	}
+
+	err := db.Close()
+	db = nil
+	return err
+}
+
 // isMn checks if the rune is in the Unicode
 // category Mn.
 func isMn(r rune) bool {
 	return unicode.Is(unicode.Mn, r)
 }
 
+// cyrillicLatin maps the Cyrillic capital letters to
+// their Latin transliteration.
+var cyrillicLatin = map[rune]string{
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Ґ': "G", 'Д': "D",
+	'Е': "E", 'Ё': "Yo", 'Є': "Ye", 'Ж': "Zh", 'З': "Z", 'И': "I",
+	'І': "I", 'Ї': "Yi", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M",
+	'Н': "N", 'О': "O", 'П': "P", 'Р': "R", 'С': "S", 'Т': "T",
+	'У': "U", 'Ў': "U", 'Ф': "F", 'Х': "Kh", 'Ц': "Ts", 'Ч': "Ch",
+	'Ш': "Sh", 'Щ': "Shch", 'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E",
+	'Ю': "Yu", 'Я': "Ya",
+}
+
+// transliterate replaces the Cyrillic letters with
+// Latin ones, otherwise they would be removed with the
+// rest of the special characters.
+func transliterate(name string) string {
+	result := make([]rune, 0, len(name))
+	for _, r := range name {
+		latin, ok := cyrillicLatin[unicode.ToUpper(r)]
+		if !ok {
+			result = append(result, r)
+			continue
+		}
+
+		if unicode.IsLower(r) {
+			latin = strings.ToLower(latin)
+		}
+		result = append(result, []rune(latin)...)
+	}
+	return string(result)
+}
+
 // GetCompatibleString removes all the special characters
 // from the string name to create a new string compatible
 // with different file names.
 func GetCompatibleString(name string) string {
 	// Replace all the & signs with and text
 	name = strings.Replace(name, "&", "and", -1)
+	// Write the Cyrillic names with Latin letters
+	name = transliterate(name)
 	// Change all the characters to ASCII
 	t := transform.Chain(norm.NFD, transform.RemoveFunc(isMn), norm.NFC)
 	result, _, _ := transform.String(t, name)
@@ -122,18 +331,16 @@ func GetCompatibleString(name string) string {
 // database accordingly. It checks the different fields
 // and completes the missing information with the default
 // data.
-func StoreNewSong(song *musicmgr.FileTags, path string) error {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
+func (boltStore) StoreNewSong(song *musicmgr.FileTags, path string) error {
 	var artistStore ArtistStore
 	var albumStore AlbumStore
 	var songStore SongStore
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	// Read the song file before the transaction starts.
+	var info SongStore
+	info.setFileInfo(path)
+
+	return update(func(tx *bolt.Tx) error {
 		// Get the artists bucket
 		artistsBucket, updateError := tx.CreateBucketIfNotExists([]byte("Artists"))
 		if updateError != nil {
@@ -208,17 +415,27 @@ func StoreNewSong(song *musicmgr.FileTags, path string) error {
 		songStore.SongName = song.Title
 		songStore.SongPath = songPath + extension
 		songStore.SongFullPath = path
-
-		encoded, err = json.Marshal(songStore)
-		if err != nil {
-			return err
+		songStore.setTags(song)
+		songStore.copyFileInfo(&info)
+
+		// Remove the previous entry of the file when its
+		// tags placed it in a different Song.
+		oldArtist, oldAlbum, oldSong, err := songByPath(tx, path)
+		if err == nil && (oldArtist != artistPath || oldAlbum != albumPath || oldSong != songStore.SongPath) {
+			oldArtistBucket := artistsBucket.Bucket([]byte(oldArtist))
+			if oldArtistBucket != nil {
+				oldAlbumBucket := oldArtistBucket.Bucket([]byte(oldAlbum))
+				if oldAlbumBucket != nil {
+					err = removeSong(tx, oldAlbumBucket, oldArtist, oldAlbum, oldSong)
+					if err != nil {
+						return err
+					}
+				}
+			}
 		}
 
-		albumBucket.Put([]byte(songPath+extension), encoded)
-		return nil
+		return putSong(tx, albumBucket, artistPath, albumPath, songStore.SongPath, &songStore)
 	})
-
-	return nil
 }
 
 // ListArtists returns all the Dirent corresponding
@@ -228,29 +445,13 @@ func StoreNewSong(song *musicmgr.FileTags, path string) error {
 // It returns nil in the second return value if there
 // was no error and nil if the Artists were
 // obtained correctly.
-func ListArtists() ([]fuse.Dirent, error) {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
+func (boltStore) ListArtists() ([]fuse.Dirent, error) {
 	var a []fuse.Dirent
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Artists"))
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			if v == nil {
-				var node fuse.Dirent
-				node.Name = string(k)
-				node.Type = fuse.DT_Dir
-				a = append(a, node)
-			} else {
-				var node fuse.Dirent
-				node.Name = string(k)
-				node.Type = fuse.DT_File
-				a = append(a, node)
-			}
+			a = append(a, bucketDirent(string(k), v == nil))
 		}
 		return nil
 	})
@@ -269,30 +470,14 @@ func ListArtists() ([]fuse.Dirent, error) {
 // It returns nil in the second return value if there
 // was no error and nil if the Albums were
 // obtained correctly.
-func ListAlbums(artist string) ([]fuse.Dirent, error) {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
+func (boltStore) ListAlbums(artist string) ([]fuse.Dirent, error) {
 	var a []fuse.Dirent
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		b := root.Bucket([]byte(artist))
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			if v == nil {
-				var node fuse.Dirent
-				node.Name = string(k)
-				node.Type = fuse.DT_Dir
-				a = append(a, node)
-			} else {
-				var node fuse.Dirent
-				node.Name = string(k)
-				node.Type = fuse.DT_File
-				a = append(a, node)
-			}
+			a = append(a, bucketDirent(string(k), v == nil))
 		}
 		return nil
 	})
@@ -312,19 +497,15 @@ func ListAlbums(artist string) ([]fuse.Dirent, error) {
 // It returns nil in the second return value if there
 // was no error and nil if the Songs were
 // obtained correctly.
-func ListSongs(artist string, album string) ([]fuse.Dirent, error) {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
+func (boltStore) ListSongs(artist string, album string) ([]fuse.Dirent, error) {
 	var a []fuse.Dirent
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 		b := artistBucket.Bucket([]byte(album))
 		c := b.Cursor()
+		var keys []string
+		songs := make(map[string]SongStore)
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			var song SongStore
 			if k[0] != '.' || string(k) == ".description" {
@@ -333,11 +514,11 @@ func ListSongs(artist string, album string) ([]fuse.Dirent, error) {
 					continue
 				}
 			}
-			var node fuse.Dirent
-			node.Name = string(k)
-			node.Type = fuse.DT_File
-			a = append(a, node)
+			keys = append(keys, string(k))
+			songs[string(k)] = song
 		}
+
+		a = songDirents(keys, songs)
 		return nil
 	})
 
@@ -348,18 +529,203 @@ func ListSongs(artist string, album string) ([]fuse.Dirent, error) {
 	return a, nil
 }
 
+// WalkAlbums calls fn for every Album in the database
+// with the full paths of the songs it contains.
+// The transaction is finished before calling fn so it can
+// use the rest of the store functions.
+// It stops on the first error returned by fn.
+func (boltStore) WalkAlbums(fn func(artist, album string, paths []string) error) error {
+	var albums [][2]string
+	err := view(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		if root == nil {
+			return nil
+		}
+
+		c := root.Cursor()
+		for artist, v := c.First(); artist != nil; artist, v = c.Next() {
+			if v != nil {
+				continue
+			}
+
+			ac := root.Bucket(artist).Cursor()
+			for album, v := ac.First(); album != nil; album, v = ac.Next() {
+				if v == nil {
+					albums = append(albums, [2]string{string(artist), string(album)})
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, a := range albums {
+		songs, err := albumSongs(a[0], a[1])
+		if err != nil {
+			return err
+		}
+
+		paths := make([]string, len(songs))
+		for i, song := range songs {
+			paths[i] = song.SongFullPath
+		}
+
+		if err = fn(a[0], a[1], paths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedSong is a Song found in the database along
+// with the keys of its Artist, Album and Song and the
+// tags stored for it.
+type storedSong struct {
+	artist string
+	album  string
+	key    string
+	song   SongStore
+	tags   musicmgr.FileTags
+}
+
+// allSongs returns all the Songs in the database.
+func allSongs() ([]storedSong, error) {
+	var songs []storedSong
+	err := view(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(artist, v []byte) error {
+			artistBucket := root.Bucket(artist)
+			if v != nil || artistBucket == nil {
+				return nil
+			}
+
+			var artistStore ArtistStore
+			json.Unmarshal(artistBucket.Get([]byte(".description")), &artistStore)
+			if artistStore.ArtistName == "" {
+				artistStore.ArtistName = string(artist)
+			}
+
+			return artistBucket.ForEach(func(album, v []byte) error {
+				albumBucket := artistBucket.Bucket(album)
+				if v != nil || albumBucket == nil {
+					return nil
+				}
+
+				var albumStore AlbumStore
+				json.Unmarshal(albumBucket.Get([]byte(".description")), &albumStore)
+				if albumStore.AlbumName == "" {
+					albumStore.AlbumName = string(album)
+				}
+
+				return albumBucket.ForEach(func(k, v []byte) error {
+					if k[0] == '.' {
+						return nil
+					}
+
+					var song SongStore
+					if json.Unmarshal(v, &song) != nil {
+						return nil
+					}
+					songs = append(songs, storedSong{
+						artist: string(artist),
+						album:  string(album),
+						key:    string(k),
+						song:   song,
+						tags:   song.fileTags(artistStore.ArtistName, albumStore.AlbumName),
+					})
+					return nil
+				})
+			})
+		})
+	})
+	return songs, err
+}
+
+// storedNames returns the names of the Artist and the
+// Album stored in their descriptions, the Keys are
+// used when the descriptions are missing.
+func storedNames(tx *bolt.Tx, artist, album string) (string, string) {
+	artistName, albumName := artist, album
+	root := tx.Bucket([]byte("Artists"))
+	if root == nil {
+		return artistName, albumName
+	}
+
+	artistBucket := root.Bucket([]byte(artist))
+	if artistBucket == nil {
+		return artistName, albumName
+	}
+
+	var artistStore ArtistStore
+	json.Unmarshal(artistBucket.Get([]byte(".description")), &artistStore)
+	if artistStore.ArtistName != "" {
+		artistName = artistStore.ArtistName
+	}
+
+	albumBucket := artistBucket.Bucket([]byte(album))
+	if albumBucket == nil {
+		return artistName, albumName
+	}
+
+	var albumStore AlbumStore
+	json.Unmarshal(albumBucket.Get([]byte(".description")), &albumStore)
+	if albumStore.AlbumName != "" {
+		albumName = albumStore.AlbumName
+	}
+	return artistName, albumName
+}
+
+// loadStoredSong returns the Song stored with the
+// Artist, Album and Song Keys, as allSongs does.
+func loadStoredSong(tx *bolt.Tx, artist, album, key string) (storedSong, error) {
+	song, err := getSong(tx, artist, album, key)
+	if err != nil {
+		return storedSong{}, err
+	}
+
+	artistName, albumName := storedNames(tx, artist, album)
+	return storedSong{
+		artist: artist,
+		album:  album,
+		key:    key,
+		song:   song,
+		tags:   song.fileTags(artistName, albumName),
+	}, nil
+}
+
+// WalkSongs calls fn for every Song in the database
+// with the full path of the file and the tags stored
+// for it in the database.
+// The transaction is finished before calling fn so it can
+// use the rest of the store functions.
+// It stops on the first error returned by fn.
+func (boltStore) WalkSongs(fn func(path string, tags musicmgr.FileTags) error) error {
+	songs, err := allSongs()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range songs {
+		if err = fn(s.song.SongFullPath, s.tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetArtistPath checks that a specified Artist
 // exists on the database and returns a fuse
 // error if it does not.
 // It also returns the Artist name as string.
-func GetArtistPath(artist string) (string, error) {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
-	err = db.View(func(tx *bolt.Tx) error {
+func (boltStore) GetArtistPath(artist string) (string, error) {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 
@@ -380,14 +746,8 @@ func GetArtistPath(artist string) (string, error) {
 // and Album exists on the database and returns
 // a fuse error if it does not.
 // It also returns the Album name as string.
-func GetAlbumPath(artist string, album string) (string, error) {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
-	err = db.View(func(tx *bolt.Tx) error {
+func (boltStore) GetAlbumPath(artist string, album string) (string, error) {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 
@@ -414,16 +774,10 @@ func GetAlbumPath(artist string, album string) (string, error) {
 // GetSong returns a SongStore object from the database.
 // If there is an error obtaining the Song
 // the error will be returned.
-func GetSong(artist, album, song string) (SongStore, error) {
+func (boltStore) GetSong(artist, album, song string) (SongStore, error) {
 	glog.Infof("Getting file for song: %s Artist: %s Album: %s\n", song, artist, album)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return SongStore{}, err
-	}
-	defer db.Close()
-
 	var returnValue SongStore
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		if root == nil {
 			return fuse.EIO
@@ -459,22 +813,74 @@ func GetSong(artist, album, song string) (SongStore, error) {
 	return returnValue, nil
 }
 
+// UpdateSongTags stores the tags read from the song
+// file in the database, the name and paths of the
+// Song are not modified.
+// It returns nil if the Song was updated correctly.
+func (boltStore) UpdateSongTags(artist, album, song string, tags *musicmgr.FileTags) error {
+	glog.Infof("Updating tags for song: %s Artist: %s Album: %s\n", song, artist, album)
+
+	// Read the song file before the transaction starts.
+	var info SongStore
+	var path string
+	view(func(tx *bolt.Tx) error {
+		stored, err := getSong(tx, artist, album, song)
+		if err == nil {
+			path = stored.SongFullPath
+		}
+		return nil
+	})
+	if path != "" {
+		info.setFileInfo(path)
+	}
+
+	return update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Artists"))
+		if root == nil {
+			return fuse.EIO
+		}
+
+		artistBucket := root.Bucket([]byte(artist))
+		if artistBucket == nil {
+			return fuse.ENOENT
+		}
+
+		albumBucket := artistBucket.Bucket([]byte(album))
+		if albumBucket == nil {
+			return fuse.ENOENT
+		}
+
+		songJson := albumBucket.Get([]byte(song))
+		if songJson == nil {
+			glog.Info("Song not found.")
+			return fuse.ENOENT
+		}
+
+		var songStore SongStore
+		err := json.Unmarshal(songJson, &songStore)
+		if err != nil {
+			glog.Error("Cannot open song.")
+			return errors.New("Cannot open song.")
+		}
+
+		songStore.setTags(tags)
+		if songStore.SongFullPath == path {
+			songStore.copyFileInfo(&info)
+		}
+		return putSong(tx, albumBucket, artist, album, song, &songStore)
+	})
+}
+
 // GetFilePath checks that a specified Song
 // Album exists on the database and returns
 // the full path to the Song file.
 // If there is an error obtaining the Song
 // an error will be returned.
-func GetFilePath(artist, album, song string) (string, error) {
+func (boltStore) GetFilePath(artist, album, song string) (string, error) {
 	glog.Infof("Getting file path for song: %s Artist: %s Album: %s\n", song, artist, album)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
 	var returnValue string
 
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		if root == nil {
 			return fuse.EIO
@@ -512,20 +918,30 @@ func GetFilePath(artist, album, song string) (string, error) {
 	return returnValue, nil
 }
 
+// GetSongByPath returns the Artist, Album and Song
+// stored in the database for the file in the specified
+// path, it uses the Paths index instead of walking all
+// the Artists.
+// It returns fuse.ENOENT if there is no Song with
+// that file.
+func (boltStore) GetSongByPath(path string) (string, string, string, error) {
+	var artist, album, song string
+	err := view(func(tx *bolt.Tx) error {
+		var err error
+		artist, album, song, err = songByPath(tx, path)
+		return err
+	})
+	return artist, album, song, err
+}
+
 // GetDescription obtains a Song description from the
 // database as a JSON object.
 // If the description is obtained correctly a string with
 // the JSON is returned and nil.
-func GetDescription(artist string, album string, name string) (string, error) {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
+func (boltStore) GetDescription(artist string, album string, name string) (string, error) {
 	var returnValue string
 
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 		var descJson []byte
@@ -534,6 +950,9 @@ func GetDescription(artist string, album string, name string) (string, error) {
 		} else {
 			b := artistBucket.Bucket([]byte(album))
 			descJson = b.Get([]byte(name))
+			if descJson != nil {
+				descJson = albumDescription(b, descJson)
+			}
 		}
 
 		if descJson == nil {
@@ -550,6 +969,36 @@ func GetDescription(artist string, album string, name string) (string, error) {
 	return returnValue, nil
 }
 
+// albumDescription completes the Album description
+// with the total length of the songs in the Album
+// bucket.
+func albumDescription(b *bolt.Bucket, descJson []byte) []byte {
+	var albumStore AlbumStore
+	err := json.Unmarshal(descJson, &albumStore)
+	if err != nil {
+		return descJson
+	}
+
+	albumStore.AlbumDuration = 0
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if k[0] == '.' || v == nil {
+			continue
+		}
+
+		var song SongStore
+		if json.Unmarshal(v, &song) == nil {
+			albumStore.AlbumDuration += song.Duration
+		}
+	}
+
+	encoded, err := json.Marshal(albumStore)
+	if err != nil {
+		return descJson
+	}
+	return encoded
+}
+
 // CreateArtist creates a new artist from a Raw
 // name. It generates the compatible string to
 // use as Directory name and stores the information
@@ -557,15 +1006,9 @@ func GetDescription(artist string, album string, name string) (string, error) {
 // file.
 // If there is an error it will be specified in the
 // error return value, nil otherwise.
-func CreateArtist(nameRaw string) (string, error) {
+func (boltStore) CreateArtist(nameRaw string) (string, error) {
 	name := GetCompatibleString(nameRaw)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return name, err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket, createError := root.CreateBucket([]byte(name))
 		if createError != nil {
@@ -601,15 +1044,9 @@ func CreateArtist(nameRaw string) (string, error) {
 // If the Album is created correctly the string return value
 // will contain the compatible string to use as Directory
 // name and the second value will contain nil.
-func CreateAlbum(artist string, nameRaw string) (string, error) {
+func (boltStore) CreateAlbum(artist string, nameRaw string) (string, error) {
 	name := GetCompatibleString(nameRaw)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return name, err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 		if artistBucket == nil {
@@ -683,23 +1120,17 @@ func CreateAlbum(artist string, nameRaw string) (string, error) {
 // If the Song is created correctly the string return value
 // will contain the compatible string to use as File
 // name and the second value will contain nil.
-func CreateSong(artist string, album string, nameRaw string, path string) (string, error) {
+func (boltStore) CreateSong(artist string, album string, nameRaw string, path string) (string, error) {
 	glog.Infof("Adding song to the DB: %s with Artist: %s and Album: %s\n", nameRaw, artist, album)
 	extension := filepath.Ext(nameRaw)
-	if extension != ".mp3" {
+	if !musicmgr.IsMusicFile(nameRaw) {
 		return "", errors.New("Wrong file format.")
 	}
 
 	nameRaw = nameRaw[:len(nameRaw)-len(extension)]
 	name := GetCompatibleString(nameRaw)
 
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return name, err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 		if artistBucket == nil {
@@ -715,12 +1146,10 @@ func CreateSong(artist string, album string, nameRaw string, path string) (strin
 		songStore.SongPath = name + extension
 		songStore.SongFullPath = path + name + extension
 
-		encoded, err := json.Marshal(songStore)
+		err := putSong(tx, albumBucket, artist, album, name+extension, &songStore)
 		if err != nil {
 			return err
 		}
-
-		albumBucket.Put([]byte(name+extension), encoded)
 		glog.Infof("Created with name: %s\n", name+extension)
 		return nil
 	})
@@ -730,16 +1159,10 @@ func CreateSong(artist string, album string, nameRaw string, path string) (strin
 
 // DeleteArtist deletes the specified Artist only
 // in the database and returns nil if there was no error.
-func DeleteArtist(artist, mPoint string) error {
+func (boltStore) DeleteArtist(artist, mPoint string) error {
 	glog.Infof("Deleting Artist: %s\n", artist)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
 	var songList []SongStore
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		buck := root.Bucket([]byte(artist))
 
@@ -771,6 +1194,10 @@ func DeleteArtist(artist, mPoint string) error {
 				songList = append(songList, song)
 			}
 		}
+		err := unindexArtist(tx, root, artist)
+		if err != nil {
+			return err
+		}
 		root.DeleteBucket([]byte(artist))
 		return nil
 	})
@@ -794,22 +1221,16 @@ func DeleteArtist(artist, mPoint string) error {
 // DeleteAlbum deletes the specified Album for
 // the specified Artist only in the database and
 // returns nil if there was no error.
-func DeleteAlbum(artistName, albumName, mPoint string) error {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
+func (boltStore) DeleteAlbum(artistName, albumName, mPoint string) error {
 	var songList []SongStore
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artistName))
 		if artistBucket == nil {
 			return errors.New("Artist not found.")
 		}
 
-		album := artistBucket.Bucket([]byte(artistName))
+		album := artistBucket.Bucket([]byte(albumName))
 		if album == nil {
 			return nil
 		}
@@ -831,6 +1252,10 @@ func DeleteAlbum(artistName, albumName, mPoint string) error {
 			song.SongName = string(name)
 			songList = append(songList, song)
 		}
+		err := unindexAlbum(tx, artistBucket, artistName, albumName)
+		if err != nil {
+			return err
+		}
 		artistBucket.DeleteBucket([]byte(albumName))
 		return nil
 	})
@@ -854,20 +1279,14 @@ func DeleteAlbum(artistName, albumName, mPoint string) error {
 // DeleteSong deletes the specified Song in the
 // specified Album and Artist only in the database
 // and returns nil if there was no error.
-func DeleteSong(artist, album, song, mPoint string) error {
+func (boltStore) DeleteSong(artist, album, song, mPoint string) error {
 	glog.Infof("Deleting song: %s with Artist: %s and Album: %s\n", song, artist, album)
 	if song[0] == '.' {
 		return nil
 	}
 
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return fuse.EIO
-	}
-	defer db.Close()
-
 	var songData SongStore
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Artists"))
 		artistBucket := root.Bucket([]byte(artist))
 		if artistBucket == nil {
@@ -886,7 +1305,7 @@ func DeleteSong(artist, album, song, mPoint string) error {
 				os.Remove(songData.SongFullPath)
 			}
 		}
-		return albumBucket.Delete([]byte(song))
+		return removeSong(tx, albumBucket, artist, album, song)
 	})
 
 	if err != nil {
@@ -31,15 +31,9 @@ import (
 // exists on the database and returns an
 // error if it does not.
 // It also returns the playlist name as string.
-func GetPlaylistPath(playlist string) (string, error) {
+func (boltStore) GetPlaylistPath(playlist string) (string, error) {
 	glog.Infof("Entered Playlist path with playlist: %s\n", playlist)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			return errors.New("No playlists.")
@@ -74,11 +68,16 @@ func GetPlaylistPath(playlist string) (string, error) {
 func GetPlaylistFilePath(playlist, song, mPoint string) (string, error) {
 	glog.Infof("Entered Playlist file path with song: %s, and playlist: %s\n", song, playlist)
 
-	returnValue, err := getPlaylistFile(playlist, song)
+	returnValue, err := GetPlaylistFile(playlist, song)
 	if err == nil {
 		return returnValue.Path, nil
 	}
 
+	rulePath, err := getRuleSongPath(playlist, song, mPoint)
+	if err == nil {
+		return rulePath, nil
+	}
+
 	if mPoint[len(mPoint)-1] != '/' {
 		mPoint = mPoint + "/"
 	}
@@ -97,16 +96,10 @@ func GetPlaylistFilePath(playlist, song, mPoint string) (string, error) {
 // in the MuLi system.
 // It receives no arguments and returns a slice of Dir objects to list
 // all the available playlists and the error if there is any.
-func ListPlaylists() ([]fuse.Dirent, error) {
+func (boltStore) ListPlaylists() ([]fuse.Dirent, error) {
 	glog.Info("Entered list playlists.")
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
 	var a []fuse.Dirent
-	err = db.View(func(tx *bolt.Tx) error {
+	view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Playlists"))
 		if b == nil {
 			glog.Infof("There is no Playlists bucket.")
@@ -129,18 +122,14 @@ func ListPlaylists() ([]fuse.Dirent, error) {
 // ListPlaylistSongs function returns all the songs inside a playlist.
 // The available songs are loaded from the database and also from the
 // temporary drop directory named after the playlist.
+// The songs selected by the rules of smart playlists are evaluated
+// every time the playlist is listed.
 // It receives a playlist name and returns a slice with all the
 // files.
-func ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
+func (boltStore) ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
 	glog.Infof("Listing contents of playlist %s.\n", playlist)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
 	var a []fuse.Dirent
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			return nil
@@ -160,6 +149,10 @@ func ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
 				a = append(a, node)
 			}
 		}
+
+		for _, r := range playlistRuleSongs(tx, b, playlist, mPoint) {
+			a = append(a, fuse.Dirent{Name: r.name, Type: fuse.DT_File})
+		}
 		return nil
 	})
 
@@ -167,6 +160,13 @@ func ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
 		return nil, err
 	}
 
+	return append(a, listPlaylistDrops(playlist, mPoint)...), nil
+}
+
+// listPlaylistDrops returns the files dropped inside a
+// playlist that are still in its temporary directory.
+func listPlaylistDrops(playlist, mPoint string) []fuse.Dirent {
+	var a []fuse.Dirent
 	if mPoint[len(mPoint)-1] != '/' {
 		mPoint = mPoint + "/"
 	}
@@ -182,23 +182,17 @@ func ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
 			a = append(a, node)
 		}
 	}
-	return a, nil
+	return a
 }
 
 // CreatePlaylist function creates a playlist item in the database and
 // also creates it in the filesystem.
 // It receives the playlist name and returns the modified name and an
 // error if something went wrong.
-func CreatePlaylist(name, mPoint string) (string, error) {
+func (boltStore) CreatePlaylist(name, mPoint string) (string, error) {
 	glog.Infof("Creating Playlist with name: %s\n", name)
 	name = GetCompatibleString(name)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root, err := tx.CreateBucketIfNotExists([]byte("Playlists"))
 		if err != nil {
 			glog.Errorf("Error creating Playlists bucket: %s\n", err)
@@ -220,18 +214,48 @@ func CreatePlaylist(name, mPoint string) (string, error) {
 	return name, err
 }
 
+// setPlaylistFileInfo fills the name and duration of
+// a playlist file with the information of the song
+// stored in the Artists bucket.
+func setPlaylistFileInfo(artists *bolt.Bucket, file *playlistmgr.PlaylistFile) {
+	if artists == nil {
+		return
+	}
+
+	artistBucket := artists.Bucket([]byte(file.Artist))
+	if artistBucket == nil {
+		return
+	}
+
+	albumBucket := artistBucket.Bucket([]byte(file.Album))
+	if albumBucket == nil {
+		return
+	}
+
+	var song SongStore
+	songJson := albumBucket.Get([]byte(file.Title))
+	if songJson == nil || json.Unmarshal(songJson, &song) != nil {
+		return
+	}
+
+	var artist ArtistStore
+	artistJson := artistBucket.Get([]byte(".description"))
+	if artistJson == nil || json.Unmarshal(artistJson, &artist) != nil {
+		artist.ArtistName = file.Artist
+	}
+
+	file.Name = artist.ArtistName + " - " + song.SongName
+	file.Duration = song.Duration
+}
+
 // RegeneratePlaylistFile creates the playlist file from the
 // information in the database.
-func RegeneratePlaylistFile(name, mPoint string) error {
+// The songs currently selected by the rules of a smart playlist
+// are also written.
+func (boltStore) RegeneratePlaylistFile(name, mPoint string) error {
 	glog.Infof("Regenerating playlist for name: %s\n", name)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
 	var a []playlistmgr.PlaylistFile
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			glog.Info("Cannot open Playlists bucket.")
@@ -244,18 +268,37 @@ func RegeneratePlaylistFile(name, mPoint string) error {
 			return errors.New("Playlist not exists.")
 		}
 
+		artists := tx.Bucket([]byte("Artists"))
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			if v != nil {
 				var file playlistmgr.PlaylistFile
 				err := json.Unmarshal(v, &file)
 				if err == nil {
+					setPlaylistFileInfo(artists, &file)
 					a = append(a, file)
 				} else {
 					glog.Errorf("Cannot unmarshal Playlist File %s: %s\n", k, err)
 				}
 			}
 		}
+
+		for _, r := range playlistRuleSongs(tx, b, name, mPoint) {
+			song, err := getSong(tx, r.artist, r.album, r.song)
+			if err != nil {
+				continue
+			}
+
+			file := playlistmgr.PlaylistFile{
+				Title:  r.song,
+				Artist: r.artist,
+				Album:  r.album,
+				Path:   song.SongFullPath,
+				Rule:   true,
+			}
+			setPlaylistFileInfo(artists, &file)
+			a = append(a, file)
+		}
 		return nil
 	})
 
@@ -268,20 +311,14 @@ func RegeneratePlaylistFile(name, mPoint string) error {
 
 // AddFileToPlaylist function adds a file to a specific playlist.
 // The function also checks that the file exists in the MuLi database.
-func AddFileToPlaylist(file playlistmgr.PlaylistFile, playlistName string) error {
+func (boltStore) AddFileToPlaylist(file playlistmgr.PlaylistFile, playlistName string) error {
 	path, err := GetFilePath(file.Artist, file.Album, file.Title)
 	if err != nil {
 		return errors.New("Playlist item not found in MuLi.")
 	}
 
 	file.Path = path
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			glog.Errorf("Error opening Playlists bucket: %s\n", err)
@@ -357,14 +394,8 @@ func AddFileToPlaylist(file playlistmgr.PlaylistFile, playlistName string) error
 // DeletePlaylist function deletes a playlist from the database
 // and also deletes all the entries in the specific files and
 // deletes it from the filesystem.
-func DeletePlaylist(name, mPoint string) error {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+func (boltStore) DeletePlaylist(name, mPoint string) error {
+	update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			glog.Errorf("Error opening Playlists bucket.\n")
@@ -385,7 +416,7 @@ func DeletePlaylist(name, mPoint string) error {
 
 			// Get the PlaylistFile
 			var file playlistmgr.PlaylistFile
-			err = json.Unmarshal(songJson, &file)
+			err := json.Unmarshal(songJson, &file)
 			if err != nil {
 				continue
 			}
@@ -451,14 +482,8 @@ func DeletePlaylist(name, mPoint string) error {
 // DeletePlaylistSong function deletes a specific song from a playlist.
 // The force parameter is used to just delete the song without modifying
 // the original song file.
-func DeletePlaylistSong(playlist, name string, force bool) error {
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+func (boltStore) DeletePlaylistSong(playlist, name string, force bool) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			glog.Errorf("Error opening Playlists bucket.\n")
@@ -479,7 +504,7 @@ func DeletePlaylistSong(playlist, name string, force bool) error {
 
 			// Get the playlist file
 			var file playlistmgr.PlaylistFile
-			err = json.Unmarshal(songJson, &file)
+			err := json.Unmarshal(songJson, &file)
 			if err != nil {
 				return nil
 			}
@@ -540,19 +565,13 @@ func DeletePlaylistSong(playlist, name string, force bool) error {
 	return err
 }
 
-// getPlaylistFile returns a PlaylistFile struct
+// GetPlaylistFile returns a PlaylistFile struct
 // with all the information from a specific file
 // inside a playlist.
-func getPlaylistFile(playlist, song string) (playlistmgr.PlaylistFile, error) {
-	glog.Infof("Entered getPlaylistFile with song: %s, and playlist: %s\n", song, playlist)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return playlistmgr.PlaylistFile{}, err
-	}
-	defer db.Close()
-
+func (boltStore) GetPlaylistFile(playlist, song string) (playlistmgr.PlaylistFile, error) {
+	glog.Infof("Entered GetPlaylistFile with song: %s, and playlist: %s\n", song, playlist)
 	var returnValue playlistmgr.PlaylistFile
-	err = db.View(func(tx *bolt.Tx) error {
+	err := view(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			return errors.New("No playlists.")
@@ -582,16 +601,10 @@ func getPlaylistFile(playlist, song string) (playlistmgr.PlaylistFile, error) {
 
 // RenamePlaylist moves the entire Playlist and changes all
 // the links to the songs in every MuLi song.
-func RenamePlaylist(oldName, newName, mPoint string) (string, error) {
+func (boltStore) RenamePlaylist(oldName, newName, mPoint string) (string, error) {
 	glog.Infof("Renaming %s playlist to %s.\n", oldName, newName)
 	newName = GetCompatibleString(newName)
-	db, err := bolt.Open(config.DbPath, 0600, nil)
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	err := update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("Playlists"))
 		if root == nil {
 			glog.Errorf("Error opening Playlists bucket.\n")
@@ -682,6 +695,7 @@ func RenamePlaylist(oldName, newName, mPoint string) (string, error) {
 			}
 		}
 
+		playlistmgr.MoveRules(oldName, newName, mPoint)
 		playlistmgr.DeletePlaylist(oldName, mPoint)
 		return root.DeleteBucket([]byte(oldName))
 	})
@@ -697,7 +711,7 @@ func RenamePlaylist(oldName, newName, mPoint string) (string, error) {
 // it also updates the song in the original place and
 // checks that every playlist containing the song is updated.
 func RenamePlaylistSong(playlist, oldName, newName, mPoint string) (string, error) {
-	file, err := getPlaylistFile(playlist, oldName)
+	file, err := GetPlaylistFile(playlist, oldName)
 	if err != nil {
 		glog.Infof("Cannot open playlist file: %s\n", err)
 		return "", err
@@ -0,0 +1,146 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// MetaBucket is the root Bucket with the information
+// about the database itself, like the schema version.
+const MetaBucket = "Meta"
+
+// versionKey is the Key in the Meta Bucket where the
+// schema version is stored.
+const versionKey = "version"
+
+// migration upgrades the database to the next schema
+// version, it runs inside a single transaction so a
+// failed migration leaves the database untouched.
+type migration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations are all the upgrades of the database
+// layout in order, the migration at index i takes the
+// database from version i to version i+1.
+// New migrations are always added at the end, the
+// databases created before the schema version existed
+// are version 0.
+var migrations = []migration{
+	{"Index the Songs by Genre, year, decade and for the search.", rebuildIndexes},
+	{"Index the Songs by the path of their files.", rebuildPathsIndex},
+}
+
+// SchemaVersion returns the version of the database
+// layout used by this version of MuLi.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// readSchemaVersion returns the version stored in the
+// database, 0 if there is none.
+func readSchemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket([]byte(MetaBucket))
+	if meta == nil {
+		return 0, nil
+	}
+
+	value := meta.Get([]byte(versionKey))
+	if value == nil {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, errors.New("Wrong database schema version.")
+	}
+	return version, nil
+}
+
+// writeSchemaVersion stores the schema version in the
+// Meta Bucket.
+func writeSchemaVersion(tx *bolt.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(MetaBucket))
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(versionKey), []byte(strconv.Itoa(version)))
+}
+
+// migrationBackupPath returns the path of the copy of
+// the database taken before upgrading it from the
+// specified version.
+func migrationBackupPath(path string, version int) string {
+	return fmt.Sprintf("%s.v%d.bak", path, version)
+}
+
+// migrateDB upgrades the database in place to the
+// current schema version.
+// A copy of the database is written next to it before
+// each migration, the migration and the new version
+// are stored in the same transaction.
+// It returns an error if the database was created by
+// a newer version of MuLi.
+func migrateDB(d *bolt.DB, path string) error {
+	var version int
+	err := d.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = readSchemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion() {
+		glog.Errorf("The database schema version %d is newer than %d.\n", version, SchemaVersion())
+		return errors.New("The database was created by a newer version of MuLi.")
+	}
+
+	for ; version < SchemaVersion(); version++ {
+		m := migrations[version]
+		backup := migrationBackupPath(path, version)
+		err = d.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		})
+		if err != nil {
+			glog.Errorf("Cannot copy the database before migrating it: %s\n", err)
+			return err
+		}
+
+		glog.Infof("Migrating the database to version %d: %s\n", version+1, m.description)
+		err = d.Update(func(tx *bolt.Tx) error {
+			err := m.migrate(tx)
+			if err != nil {
+				return err
+			}
+			return writeSchemaVersion(tx, version+1)
+		})
+		if err != nil {
+			glog.Errorf("Cannot migrate the database, the copy is in %s: %s\n", backup, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// Names of the Buckets used by the searches.
+const (
+	SearchIndex    = "Search"
+	SearchesBucket = "Searches"
+)
+
+// searchEntry holds the tags of a Song as they are
+// stored in the search index, the text values are
+// normalized with searchValue.
+type searchEntry struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Composer    string
+	Genre       string
+	Year        int
+	Track       int
+	Disc        int
+}
+
+// searchTextFields are the text fields that can be
+// used in the queries.
+var searchTextFields = map[string]func(e *searchEntry) string{
+	"title":       func(e *searchEntry) string { return e.Title },
+	"artist":      func(e *searchEntry) string { return e.Artist },
+	"album":       func(e *searchEntry) string { return e.Album },
+	"albumartist": func(e *searchEntry) string { return e.AlbumArtist },
+	"composer":    func(e *searchEntry) string { return e.Composer },
+	"genre":       func(e *searchEntry) string { return e.Genre },
+}
+
+// searchNumberFields are the numeric fields that can
+// be used in the queries.
+var searchNumberFields = map[string]func(e *searchEntry) int{
+	"year":  func(e *searchEntry) int { return e.Year },
+	"track": func(e *searchEntry) int { return e.Track },
+	"disc":  func(e *searchEntry) int { return e.Disc },
+}
+
+// searchOperators are the comparisons allowed for the
+// numeric fields, the longest ones go first.
+var searchOperators = []string{"<=", ">=", "!=", "<", ">", "="}
+
+// searchValue normalizes a text value so the queries
+// ignore the case, the accents and the characters
+// that are not allowed in the file names.
+func searchValue(value string) string {
+	return strings.ToLower(GetCompatibleString(value))
+}
+
+// newSearchEntry returns the search index entry of the
+// Song.
+func newSearchEntry(artist, album string, song *SongStore) searchEntry {
+	return searchEntry{
+		Title:       searchValue(song.SongName),
+		Artist:      strings.ToLower(artist),
+		Album:       strings.ToLower(album),
+		AlbumArtist: searchValue(song.AlbumArtist),
+		Composer:    searchValue(song.Composer),
+		Genre:       searchValue(song.Genre),
+		Year:        song.Year,
+		Track:       song.Track,
+		Disc:        song.Disc,
+	}
+}
+
+// searchTerm is a single condition of a query, an
+// empty field matches any of the text fields.
+// The text fields look for the text inside the value
+// unless the operator is = or !=.
+type searchTerm struct {
+	field    string
+	operator string
+	text     string
+	number   int
+}
+
+// matches returns true if the entry fulfills the
+// condition.
+func (t searchTerm) matches(e *searchEntry) bool {
+	if t.field == "" {
+		for _, value := range searchTextFields {
+			if strings.Contains(value(e), t.text) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if value, ok := searchTextFields[t.field]; ok {
+		switch t.operator {
+		case "=":
+			return value(e) == t.text
+		case "!=":
+			return value(e) != t.text
+		}
+		return strings.Contains(value(e), t.text)
+	}
+
+	n := searchNumberFields[t.field](e)
+	switch t.operator {
+	case "!=":
+		return n != t.number
+	case "<=":
+		return n > 0 && n <= t.number
+	case ">=":
+		return n >= t.number
+	case "<":
+		return n > 0 && n < t.number
+	case ">":
+		return n > t.number
+	}
+	return n == t.number
+}
+
+// splitQuery splits the query in words, the double
+// quotes keep the spaces inside a word.
+func splitQuery(query string) []string {
+	var words []string
+	var word []rune
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+		default:
+			word = append(word, r)
+		}
+	}
+
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// parseQuery returns the conditions of the query.
+// Every word is a condition and all of them must match,
+// the words like field:value compare a single field
+// while the rest of them are looked for in all the
+// text fields. The numeric fields can be compared
+// with <, <=, >, >= or =, like year:<2000.
+func parseQuery(query string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, word := range splitQuery(query) {
+		i := strings.Index(word, ":")
+		if i < 0 {
+			terms = append(terms, searchTerm{text: searchValue(word)})
+			continue
+		}
+
+		t := searchTerm{field: strings.ToLower(word[:i])}
+		value := word[i+1:]
+		if _, ok := searchTextFields[t.field]; ok {
+			t.text = searchValue(value)
+			terms = append(terms, t)
+			continue
+		}
+
+		if _, ok := searchNumberFields[t.field]; !ok {
+			return nil, errors.New("Unknown search field: " + t.field + ".")
+		}
+
+		t.operator = "="
+		for _, op := range searchOperators {
+			if strings.HasPrefix(value, op) {
+				t.operator = op
+				value = value[len(op):]
+				break
+			}
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("Wrong number in search field: " + t.field + ".")
+		}
+		t.number = n
+		terms = append(terms, t)
+	}
+
+	if len(terms) == 0 {
+		return nil, errors.New("The search is empty.")
+	}
+	return terms, nil
+}
+
+// searchResultName returns the name of a Song inside
+// a search Directory, the Artist and Album are part
+// of the name since the results come from the whole
+// library.
+func searchResultName(artist, album, song string) string {
+	return artist + " - " + album + " - " + song
+}
+
+// searchResult is a Song that matches a query.
+type searchResult struct {
+	name   string
+	artist string
+	album  string
+	song   string
+	entry  searchEntry
+}
+
+// matchesTerms returns true if the entry matches all
+// the conditions.
+func matchesTerms(terms []searchTerm, e *searchEntry) bool {
+	for _, t := range terms {
+		if !t.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSongs returns the Songs from the search index
+// that match all the conditions, sorted by Artist,
+// Album and Song.
+func matchSongs(tx *bolt.Tx, terms []searchTerm) []searchResult {
+	b := tx.Bucket([]byte(SearchIndex))
+	if b == nil {
+		return nil
+	}
+
+	var results []searchResult
+	b.ForEach(func(k, v []byte) error {
+		var e searchEntry
+		if json.Unmarshal(v, &e) != nil {
+			return nil
+		}
+
+		if !matchesTerms(terms, &e) {
+			return nil
+		}
+
+		parts := strings.SplitN(string(k), "/", 3)
+		if len(parts) != 3 {
+			return nil
+		}
+		results = append(results, searchResult{
+			name:   searchResultName(parts[0], parts[1], parts[2]),
+			artist: parts[0],
+			album:  parts[1],
+			song:   parts[2],
+			entry:  e,
+		})
+		return nil
+	})
+	return results
+}
+
+// searchSongs returns the Songs from the search index
+// that match the query.
+func searchSongs(query string) ([]searchResult, error) {
+	terms, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []searchResult
+	err = view(func(tx *bolt.Tx) error {
+		results = matchSongs(tx, terms)
+		return nil
+	})
+	return results, err
+}
+
+// CheckSearch returns an error if the query is not
+// valid.
+func CheckSearch(query string) error {
+	_, err := parseQuery(query)
+	return err
+}
+
+// ListSearchSongs returns the Dirent for all the Songs
+// that match the query.
+func ListSearchSongs(query string) ([]fuse.Dirent, error) {
+	results, err := searchSongs(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var a []fuse.Dirent
+	for _, r := range results {
+		a = append(a, fuse.Dirent{Name: r.name, Type: fuse.DT_File})
+	}
+	return a, nil
+}
+
+// GetSearchSong returns the Artist, Album and Song Keys
+// of a Song inside the results of the query.
+// The Keys are taken from the name of the result and
+// only that Song is checked against the query.
+func GetSearchSong(query, name string) (string, string, string, error) {
+	terms, err := parseQuery(query)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	keys := strings.SplitN(name, " - ", 3)
+	if len(keys) != 3 {
+		return "", "", "", fuse.ENOENT
+	}
+
+	err = view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SearchIndex))
+		if b == nil {
+			return fuse.ENOENT
+		}
+
+		value := b.Get(indexKey(keys[0], keys[1], keys[2]))
+		if value == nil {
+			return fuse.ENOENT
+		}
+
+		var e searchEntry
+		if json.Unmarshal(value, &e) != nil || !matchesTerms(terms, &e) {
+			return fuse.ENOENT
+		}
+		return nil
+	})
+
+	if err != nil {
+		return "", "", "", err
+	}
+	return keys[0], keys[1], keys[2], nil
+}
+
+// ListSearches returns the Dirent for the saved
+// searches.
+func ListSearches() ([]fuse.Dirent, error) {
+	var a []fuse.Dirent
+	err := view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SearchesBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			a = append(a, fuse.Dirent{Name: string(k), Type: fuse.DT_Dir})
+			return nil
+		})
+	})
+	return a, err
+}
+
+// CreateSearch saves the query so it is listed inside
+// the search Directory.
+func CreateSearch(query string) error {
+	glog.Infof("Creating search: %s\n", query)
+	if err := CheckSearch(query); err != nil {
+		return err
+	}
+
+	return update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(SearchesBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(query), []byte{})
+	})
+}
+
+// DeleteSearch removes a saved query, the Songs are
+// not modified.
+func DeleteSearch(query string) error {
+	return update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SearchesBucket))
+		if b == nil || b.Get([]byte(query)) == nil {
+			return fuse.ENOENT
+		}
+		return b.Delete([]byte(query))
+	})
+}
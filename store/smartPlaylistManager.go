@@ -0,0 +1,335 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
+	"github.com/golang/glog"
+)
+
+// playlistRules are the rules of a smart playlist, the
+// Songs that match all the conditions are sorted by the
+// order field and limited to the first ones.
+// An empty order keeps the Songs sorted by Artist,
+// Album and Song, the random order is shuffled with
+// the seed so it only changes when the rules are
+// written again.
+type playlistRules struct {
+	terms []searchTerm
+	order string
+	desc  bool
+	limit int
+	seed  int64
+}
+
+// ruleOperators are the comparisons allowed in the
+// rules, the longest ones go first.
+var ruleOperators = []string{"<=", ">=", "!=", "=", "<", ">", "~"}
+
+// parseRuleCondition parses a single condition of the
+// rules like genre=Jazz or year>=1960.
+// The text fields can be compared with =, != or ~,
+// that looks for the text inside the value, and the
+// numeric fields with =, !=, <, <=, > or >=.
+func parseRuleCondition(condition string) (searchTerm, error) {
+	i := strings.IndexAny(condition, "<>=!~")
+	if i <= 0 {
+		return searchTerm{}, errors.New("Wrong rule condition: " + condition + ".")
+	}
+
+	t := searchTerm{field: strings.ToLower(strings.TrimSpace(condition[:i]))}
+	for _, op := range ruleOperators {
+		if strings.HasPrefix(condition[i:], op) {
+			t.operator = op
+			break
+		}
+	}
+
+	value := strings.TrimSpace(condition[i+len(t.operator):])
+	if t.operator == "" || value == "" {
+		return searchTerm{}, errors.New("Wrong rule condition: " + condition + ".")
+	}
+
+	if _, ok := searchTextFields[t.field]; ok {
+		if t.operator != "=" && t.operator != "!=" && t.operator != "~" {
+			return searchTerm{}, errors.New("Wrong operator for field: " + t.field + ".")
+		}
+		t.text = searchValue(value)
+		return t, nil
+	}
+
+	if _, ok := searchNumberFields[t.field]; !ok {
+		return searchTerm{}, errors.New("Unknown rule field: " + t.field + ".")
+	}
+
+	if t.operator == "~" {
+		return searchTerm{}, errors.New("Wrong operator for field: " + t.field + ".")
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return searchTerm{}, errors.New("Wrong number in rule field: " + t.field + ".")
+	}
+	t.number = n
+	return t, nil
+}
+
+// parsePlaylistRules parses the rules of a smart
+// playlist, like "genre=Jazz AND year>=1960 ORDER BY
+// random LIMIT 100".
+// The conditions are joined with AND, ORDER BY takes a
+// field, optionally followed by ASC or DESC, or random.
+// The lines starting with # are comments.
+// It returns nil if there are no rules.
+func parsePlaylistRules(text string) (*playlistRules, error) {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	words := splitQuery(strings.Join(lines, " "))
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	rules := &playlistRules{}
+	var condition []string
+	addCondition := func() error {
+		if len(condition) == 0 {
+			return nil
+		}
+
+		t, err := parseRuleCondition(strings.Join(condition, " "))
+		if err != nil {
+			return err
+		}
+		rules.terms = append(rules.terms, t)
+		condition = nil
+		return nil
+	}
+
+	for i := 0; i < len(words); i++ {
+		switch strings.ToUpper(words[i]) {
+		case "AND":
+			if len(condition) == 0 {
+				return nil, errors.New("Missing rule condition before AND.")
+			}
+			if err := addCondition(); err != nil {
+				return nil, err
+			}
+		case "LIMIT":
+			if err := addCondition(); err != nil {
+				return nil, err
+			}
+			if i+1 >= len(words) {
+				return nil, errors.New("Missing LIMIT value.")
+			}
+			i++
+			n, err := strconv.Atoi(words[i])
+			if err != nil || n <= 0 {
+				return nil, errors.New("Wrong LIMIT value: " + words[i] + ".")
+			}
+			rules.limit = n
+		case "ORDER":
+			if err := addCondition(); err != nil {
+				return nil, err
+			}
+			if i+2 >= len(words) || strings.ToUpper(words[i+1]) != "BY" {
+				return nil, errors.New("Wrong ORDER BY clause.")
+			}
+			i += 2
+			rules.order = strings.ToLower(words[i])
+			_, text := searchTextFields[rules.order]
+			_, number := searchNumberFields[rules.order]
+			if !text && !number && rules.order != "random" {
+				return nil, errors.New("Unknown order field: " + words[i] + ".")
+			}
+			if i+1 < len(words) {
+				switch strings.ToUpper(words[i+1]) {
+				case "DESC":
+					rules.desc = true
+					i++
+				case "ASC":
+					i++
+				}
+			}
+		default:
+			condition = append(condition, words[i])
+		}
+	}
+
+	if err := addCondition(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// readPlaylistRules reads and parses the rules of the
+// playlist, it returns nil if it is not a smart
+// playlist.
+func readPlaylistRules(playlist, mPoint string) (*playlistRules, error) {
+	text, modified, err := playlistmgr.ReadRules(playlist, mPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := parsePlaylistRules(text)
+	if err != nil || rules == nil {
+		return nil, err
+	}
+	rules.seed = modified.UnixNano()
+	return rules, nil
+}
+
+// ruleOrder sorts the results of the rules by a field.
+type ruleOrder struct {
+	results []searchResult
+	field   string
+	desc    bool
+}
+
+func (o ruleOrder) Len() int      { return len(o.results) }
+func (o ruleOrder) Swap(i, j int) { o.results[i], o.results[j] = o.results[j], o.results[i] }
+
+func (o ruleOrder) Less(i, j int) bool {
+	a, b := &o.results[i].entry, &o.results[j].entry
+	if value, ok := searchTextFields[o.field]; ok {
+		if o.desc {
+			return value(a) > value(b)
+		}
+		return value(a) < value(b)
+	}
+
+	value := searchNumberFields[o.field]
+	if o.desc {
+		return value(a) > value(b)
+	}
+	return value(a) < value(b)
+}
+
+// apply returns the Songs selected by the rules.
+func (r *playlistRules) apply(tx *bolt.Tx) []searchResult {
+	results := matchSongs(tx, r.terms)
+	switch r.order {
+	case "":
+	case "random":
+		shuffled := make([]searchResult, len(results))
+		for i, j := range rand.New(rand.NewSource(r.seed)).Perm(len(results)) {
+			shuffled[j] = results[i]
+		}
+		results = shuffled
+	default:
+		sort.Stable(ruleOrder{results, r.order, r.desc})
+	}
+
+	if r.limit > 0 && len(results) > r.limit {
+		results = results[:r.limit]
+	}
+	return results
+}
+
+// playlistRuleSongs returns the Songs added to the
+// playlist by its rules, the ones that are already in
+// the playlist Bucket are skipped.
+// The Songs are named by their Key like the rest of
+// the playlist, unless the name is already taken, in
+// that case the Artist and Album are added to it.
+func playlistRuleSongs(tx *bolt.Tx, b *bolt.Bucket, playlist, mPoint string) []searchResult {
+	rules, err := readPlaylistRules(playlist, mPoint)
+	if err != nil {
+		glog.Infof("Wrong rules in playlist %s: %s\n", playlist, err)
+		return nil
+	}
+
+	if rules == nil {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	stored := make(map[string]bool)
+	b.ForEach(func(k, v []byte) error {
+		var file playlistmgr.PlaylistFile
+		if v != nil && json.Unmarshal(v, &file) == nil {
+			names[string(k)] = true
+			stored[string(indexKey(file.Artist, file.Album, file.Title))] = true
+		}
+		return nil
+	})
+
+	var results []searchResult
+	for _, r := range rules.apply(tx) {
+		if stored[string(indexKey(r.artist, r.album, r.song))] {
+			continue
+		}
+
+		if !names[r.song] {
+			r.name = r.song
+		}
+		names[r.name] = true
+		results = append(results, r)
+	}
+	return results
+}
+
+// CheckPlaylistRules returns an error if the rules of
+// the playlist are not valid.
+func CheckPlaylistRules(playlist, mPoint string) error {
+	_, err := readPlaylistRules(playlist, mPoint)
+	return err
+}
+
+// getRuleSongPath returns the path of a Song added to
+// the playlist by its rules.
+func getRuleSongPath(playlist, name, mPoint string) (string, error) {
+	var path string
+	err := view(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("Playlists"))
+		if root == nil {
+			return errors.New("No playlists.")
+		}
+
+		b := root.Bucket([]byte(playlist))
+		if b == nil {
+			return errors.New("Playlist not exists.")
+		}
+
+		for _, r := range playlistRuleSongs(tx, b, playlist, mPoint) {
+			if r.name != name {
+				continue
+			}
+
+			song, err := getSong(tx, r.artist, r.album, r.song)
+			if err != nil {
+				return err
+			}
+			path = song.SongFullPath
+			return nil
+		}
+		return errors.New("Song not found.")
+	})
+	return path, err
+}
@@ -0,0 +1,372 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"reflect"
+	"sort"
+
+	"bazil.org/fuse"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/playlistmgr"
+	"github.com/golang/glog"
+)
+
+// reservedNames are the names of the special
+// Directories in the root of the filesystem, no Artist
+// can use them because it would be hidden.
+var reservedNames = []string{"drop", "playlists", "genres", "years", "decades", "search"}
+
+// reservedArtist returns true if the compatible name
+// of the Artist is one of the reserved names.
+func reservedArtist(nameRaw string) bool {
+	name := GetCompatibleString(nameRaw)
+	for _, reserved := range reservedNames {
+		if name == reserved {
+			glog.Infof("The Artist name %s is reserved.\n", name)
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps the Artists, Albums, Songs, Playlists and
+// descriptions of the MuLi filesystem.
+// The package functions with the same names call the
+// current Store, it is the Bolt database unless it is
+// replaced with SetStore.
+// The errors and names returned must be the same for
+// every implementation, a missing item is fuse.ENOENT
+// and an existing one is fuse.EEXIST.
+// The Store only covers these operations. The Genres,
+// Years and Decades directories, the search, the
+// custom layout, the covers, the lyrics, the tag
+// backups, the smart playlists and the move journal
+// are not part of it, they always use the Bolt
+// database opened by InitDB and return ErrNoDatabase
+// when it is not open.
+type Store interface {
+	// Artists
+	ListArtists() ([]fuse.Dirent, error)
+	GetArtistPath(artist string) (string, error)
+	CreateArtist(nameRaw string) (string, error)
+	DeleteArtist(artist, mPoint string) error
+	MoveArtist(oldArtist, newArtist, mPoint string) error
+
+	// Albums
+	ListAlbums(artist string) ([]fuse.Dirent, error)
+	GetAlbumPath(artist, album string) (string, error)
+	CreateAlbum(artist, nameRaw string) (string, error)
+	DeleteAlbum(artist, album, mPoint string) error
+	MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error
+	WalkAlbums(fn func(artist, album string, paths []string) error) error
+
+	// Songs
+	ListSongs(artist, album string) ([]fuse.Dirent, error)
+	GetSong(artist, album, song string) (SongStore, error)
+	GetFilePath(artist, album, song string) (string, error)
+	GetSongByPath(path string) (artist, album, song string, err error)
+	StoreNewSong(song *musicmgr.FileTags, path string) error
+	CreateSong(artist, album, nameRaw, path string) (string, error)
+	UpdateSongTags(artist, album, song string, tags *musicmgr.FileTags) error
+	DeleteSong(artist, album, song, mPoint string) error
+	WalkSongs(fn func(path string, tags musicmgr.FileTags) error) error
+
+	// Descriptions
+	GetDescription(artist, album, name string) (string, error)
+
+	// Playlists
+	ListPlaylists() ([]fuse.Dirent, error)
+	GetPlaylistPath(playlist string) (string, error)
+	GetPlaylistFile(playlist, song string) (playlistmgr.PlaylistFile, error)
+	ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error)
+	CreatePlaylist(name, mPoint string) (string, error)
+	DeletePlaylist(name, mPoint string) error
+	RenamePlaylist(oldName, newName, mPoint string) (string, error)
+	AddFileToPlaylist(file playlistmgr.PlaylistFile, playlistName string) error
+	DeletePlaylistSong(playlist, name string, force bool) error
+	RegeneratePlaylistFile(name, mPoint string) error
+}
+
+// backend is the Store used by the package functions.
+var backend Store = boltStore{}
+
+// SetStore replaces the Store used by the package
+// functions, it allows to run MuLi on top of a
+// different backend like the one returned by
+// NewMemoryStore. InitDB does not change the Store, so
+// it can be set before or after opening the database.
+// The features that need the Bolt database are listed
+// in the Store documentation.
+func SetStore(s Store) {
+	backend = s
+}
+
+// CurrentStore returns the Store used by the package
+// functions.
+func CurrentStore() Store {
+	return backend
+}
+
+// sortedKeys returns the keys of a map with string keys
+// sorted in the same order than the Keys in a Bolt
+// Bucket.
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bucketDirent returns the Dirent of a Key in a
+// listing, the Buckets are Directories and the rest of
+// the Keys are files.
+func bucketDirent(name string, isBucket bool) fuse.Dirent {
+	if isBucket {
+		return fuse.Dirent{Name: name, Type: fuse.DT_Dir}
+	}
+	return fuse.Dirent{Name: name, Type: fuse.DT_File}
+}
+
+// songDirents returns the Dirent of the sorted Keys of
+// an Album. The lyrics are listed after the Songs that
+// have them and the cover files at the end when any
+// Song has a cover.
+func songDirents(keys []string, songs map[string]SongStore) []fuse.Dirent {
+	var a []fuse.Dirent
+	hasCover := false
+	for _, k := range keys {
+		a = append(a, bucketDirent(k, false))
+		song := songs[k]
+		if song.HasCover {
+			hasCover = true
+		}
+		if song.HasLyrics {
+			a = append(a, bucketDirent(LyricsName(k), false))
+		}
+	}
+
+	if hasCover {
+		for _, name := range CoverFiles {
+			a = append(a, bucketDirent(name, false))
+		}
+	}
+	return a
+}
+
+// ListArtists returns all the Dirent corresponding
+// to Artists in the current Store.
+func ListArtists() ([]fuse.Dirent, error) {
+	return backend.ListArtists()
+}
+
+// GetArtistPath checks that a specified Artist exists
+// and returns the Artist name.
+func GetArtistPath(artist string) (string, error) {
+	return backend.GetArtistPath(artist)
+}
+
+// CreateArtist creates a new Artist from a Raw name and
+// returns the compatible string used as Directory name.
+// The names of the special Directories return
+// fuse.EPERM.
+func CreateArtist(nameRaw string) (string, error) {
+	if reservedArtist(nameRaw) {
+		return GetCompatibleString(nameRaw), fuse.EPERM
+	}
+	return backend.CreateArtist(nameRaw)
+}
+
+// DeleteArtist deletes the specified Artist and the
+// files of its songs.
+func DeleteArtist(artist, mPoint string) error {
+	return backend.DeleteArtist(artist, mPoint)
+}
+
+// MoveArtist changes the Artist path moving all its
+// Albums into the new Artist. The names of the special
+// Directories return fuse.EPERM.
+func MoveArtist(oldArtist, newArtist, mPoint string) error {
+	if reservedArtist(newArtist) {
+		return fuse.EPERM
+	}
+	return backend.MoveArtist(oldArtist, newArtist, mPoint)
+}
+
+// ListAlbums returns all the Dirent corresponding
+// to Albums for a specified Artist.
+func ListAlbums(artist string) ([]fuse.Dirent, error) {
+	return backend.ListAlbums(artist)
+}
+
+// GetAlbumPath checks that a specified Artist and Album
+// exist and returns the Artist name.
+func GetAlbumPath(artist string, album string) (string, error) {
+	return backend.GetAlbumPath(artist, album)
+}
+
+// CreateAlbum creates an Album for a specific Artist from
+// a Raw name and returns the compatible string used as
+// Directory name.
+func CreateAlbum(artist string, nameRaw string) (string, error) {
+	return backend.CreateAlbum(artist, nameRaw)
+}
+
+// DeleteAlbum deletes the specified Album and the files
+// of its songs.
+func DeleteAlbum(artistName, albumName, mPoint string) error {
+	return backend.DeleteAlbum(artistName, albumName, mPoint)
+}
+
+// MoveAlbum changes the Album path moving all its Songs
+// into the new Album.
+func MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint string) error {
+	return backend.MoveAlbum(oldArtist, oldAlbum, newArtist, newAlbum, mPoint)
+}
+
+// WalkAlbums calls fn for every Album with the full
+// paths of the songs it contains.
+func WalkAlbums(fn func(artist, album string, paths []string) error) error {
+	return backend.WalkAlbums(fn)
+}
+
+// ListSongs returns all the Dirent corresponding to
+// Songs for a specified Artist and Album.
+func ListSongs(artist string, album string) ([]fuse.Dirent, error) {
+	return backend.ListSongs(artist, album)
+}
+
+// GetSong returns the SongStore object of a Song.
+func GetSong(artist, album, song string) (SongStore, error) {
+	return backend.GetSong(artist, album, song)
+}
+
+// GetFilePath returns the full path to the Song file.
+func GetFilePath(artist, album, song string) (string, error) {
+	return backend.GetFilePath(artist, album, song)
+}
+
+// GetSongByPath returns the Artist, Album and Song
+// stored for the file in the specified path.
+func GetSongByPath(path string) (string, string, string, error) {
+	return backend.GetSongByPath(path)
+}
+
+// StoreNewSong stores a Song from the information in its
+// tags creating the Artist and Album if needed.
+// The Songs of an Artist with the name of a special
+// Directory return fuse.EPERM.
+func StoreNewSong(song *musicmgr.FileTags, path string) error {
+	if reservedArtist(song.Artist) {
+		return fuse.EPERM
+	}
+	return backend.StoreNewSong(song, path)
+}
+
+// CreateSong creates a Song for a specific Artist and
+// Album and returns the compatible string used as File
+// name.
+func CreateSong(artist string, album string, nameRaw string, path string) (string, error) {
+	return backend.CreateSong(artist, album, nameRaw, path)
+}
+
+// UpdateSongTags stores the tags read from the song file,
+// the name and paths of the Song are not modified.
+func UpdateSongTags(artist, album, song string, tags *musicmgr.FileTags) error {
+	return backend.UpdateSongTags(artist, album, song, tags)
+}
+
+// DeleteSong deletes the specified Song and removes it
+// from its playlists.
+func DeleteSong(artist, album, song, mPoint string) error {
+	return backend.DeleteSong(artist, album, song, mPoint)
+}
+
+// WalkSongs calls fn for every Song with the full path of
+// the file and the tags stored for it.
+func WalkSongs(fn func(path string, tags musicmgr.FileTags) error) error {
+	return backend.WalkSongs(fn)
+}
+
+// GetDescription returns the description of an Artist,
+// Album or Song as a JSON object.
+func GetDescription(artist string, album string, name string) (string, error) {
+	return backend.GetDescription(artist, album, name)
+}
+
+// ListPlaylists returns all the playlists available in
+// the MuLi system.
+func ListPlaylists() ([]fuse.Dirent, error) {
+	return backend.ListPlaylists()
+}
+
+// GetPlaylistPath checks that a specified playlist exists
+// and returns the playlist name.
+func GetPlaylistPath(playlist string) (string, error) {
+	return backend.GetPlaylistPath(playlist)
+}
+
+// GetPlaylistFile returns the PlaylistFile stored for a
+// song inside a playlist.
+func GetPlaylistFile(playlist, song string) (playlistmgr.PlaylistFile, error) {
+	return backend.GetPlaylistFile(playlist, song)
+}
+
+// ListPlaylistSongs returns all the songs inside a
+// playlist.
+func ListPlaylistSongs(playlist, mPoint string) ([]fuse.Dirent, error) {
+	return backend.ListPlaylistSongs(playlist, mPoint)
+}
+
+// CreatePlaylist creates a playlist and returns the
+// compatible name used for it.
+func CreatePlaylist(name, mPoint string) (string, error) {
+	return backend.CreatePlaylist(name, mPoint)
+}
+
+// DeletePlaylist deletes a playlist, the links from its
+// songs and the playlist directory.
+func DeletePlaylist(name, mPoint string) error {
+	return backend.DeletePlaylist(name, mPoint)
+}
+
+// RenamePlaylist moves the entire playlist and changes
+// the links in every song.
+func RenamePlaylist(oldName, newName, mPoint string) (string, error) {
+	return backend.RenamePlaylist(oldName, newName, mPoint)
+}
+
+// AddFileToPlaylist adds a file that exists in MuLi to a
+// specific playlist.
+func AddFileToPlaylist(file playlistmgr.PlaylistFile, playlistName string) error {
+	return backend.AddFileToPlaylist(file, playlistName)
+}
+
+// DeletePlaylistSong deletes a specific song from a
+// playlist.
+func DeletePlaylistSong(playlist, name string, force bool) error {
+	return backend.DeletePlaylistSong(playlist, name, force)
+}
+
+// RegeneratePlaylistFile writes the playlist file from
+// the stored information.
+func RegeneratePlaylistFile(name, mPoint string) error {
+	return backend.RegeneratePlaylistFile(name, mPoint)
+}
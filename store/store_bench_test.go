@@ -0,0 +1,208 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+)
+
+// The benchmarks measure the store operations used by
+// the filesystem on a generated Music Library:
+//
+//	go test -run NONE -bench . ./store -args -tracks 50000
+//
+// The parallel runs call the operations from several
+// goroutines at the same time like the FUSE requests
+// do, use -cpu to change the amount of them.
+// The reopen runs open and close the database around
+// every call, like the store did before the database
+// was kept open, they are the baseline for the others.
+var benchTracks = flag.Int("tracks", 10000, "Amount of tracks in the generated library.")
+
+// benchSong is a generated track, with the Keys used
+// in the store.
+type benchSong struct {
+	artist string
+	album  string
+	title  string
+}
+
+// benchOperation is one of the measured store calls.
+type benchOperation struct {
+	name string
+	run  func(s benchSong) error
+}
+
+var benchOperations = []benchOperation{
+	{"ListArtists", func(s benchSong) error {
+		_, err := ListArtists()
+		return err
+	}},
+	{"GetArtistPath", func(s benchSong) error {
+		_, err := GetArtistPath(s.artist)
+		return err
+	}},
+	{"ListAlbums", func(s benchSong) error {
+		_, err := ListAlbums(s.artist)
+		return err
+	}},
+	{"GetAlbumPath", func(s benchSong) error {
+		_, err := GetAlbumPath(s.artist, s.album)
+		return err
+	}},
+	{"ListSongs", func(s benchSong) error {
+		_, err := ListSongs(s.artist, s.album)
+		return err
+	}},
+	{"GetFilePath", func(s benchSong) error {
+		_, err := GetFilePath(s.artist, s.album, s.title)
+		return err
+	}},
+	{"GetSong", func(s benchSong) error {
+		_, err := GetSong(s.artist, s.album, s.title)
+		return err
+	}},
+	{"GetDescription", func(s benchSong) error {
+		_, err := GetDescription(s.artist, s.album, ".description")
+		return err
+	}},
+}
+
+// benchTags returns the tags and the path of the
+// generated track number i, there are 10 tracks per
+// Album and 10 Albums per Artist.
+func benchTags(i int) (musicmgr.FileTags, string) {
+	tags := musicmgr.FileTags{
+		Title:  "Song " + strconv.Itoa(i%10),
+		Artist: "Artist " + strconv.Itoa(i/100),
+		Album:  "Album " + strconv.Itoa(i/10%10),
+		Genre:  "Genre " + strconv.Itoa(i%20),
+		Year:   1950 + i%70,
+		Track:  i%10 + 1,
+	}
+	return tags, fmt.Sprintf("/music/%d/%d/%d.mp3", i/100, i/10%10, i%10)
+}
+
+// openBenchDB opens a new database in a temporary
+// directory, the returned function closes and deletes
+// it.
+func openBenchDB(b *testing.B) func() {
+	dir, err := ioutil.TempDir("", "mulibench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = InitDB(filepath.Join(dir, "muli.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+
+	return func() {
+		CloseDB()
+		os.RemoveAll(dir)
+	}
+}
+
+// reopenBenchDB closes the shared database and opens
+// it again.
+func reopenBenchDB() error {
+	path := db.Path()
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	var err error
+	db, err = bolt.Open(path, 0600, nil)
+	return err
+}
+
+func BenchmarkStoreNewSong(b *testing.B) {
+	defer openBenchDB(b)()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tags, path := benchTags(i)
+		if err := StoreNewSong(&tags, path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOperations(b *testing.B) {
+	defer openBenchDB(b)()
+
+	songs := make([]benchSong, 0, *benchTracks)
+	for i := 0; i < *benchTracks; i++ {
+		tags, path := benchTags(i)
+		if err := StoreNewSong(&tags, path); err != nil {
+			b.Fatal(err)
+		}
+
+		songs = append(songs, benchSong{
+			artist: GetCompatibleString(tags.Artist),
+			album:  GetCompatibleString(tags.Album),
+			title:  GetCompatibleString(tags.Title) + ".mp3",
+		})
+	}
+
+	for _, op := range benchOperations {
+		op := op
+		b.Run(op.name, func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < b.N; i++ {
+				if err := op.run(songs[r.Intn(len(songs))]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(op.name+"Reopen", func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < b.N; i++ {
+				if err := reopenBenchDB(); err != nil {
+					b.Fatal(err)
+				}
+				if err := op.run(songs[r.Intn(len(songs))]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(op.name+"Parallel", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(1))
+				for pb.Next() {
+					if err := op.run(songs[r.Intn(len(songs))]); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
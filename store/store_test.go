@@ -0,0 +1,79 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/dankomiocevic/mulifs/musicmgr"
+)
+
+// TestReservedArtists checks that no Artist gets the
+// name of a special Directory.
+func TestReservedArtists(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+	SetStore(NewMemoryStore())
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+
+	for _, name := range []string{"genres", "years!", "search", "drop"} {
+		if _, err := CreateArtist(name); err != fuse.EPERM {
+			t.Errorf("Creating the Artist %s returned %v", name, err)
+		}
+	}
+	if _, err := CreateArtist("Search"); err != nil {
+		t.Errorf("Creating the Artist Search returned %v", err)
+	}
+
+	tags := musicmgr.FileTags{Title: "Song", Artist: "decades", Album: "Album"}
+	if err := StoreNewSong(&tags, mPoint+"song.mp3"); err != fuse.EPERM {
+		t.Errorf("Storing a Song of the Artist decades returned %v", err)
+	}
+
+	artist, _, _ := addTestSong(t, mPoint, "The Band", "First Album", "Song One.mp3")
+	if err := MoveArtist(artist, "playlists", mPoint); err != fuse.EPERM {
+		t.Errorf("Moving an Artist to playlists returned %v", err)
+	}
+	if got := direntNames(ListArtists()); got != "Search,The_Band" {
+		t.Errorf("Wrong Artists: %s", got)
+	}
+}
+
+// TestInitDBKeepsStore checks that opening the database
+// does not replace the Store set with SetStore.
+func TestInitDBKeepsStore(t *testing.T) {
+	old := CurrentStore()
+	defer SetStore(old)
+	memory := NewMemoryStore()
+	SetStore(memory)
+
+	mPoint, remove := tempMount(t)
+	defer remove()
+	err := InitDB(filepath.Join(mPoint, "muli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB()
+
+	if CurrentStore() != memory {
+		t.Error("InitDB replaced the Store.")
+	}
+}
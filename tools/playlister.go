@@ -81,5 +81,34 @@ func ScanPlaylistFolder(root string) error {
 			visitPlaylist(f.Name(), fullPath, root)
 		}
 	}
+
+	// The smart playlists are written again with the
+	// Songs that match their rules now.
+	for _, f := range files {
+		if f.IsDir() {
+			visitRules(f.Name(), root)
+		}
+	}
 	return nil
 }
+
+// visitRules creates the smart playlist if the
+// Directory contains a rules file and writes its
+// playlist file again.
+func visitRules(name, mPoint string) error {
+	text, _, err := playlistmgr.ReadRules(name, mPoint)
+	if err != nil || len(strings.TrimSpace(text)) == 0 {
+		return err
+	}
+
+	if store.GetCompatibleString(name) != name {
+		glog.Infof("Wrong smart playlist name: %s\n", name)
+		return nil
+	}
+
+	_, err = store.CreatePlaylist(name, mPoint)
+	if err != nil {
+		return err
+	}
+	return store.RegeneratePlaylistFile(name, mPoint)
+}
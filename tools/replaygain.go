@@ -0,0 +1,76 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package tools
+
+import (
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/store"
+	"github.com/golang/glog"
+)
+
+// replayGainAlbum measures the loudness of the songs in
+// an Album and writes the ReplayGain tags on them.
+// The songs that cannot be decoded are skipped and
+// they are not used to calculate the Album gain.
+func replayGainAlbum(artist, album string, paths []string) error {
+	glog.Infof("Calculating ReplayGain for Artist: %s Album: %s\n", artist, album)
+	var songs []*musicmgr.Loudness
+	var songPaths []string
+	for _, path := range paths {
+		loudness, err := musicmgr.AnalyzeLoudness(path)
+		if err != nil {
+			glog.Infof("Cannot analyze %s: %s\n", path, err)
+			continue
+		}
+		if loudness.Silent() {
+			glog.Infof("Skipping silent song %s\n", path)
+			continue
+		}
+		songs = append(songs, loudness)
+		songPaths = append(songPaths, path)
+	}
+
+	if len(songs) == 0 {
+		return nil
+	}
+
+	albumLoudness := musicmgr.AlbumLoudness(songs)
+	for i, song := range songs {
+		rg := musicmgr.ReplayGain{
+			TrackGain: song.Gain(),
+			TrackPeak: song.Peak,
+			AlbumGain: albumLoudness.Gain(),
+			AlbumPeak: albumLoudness.Peak,
+		}
+
+		glog.Infof("Writing ReplayGain %.2f dB in %s\n", rg.TrackGain, songPaths[i])
+		err := musicmgr.SetReplayGain(songPaths[i], rg)
+		if err != nil {
+			glog.Errorf("Error writing ReplayGain in %s: %s\n", songPaths[i], err)
+		}
+	}
+	return nil
+}
+
+// ReplayGain decodes the songs in the database and
+// writes the track and album ReplayGain tags on them,
+// based on their EBU R128 loudness.
+// The album gain is calculated with all the songs in
+// the same Album directory.
+func ReplayGain() error {
+	return store.WalkAlbums(replayGainAlbum)
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package tools
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dankomiocevic/mulifs/store"
+	"github.com/golang/glog"
+)
+
+// restoreTimeLayouts are the formats accepted for the
+// time of the restore_since command, the ones without
+// a time zone use the local time.
+var restoreTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseRestoreTime parses the time of the
+// restore_since command.
+func parseRestoreTime(value string) (time.Time, error) {
+	for _, layout := range restoreTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Wrong time format: " + value)
+}
+
+// RestoreFile restores the tags the music file had
+// before MuLi modified them for the first time.
+func RestoreFile(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Restoring the tags of %s\n", path)
+	return store.RestoreFile(path)
+}
+
+// RestoreAlbum restores the original tags of every
+// song that belonged to the Album, which is specified
+// in the Artist/Album form.
+func RestoreAlbum(name string) error {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) != 2 {
+		return errors.New("The Album must be specified as Artist/Album.")
+	}
+
+	restored, err := store.RestoreAlbum(parts[0], parts[1])
+	glog.Infof("Restored the tags of %d songs\n", restored)
+	return err
+}
+
+// RestoreSince reverts all the changes done in the
+// tags after the specified time.
+func RestoreSince(value string) error {
+	since, err := parseRestoreTime(value)
+	if err != nil {
+		return err
+	}
+
+	restored, err := store.RestoreSince(since)
+	glog.Infof("Restored the tags of %d songs\n", restored)
+	return err
+}
@@ -26,16 +26,22 @@ import (
 	"github.com/golang/glog"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 // visit checks that the specified file is
 // a music file and is on the correct path.
 // If it is ok, it stores it on the database.
-func visit(path string, f os.FileInfo, err error) error {
-	if strings.HasSuffix(path, ".mp3") {
+// The missing tags are inferred from the path
+// relative to the scanned root.
+func visit(root, path string) error {
+	if musicmgr.IsMusicFile(path) {
 		glog.Infof("Reading %s\n", path)
-		err, f := musicmgr.GetMp3Tags(path)
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			relPath = filepath.Base(path)
+		}
+
+		err, f := musicmgr.GetTagsFromPath(path, relPath)
 		if err != nil {
 			glog.Errorf("Error in %s\n", path)
 		}
@@ -45,6 +51,10 @@ func visit(path string, f os.FileInfo, err error) error {
 		if f.Artist == "playlists" {
 			glog.Errorf("Error in %s\n", path)
 		}
+		artist, album, song, err := store.GetSongByPath(path)
+		if err == nil {
+			glog.Infof("Updating %s/%s/%s from %s\n", artist, album, song, path)
+		}
 		store.StoreNewSong(&f, path)
 	}
 	return nil
@@ -55,7 +65,9 @@ func visit(path string, f os.FileInfo, err error) error {
 // It uses filepath to walk through the file tree
 // and calls visit on every endpoint found.
 func ScanFolder(root string) error {
-	err := filepath.Walk(root, visit)
+	err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		return visit(root, path)
+	})
 	// TODO: Scan playlists
 	return err
 }
@@ -0,0 +1,43 @@
+// Copyright 2016 Danko Miocevic. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Author: Danko Miocevic
+
+package tools
+
+import (
+	"github.com/dankomiocevic/mulifs/musicmgr"
+	"github.com/dankomiocevic/mulifs/store"
+	"github.com/golang/glog"
+)
+
+// writeSongTags stores the tags from the database in
+// the song file. The errors are logged and the rest of
+// the songs are still processed.
+func writeSongTags(path string, tags musicmgr.FileTags) error {
+	glog.Infof("Writing tags in %s\n", path)
+	err := musicmgr.SetAllTags(tags, path)
+	if err != nil {
+		glog.Errorf("Error writing tags in %s: %s\n", path, err)
+	}
+	return nil
+}
+
+// WriteTags stores the tags from the database in every
+// song file, including the default values of the
+// missing tags and the changes done while the tags
+// were read only.
+func WriteTags() error {
+	return store.WalkSongs(writeSongTags)
+}